@@ -2,149 +2,5671 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
+	"io/fs"
 	"log"
+	"net/http"
 	"os"
+	"os/exec"
+	"path"
 	"path/filepath"
+	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
 )
 
+// rootTemplateName is the name of the template expansion starts from.
+const rootTemplateName = "cloud-init.tmpl.yaml"
+
+// goldenName is the file in a fixture directory holding the expected
+// expansion of its root template.
+const goldenName = "expected.yaml"
+
+// projectConfigName is the file holding defaults for the command line
+// options, looked for in the template directory and each directory above.
+const projectConfigName = ".cloudinit.yaml"
+
+// expectedErrorName is the file in a fixture directory holding, instead of
+// goldenName, part of the error expanding its root template fails with.
+const expectedErrorName = "expected-error.txt"
+
+// optionsName is the file in a fixture directory setting the options its
+// root template is expanded with, as a JSON object of Expander fields.
+const optionsName = "options.json"
+
+// sniffSize is how much of an included file is looked at to tell whether
+// it's binary.
+const sniffSize = 8192
+
+// dirConfigName is the name of the file configuring how the directory it's
+// in is included. It's never included itself.
+const dirConfigName = ".include.yaml"
+
+// defaultMaxDirDepth is how deep directory includes descend into nested
+// directories unless Expander.MaxDirDepth says otherwise.
+const defaultMaxDirDepth = 100
+
+// Styles of the paths shown in START/END markers.
+const (
+	// MarkerPathRoot shows paths relative to the root of FS.
+	MarkerPathRoot = "root"
+	// MarkerPathAbs shows absolute paths on disk.
+	MarkerPathAbs = "abs"
+	// MarkerPathRelativeToParent shows paths relative to the directory of
+	// the including file.
+	MarkerPathRelativeToParent = "relative-to-parent"
+)
+
+// defaultProfile is the subdirectory `#include-env:` directives fall back
+// to when there is none for the active profile.
+const defaultProfile = "default"
+
+// includeModifiers are the words that can follow the path of an include:
+//   - dedent strips the indentation common to all lines of the content.
+//   - fold pastes the content as a single double-quoted scalar, with its
+//     newlines, quotes and backslashes escaped.
+//   - fold-plain pastes the content as a single plain scalar, with its
+//     lines trimmed and joined by spaces.
+//   - nosep leaves out the empty line that otherwise follows the content.
+var includeModifiers = map[string]bool{"dedent": true, "fold": true, "fold-plain": true, "nosep": true}
+
+// disabledPrefixes start include directives that have been switched off.
+var disabledPrefixes = []string{"##include:", "#include-disabled:"}
+
+// includeTagPattern matches a block mapping value or sequence item that is
+// a `!include <path>` YAML tag, capturing the text before the tag, the
+// indentation of the key or item and the path.
+var includeTagPattern = regexp.MustCompile(`^((\s*)(?:- +)?(?:[^\s#{\[-][^#]*?: +)?)!include +([^\s,\]}]+)\s*$`)
+
+// includeLiteralPattern matches an `#include-literal: <path> [chomp]`
+// directive after a block mapping key or sequence dash, capturing the text
+// before it, the indentation of the key or item, the path and the chomping.
+var includeLiteralPattern = regexp.MustCompile(`^((\s*)(?:- +)?(?:[^\s#{\[-][^#]*?: +)?)#include-literal: *(\S+)(?: +(strip|clip|keep))?\s*$`)
+
+// flowIncludeTagPattern matches a `!include` tag inside a flow collection.
+var flowIncludeTagPattern = regexp.MustCompile(`[\[{][^#]*!include\s`)
+
+// varPattern matches `${NAME}` variable references.
+var varPattern = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// Warning is a problem found during an expansion that doesn't stop it.
+type Warning struct {
+	// File is the path of the file the problem is in, as shown in
+	// errors, or empty if it isn't about a single file.
+	File string
+	// Line is the line in File, or 0 if it isn't about a single line.
+	Line int
+	// Message describes the problem.
+	Message string
+}
+
+func (w Warning) String() string {
+	if w.File == "" {
+		return w.Message
+	}
+	return w.location() + ": " + w.Message
+}
+
+// location returns where the problem is, as `file` or `file:line`.
+func (w Warning) location() string {
+	if w.Line == 0 {
+		return w.File
+	}
+	return fmt.Sprintf("%s:%d", w.File, w.Line)
+}
+
+// IncludeNotFoundError is returned when an include directive names a path
+// that doesn't exist.
+type IncludeNotFoundError struct {
+	// Path is the missing path, as shown in errors.
+	Path string
+	// FromFile and Line are where the include directive is.
+	FromFile string
+	Line     int
+	// Err is the error from looking up Path.
+	Err error
+}
+
+func (e *IncludeNotFoundError) Error() string {
+	return fmt.Sprintf("include path not found %s: %v", e.Path, e.Err)
+}
+
+func (e *IncludeNotFoundError) Unwrap() error {
+	return e.Err
+}
+
+// CycleError is returned when a file includes itself, directly or through
+// other files.
+type CycleError struct {
+	// Chain lists the files from the outermost to the one included again,
+	// as shown in errors.
+	Chain []string
+}
+
+func (e *CycleError) Error() string {
+	return "include cycle detected: " + strings.Join(e.Chain, " -> ")
+}
+
+// DepthExceededError is returned when a directory include finds directories
+// nested deeper than Expander.MaxDirDepth.
+type DepthExceededError struct {
+	// File is the included directory, as shown in errors.
+	File string
+	// Depth is the limit that was exceeded.
+	Depth int
+}
+
+func (e *DepthExceededError) Error() string {
+	return fmt.Sprintf("directories below %s are nested more than %d levels deep", e.File, e.Depth)
+}
+
+// Stats describes the work done by an expansion.
+type Stats struct {
+	// Files is the number of files read. Files included several times are
+	// only read once.
+	Files int
+	// Bytes is the total size of the files read.
+	Bytes int64
+	// MaxDepth is the deepest nesting of includes, 0 if the template has
+	// no includes.
+	MaxDepth int
+	// Duration is the wall-clock time the expansion took.
+	Duration time.Duration
+}
+
+// SourceMapping maps a range of output lines to the lines of the source
+// file they came from. Line numbers start at 1 and ranges are inclusive.
+type SourceMapping struct {
+	OutputStart int    `json:"outputStart"`
+	OutputEnd   int    `json:"outputEnd"`
+	Source      string `json:"source"`
+	SourceLine  int    `json:"sourceLine"`
+}
+
+// Explanation says where a range of output lines came from, for humans
+// rather than tools. Line numbers start at 1 and ranges are inclusive.
+type Explanation struct {
+	OutputStart int
+	OutputEnd   int
+	// Source is the file the lines came from, SourceStart and SourceEnd
+	// the first and last of its lines.
+	Source      string
+	SourceStart int
+	SourceEnd   int
+	// IncludedFrom and IncludedLine are where the directive that included
+	// Source is, IncludedFrom is "" for the root template.
+	IncludedFrom string
+	IncludedLine int
+}
+
+// SourceMap maps the lines of an expanded template back to their origin.
+// Lines the expander generates, such as START/END markers, aren't mapped.
+type SourceMap struct {
+	Mappings []SourceMapping `json:"mappings"`
+}
+
+// lineOrigin is the file and line a line of output comes from. line is 0
+// for generated lines.
+type lineOrigin struct {
+	file string
+	line int
+	// includedAt is, for the START marker of an included file, where the
+	// directive that included it is.
+	includedAt *lineOrigin
+}
+
+// writeLiteralBlock adds key followed by content as a literal block scalar,
+// with its lines indented by indentation. Chomping keeps the trailing
+// newlines of content exactly. The lines of content come from file.
+func (b *fragmentBuilder) writeLiteralBlock(key string, keyOrigin lineOrigin, file string, content string, indentation string) {
+	header := "|"
+	body := strings.TrimRight(content, "\n")
+	switch trailing := len(content) - len(body); {
+	case trailing == 0:
+		header = "|-"
+	case trailing > 1:
+		header = "|+"
+	}
+	// A body starting with whitespace needs an explicit indentation indicator.
+	if strings.HasPrefix(body, " ") || strings.HasPrefix(body, "\t") {
+		header = header[:1] + "2" + header[1:]
+	}
+
+	b.writeLine(key+header, keyOrigin)
+	bodyLines := strings.Split(body, "\n")
+	for i, bodyLine := range bodyLines {
+		if bodyLine != "" {
+			bodyLine = indentation + bodyLine
+		}
+		b.writeLine(bodyLine, lineOrigin{file: file, line: i + 1})
+	}
+	for i := len(body) + 1; i < len(content); i++ {
+		b.writeLine("", lineOrigin{file: file, line: len(bodyLines) + i - len(body)})
+	}
+}
+
+// fragment is processed content along with the origin of each of its lines.
+type fragment struct {
+	content string
+	origins []lineOrigin
+}
+
+// trimRight strips the trailing newlines of f, along with the lines of
+// nothing but whitespace before them, such as the empty lines separating
+// includes, which are indented like the include.
+func (f fragment) trimRight() fragment {
+	content := strings.TrimRight(f.content, "\n")
+	for content != "" {
+		last := content[strings.LastIndex(content, "\n")+1:]
+		if strings.TrimSpace(last) != "" {
+			break
+		}
+		content = strings.TrimRight(content[:len(content)-len(last)], "\n")
+	}
+	lines := 0
+	if content != "" {
+		lines = strings.Count(content, "\n") + 1
+	}
+	return fragment{content: content, origins: f.origins[:lines]}
+}
+
+// dedent strips the leading whitespace common to all non-blank lines of f,
+// leaving the START/END markers of the files in it alone.
+func (f fragment) dedent() fragment {
+	lines := strings.Split(f.content, "\n")
+	isMarker := func(i int) bool {
+		return i >= len(f.origins) || isMarkerLine(lines[i], f.origins[i])
+	}
+
+	prefix, found := "", false
+	for i, line := range lines {
+		if strings.TrimSpace(line) == "" || isMarker(i) {
+			continue
+		}
+		indentation := line[:len(line)-len(strings.TrimLeft(line, " \t"))]
+		if !found {
+			prefix, found = indentation, true
+			continue
+		}
+		for !strings.HasPrefix(indentation, prefix) {
+			prefix = prefix[:len(prefix)-1]
+		}
+	}
+	if prefix == "" {
+		return f
+	}
+
+	for i, line := range lines {
+		if !isMarker(i) {
+			lines[i] = strings.TrimPrefix(line, prefix)
+		}
+	}
+	return fragment{content: strings.Join(lines, "\n"), origins: f.origins}
+}
+
+// trimTrailingWhitespace strips the trailing spaces and tabs of the lines of
+// f, leaving the lines of block scalars alone. Block scalars are found line
+// by line like in quotedMarkers: they start after a line ending in `|` or
+// `>` and take the lines indented more than it.
+func (f fragment) trimTrailingWhitespace() fragment {
+	lines := strings.Split(f.content, "\n")
+	blockIndent := -1
+	for i, line := range lines {
+		indent := len(leadingWhitespace(line))
+		if blockIndent >= 0 {
+			if strings.TrimSpace(line) == "" || indent > blockIndent {
+				continue
+			}
+			blockIndent = -1
+		}
+		lines[i] = strings.TrimRight(line, " \t")
+		if blockScalarPattern.MatchString(lines[i]) {
+			blockIndent = indent
+		}
+	}
+	return fragment{content: strings.Join(lines, "\n"), origins: f.origins}
+}
+
+// sortLists sorts the entries of the block sequences under the top-level
+// keys of sortBy by the value of their field. An entry moves together with
+// the comments right above it and the END markers closing its START
+// markers, so the markers of included files still wrap what they included.
+func (f fragment) sortLists(sortBy map[string]string) fragment {
+	f = f.trimRight()
+	if f.content == "" {
+		return f
+	}
+	lines := strings.Split(f.content, "\n")
+	origins := append([]lineOrigin(nil), f.origins...)
+	for i := 0; i < len(lines); i++ {
+		key, ok := topLevelKey(lines[i])
+		field, sorted := sortBy[key]
+		if !ok || !sorted {
+			continue
+		}
+		_, value, _ := strings.Cut(lines[i], ":")
+		if value = strings.TrimSpace(value); value != "" && value[0] != '#' {
+			continue
+		}
+		end := i + 1
+		for end < len(lines) {
+			if _, ok := topLevelKey(lines[end]); ok || strings.HasPrefix(lines[end], "---") {
+				break
+			}
+			end++
+		}
+		sortSequence(lines[i+1:end], origins[i+1:end], field)
+		i = end - 1
+	}
+	return fragment{content: strings.Join(lines, "\n"), origins: origins}
+}
+
+// sortSequence sorts the entries of the block sequence in lines, in place,
+// by the value of their field. origins are moved along with lines.
+func sortSequence(lines []string, origins []lineOrigin, field string) {
+	sorter := sequenceSorter{lines: lines, field: field}
+	for i := range lines {
+		trimmed := strings.TrimSpace(lines[i])
+		if trimmed == "-" || strings.HasPrefix(trimmed, "- ") {
+			sorter.indentation = leadingWhitespace(lines[i])
+			break
+		}
+	}
+	sorter.sort(origins)
+}
+
+// canonicalKeyOrder is the order CanonicalOrder puts top-level keys in:
+// who the machine is, its users, storage, packages, files, then commands.
+var canonicalKeyOrder = []string{
+	"hostname", "fqdn", "prefer_fqdn_over_hostname", "manage_etc_hosts", "timezone", "locale", "keyboard",
+	"groups", "users", "disable_root", "ssh_pwauth", "chpasswd", "ssh_authorized_keys", "ssh_keys", "ssh",
+	"disk_setup", "fs_setup", "mounts", "swap", "growpart", "resize_rootfs",
+	"ca_certs", "apt", "yum_repos", "zypper", "snap", "package_update", "package_upgrade", "package_reboot_if_required", "packages",
+	"ntp", "write_files", "bootcmd", "runcmd", "power_state", "final_message",
+}
+
+// canonicalOrder reorders the top-level keys of f into canonicalKeyOrder,
+// the others following in their order. The START and END markers of
+// included files stay around what they included, which moves as one, as
+// in sortLists. The `#cloud-config` line stays first. Output with several
+// `---` documents, or with unbalanced markers, is left alone with a
+// warning.
+func (x *expansion) canonicalOrder(f fragment) fragment {
+	f = f.trimRight()
+	if f.content == "" {
+		return f
+	}
+	lines := strings.Split(f.content, "\n")
+	origins := append([]lineOrigin(nil), f.origins...)
+	header := 0
+	for header < len(lines) {
+		trimmed := strings.TrimSpace(lines[header])
+		if !strings.HasPrefix(trimmed, "#cloud-config") && !strings.HasPrefix(trimmed, "## template:") {
+			break
+		}
+		header++
+	}
+	for i, line := range lines {
+		if strings.HasPrefix(line, "---") {
+			x.warn(Warning{File: x.displayPath(f.origins[i].file), Line: f.origins[i].line, Message: "left the top-level keys in their order, the output has several YAML documents"})
+			return f
+		}
+	}
+	sorter := sequenceSorter{lines: lines[header:], keys: true}
+	if !sorter.sort(origins[header:]) {
+		x.warn(Warning{Message: "left the top-level keys in their order, the START and END markers of the output aren't balanced"})
+		return f
+	}
+	return fragment{content: strings.Join(lines, "\n"), origins: origins}
+}
+
+// singleDocument returns f without the document markers after its first
+// content line, warning about each, see Expander.SingleDocument. Markers
+// followed by anything but a comment, like `--- !tag`, are left alone.
+func (x *expansion) singleDocument(f fragment) fragment {
+	if f.content == "" {
+		return f
+	}
+	var output fragmentBuilder
+	// content is set once there's been a content line, or a marker kept.
+	content := false
+	for i, line := range strings.Split(strings.TrimSuffix(f.content, "\n"), "\n") {
+		if marker := strings.TrimRight(line, " \t"); len(marker) >= 3 && (marker[:3] == "---" || marker[:3] == "...") {
+			marker, rest := marker[:3], marker[3:]
+			if rest == "" || (rest[0] == ' ' || rest[0] == '\t') && strings.HasPrefix(strings.TrimSpace(rest), "#") {
+				if marker == "---" && !content {
+					content = true
+					output.writeLine(line, f.origins[i])
+					continue
+				}
+				x.warn(Warning{File: x.displayPath(f.origins[i].file), Line: f.origins[i].line, Message: fmt.Sprintf("removed the document marker %q, the output is a single document", marker)})
+				continue
+			}
+		}
+		if trimmedLine := strings.TrimSpace(line); trimmedLine != "" && !strings.HasPrefix(trimmedLine, "#") {
+			content = true
+		}
+		output.writeLine(line, f.origins[i])
+	}
+	return output.fragment()
+}
+
+// sequenceSorter sorts the entries of a block sequence, keeping the START
+// and END markers of included files around what they included: the
+// entries between a pair of markers are sorted among themselves, and move
+// as one, ordered by their first value.
+type sequenceSorter struct {
+	lines       []string
+	field       string
+	indentation string
+	// keys sorts top-level keys, by their place in canonicalKeyOrder,
+	// instead of sequence entries.
+	keys bool
+}
+
+// sort sorts s.lines in place, moving origins along, unless the markers
+// aren't balanced. It returns whether it sorted.
+func (s *sequenceSorter) sort(origins []lineOrigin) bool {
+	order, _, _, next, ok := s.group(0, nil)
+	if !ok || next != len(s.lines) {
+		return false
+	}
+
+	sortedLines := make([]string, len(s.lines))
+	sortedOrigins := make([]lineOrigin, len(origins))
+	for i, from := range order {
+		sortedLines[i], sortedOrigins[i] = s.lines[from], origins[from]
+	}
+	copy(s.lines, sortedLines)
+	copy(origins, sortedOrigins)
+	return true
+}
+
+// sortUnit is an entry or a pair of markers with the entries between them,
+// along with the comments right above it.
+type sortUnit struct {
+	lines []int
+	value string
+	found bool
+}
+
+// group sorts the units from line i up to the END marker of the innermost
+// of the open START markers, or the end of the lines if none are open. It
+// returns the sorted line numbers, the value of the first unit, and the
+// line it stopped at. ok is false if the markers aren't balanced.
+func (s *sequenceSorter) group(i int, open []string) (order []int, value string, found bool, next int, ok bool) {
+	var head, pending []int
+	var units []sortUnit
+	for i < len(s.lines) {
+		trimmed := strings.TrimSpace(s.lines[i])
+		var unit sortUnit
+		if name, isEnd := strings.CutPrefix(trimmed, "# END "); isEnd && isOpen(open, name) {
+			if name != open[len(open)-1] {
+				return nil, "", false, i, false
+			}
+			break
+		} else if name, isStart := strings.CutPrefix(trimmed, "# START "); isStart {
+			inner, value, found, end, ok := s.group(i+1, append(open[:len(open):len(open)], name))
+			if !ok || end == len(s.lines) {
+				return nil, "", false, end, false
+			}
+			unit = sortUnit{lines: append(append([]int{i}, inner...), end), value: value, found: found}
+			i = end + 1
+		} else if s.isEntry(i) {
+			end := s.entryEnd(i, open)
+			unit.value, unit.found = s.fieldValue(i, end)
+			for ; i < end; i++ {
+				unit.lines = append(unit.lines, i)
+			}
+		} else {
+			pending = append(pending, i)
+			i++
+			continue
+		}
+
+		// Comments right above the unit belong to it, anything else before
+		// it to the unit before.
+		above, start := len(pending), unit.lines[0]
+		for above > 0 && pending[above-1] == start-1 && strings.HasPrefix(strings.TrimSpace(s.lines[start-1]), "#") {
+			above--
+			start--
+		}
+		unit.lines = append(pending[above:len(pending):len(pending)], unit.lines...)
+		if len(units) == 0 {
+			head = append(head, pending[:above]...)
+		} else {
+			units[len(units)-1].lines = append(units[len(units)-1].lines, pending[:above]...)
+		}
+		pending = nil
+		units = append(units, unit)
+	}
+
+	sort.SliceStable(units, func(a, b int) bool {
+		if units[a].found != units[b].found {
+			return units[a].found
+		}
+		return units[a].value < units[b].value
+	})
+	order = head
+	for _, unit := range units {
+		order = append(order, unit.lines...)
+	}
+	order = append(order, pending...)
+	if len(units) > 0 {
+		value, found = units[0].value, units[0].found
+	}
+	return order, value, found, i, true
+}
+
+// isEntry reports whether line i starts an entry of the sequence.
+func (s *sequenceSorter) isEntry(i int) bool {
+	if s.keys {
+		_, ok := topLevelKey(s.lines[i])
+		return ok
+	}
+	trimmed := strings.TrimSpace(s.lines[i])
+	return leadingWhitespace(s.lines[i]) == s.indentation && (trimmed == "-" || strings.HasPrefix(trimmed, "- "))
+}
+
+// entryEnd returns the line after the entry starting at line i: the first
+// line that isn't indented more than the entry, not counting blank lines
+// at its end, or a marker of the sequence rather than of the entry.
+func (s *sequenceSorter) entryEnd(i int, open []string) int {
+	end := i + 1
+	for ; end < len(s.lines); end++ {
+		line, trimmed := s.lines[end], strings.TrimSpace(s.lines[end])
+		if trimmed == "" || s.keys && (trimmed == "-" || strings.HasPrefix(line, "- ")) {
+			continue
+		}
+		if len(leadingWhitespace(line)) <= len(s.indentation) {
+			break
+		}
+		if name, isEnd := strings.CutPrefix(trimmed, "# END "); isEnd && isOpen(open, name) {
+			break
+		}
+		if strings.HasPrefix(trimmed, "# START ") && s.startsEntries(end) {
+			break
+		}
+	}
+	for end > i+1 && strings.TrimSpace(s.lines[end-1]) == "" {
+		end--
+	}
+	return end
+}
+
+// startsEntries reports whether the comments from line i on are followed
+// by an entry of the sequence.
+func (s *sequenceSorter) startsEntries(i int) bool {
+	for ; i < len(s.lines); i++ {
+		trimmed := strings.TrimSpace(s.lines[i])
+		if trimmed != "" && !strings.HasPrefix(trimmed, "#") {
+			return s.isEntry(i)
+		}
+	}
+	return false
+}
+
+// fieldValue returns the value of the field of the entry on lines start to
+// end, which is either on its `- ` line or indented like the text after
+// the dash on the lines below.
+func (s *sequenceSorter) fieldValue(start, end int) (string, bool) {
+	if s.keys {
+		key, _ := topLevelKey(s.lines[start])
+		for rank, known := range canonicalKeyOrder {
+			if key == known {
+				return fmt.Sprintf("%03d", rank), true
+			}
+		}
+		return "", false
+	}
+	first := strings.TrimSpace(s.lines[start])[1:]
+	fieldIndentation := len(s.indentation) + 1 + len(leadingWhitespace(first))
+	candidates := []string{first}
+	for _, line := range s.lines[start+1 : end] {
+		if len(leadingWhitespace(line)) == fieldIndentation {
+			candidates = append(candidates, line)
+		}
+	}
+	for _, candidate := range candidates {
+		name, value, ok := strings.Cut(strings.TrimSpace(candidate), ":")
+		if ok && unquote(strings.TrimSpace(name)) == s.field {
+			return unquote(strings.TrimSpace(value)), true
+		}
+	}
+	return "", false
+}
+
+// isOpen reports whether the START marker for name is among open.
+func isOpen(open []string, name string) bool {
+	for _, o := range open {
+		if o == name {
+			return true
+		}
+	}
+	return false
+}
+
+// leadingWhitespace returns the spaces and tabs line starts with.
+func leadingWhitespace(line string) string {
+	return line[:len(line)-len(strings.TrimLeft(line, " \t"))]
+}
+
+// isMarkerLine reports whether line, which came from origin, is a START or
+// END marker of an included file.
+func isMarkerLine(line string, origin lineOrigin) bool {
+	return origin.line == 0 && (strings.HasPrefix(line, "# START ") || strings.HasPrefix(line, "# END "))
+}
+
+// includedAt returns f with site as where the files whose START markers
+// are in f were included, unless that's known already from an include
+// within f.
+func (f fragment) includedAt(site lineOrigin) fragment {
+	if f.content == "" {
+		return f
+	}
+	origins := make([]lineOrigin, len(f.origins))
+	for i, line := range strings.Split(strings.TrimSuffix(f.content, "\n"), "\n") {
+		origins[i] = f.origins[i]
+		if trimmedLine := strings.TrimSpace(line); isMarkerLine(trimmedLine, origins[i]) && strings.HasPrefix(trimmedLine, "# START ") && origins[i].includedAt == nil {
+			origins[i].includedAt = &site
+		}
+	}
+	return fragment{content: f.content, origins: origins}
+}
+
+// explain groups the lines of f into runs of lines of the same file,
+// skipping the lines the expander generates, see Expander.Explain.
+func (x *expansion) explain(f fragment) []Explanation {
+	var explanations []Explanation
+	// open holds the START markers of the files the current line is in,
+	// innermost last.
+	var open []lineOrigin
+	for i, line := range strings.Split(strings.TrimSuffix(f.content, "\n"), "\n") {
+		origin := f.origins[i]
+		if trimmedLine := strings.TrimSpace(line); isMarkerLine(trimmedLine, origin) {
+			if strings.HasPrefix(trimmedLine, "# START ") {
+				open = append(open, origin)
+			} else if len(open) > 0 {
+				open = open[:len(open)-1]
+			}
+			continue
+		}
+		if origin.line == 0 {
+			continue
+		}
+		var site lineOrigin
+		for j := len(open) - 1; j >= 0; j-- {
+			if open[j].file == origin.file && open[j].includedAt != nil {
+				site = *open[j].includedAt
+				break
+			}
+		}
+		next := Explanation{OutputStart: i + 1, OutputEnd: i + 1, Source: x.displayPath(origin.file), SourceStart: origin.line, SourceEnd: origin.line}
+		if site.file != "" {
+			next.IncludedFrom, next.IncludedLine = x.displayPath(site.file), site.line
+		}
+		if n := len(explanations); n > 0 {
+			last := &explanations[n-1]
+			if last.Source == next.Source && last.IncludedFrom == next.IncludedFrom && last.IncludedLine == next.IncludedLine && last.SourceEnd < origin.line {
+				last.OutputEnd, last.SourceEnd = next.OutputEnd, next.SourceEnd
+				continue
+			}
+		}
+		explanations = append(explanations, next)
+	}
+	return explanations
+}
+
+// isEmpty reports whether f has nothing but markers, blank lines and
+// comments.
+func (f fragment) isEmpty() bool {
+	for _, line := range strings.Split(f.content, "\n") {
+		if trimmedLine := strings.TrimSpace(line); trimmedLine != "" && !strings.HasPrefix(trimmedLine, "#") {
+			return false
+		}
+	}
+	return true
+}
+
+// fold joins the lines of f, without its markers, into a single line
+// holding a double-quoted scalar, or if plain is set a plain scalar.
+// Content that can't be a plain scalar is an error.
+func (f fragment) fold(plain bool) (fragment, error) {
+	var lines []string
+	var origin lineOrigin
+	for i, line := range strings.Split(strings.TrimSuffix(f.content, "\n"), "\n") {
+		if i >= len(f.origins) || isMarkerLine(line, f.origins[i]) {
+			continue
+		}
+		if origin.line == 0 {
+			origin = f.origins[i]
+		}
+		if plain {
+			line = strings.TrimSpace(line)
+			if line == "" {
+				continue
+			}
+		}
+		lines = append(lines, line)
+	}
+
+	var folded string
+	if plain {
+		folded = strings.Join(lines, " ")
+		if folded == "" || strings.ContainsRune("-?:,[]{}#&*!|>'\"%@`", rune(folded[0])) ||
+			strings.Contains(folded, ": ") || strings.Contains(folded, " #") || strings.HasSuffix(folded, ":") {
+			return fragment{}, fmt.Errorf("content can't be a plain scalar, use fold instead of fold-plain")
+		}
+	} else {
+		// Go's escapes for quoted strings are valid in YAML double-quoted scalars.
+		folded = strconv.Quote(strings.Join(lines, "\n"))
+	}
+	return fragment{content: folded + "\n", origins: []lineOrigin{origin}}, nil
+}
+
+// nestMarkers indents the first and last lines of f, the START/END markers
+// of an included file, by indentation.
+func (f fragment) nestMarkers(indentation string) fragment {
+	lines := strings.Split(strings.TrimSuffix(f.content, "\n"), "\n")
+	lines[0] = indentation + lines[0]
+	lines[len(lines)-1] = indentation + lines[len(lines)-1]
+	return fragment{content: strings.Join(lines, "\n") + "\n", origins: f.origins}
+}
+
+// sourceMap merges the origins of f into ranges of consecutive lines.
+func (f fragment) sourceMap() SourceMap {
+	var m SourceMap
+	for i, origin := range f.origins {
+		if origin.line == 0 {
+			continue
+		}
+		if n := len(m.Mappings); n > 0 {
+			last := &m.Mappings[n-1]
+			if last.OutputEnd == i && last.Source == origin.file && last.SourceLine+(last.OutputEnd-last.OutputStart)+1 == origin.line {
+				last.OutputEnd = i + 1
+				continue
+			}
+		}
+		m.Mappings = append(m.Mappings, SourceMapping{OutputStart: i + 1, OutputEnd: i + 1, Source: origin.file, SourceLine: origin.line})
+	}
+	return m
+}
+
+// fragmentBuilder builds a fragment line by line.
+type fragmentBuilder struct {
+	content strings.Builder
+	origins []lineOrigin
+}
+
+// writeLine adds line. Newlines in it, e.g. from the value of a variable,
+// start further lines of the same origin.
+func (b *fragmentBuilder) writeLine(line string, origin lineOrigin) {
+	b.content.WriteString(line + "\n")
+	for i := strings.Count(line, "\n"); i >= 0; i-- {
+		b.origins = append(b.origins, origin)
+	}
+}
+
+// writeFragment adds the lines of f, prefixing each with indentation.
+// We trim a single trailing newline to avoid creating an extra empty indented line.
+func (b *fragmentBuilder) writeFragment(f fragment, indentation string) {
+	contentToIndent := strings.TrimSuffix(f.content, "\n")
+	if contentToIndent == "" {
+		return
+	}
+	for i, line := range strings.Split(contentToIndent, "\n") {
+		b.writeLine(indentation+line, f.origins[i])
+	}
+}
+
+func (b *fragmentBuilder) fragment() fragment {
+	return fragment{content: b.content.String(), origins: b.origins}
+}
+
+// countingReader counts the bytes read through it.
+type countingReader struct {
+	r io.Reader
+	n *int64
+}
+
+func (c countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	*c.n += int64(n)
+	return n, err
+}
+
+// Expander expands `#include:` directives in cloud-init templates.
+// All paths are slash-separated and resolved inside FS.
+type Expander struct {
+	// FS is the filesystem templates and included files are read from.
+	FS fs.FS
+	// Vars holds the values substituted for `${NAME}` references.
+	// References to names not in Vars are left untouched.
+	Vars map[string]string
+	// Skip lists files that directory includes pass over, such as the
+	// output file of a previous run.
+	Skip []string
+	// DisplayRoot, when set, is joined with the names shown in errors and
+	// warnings, e.g. to show absolute paths. By default they are shown
+	// relative to the root of FS.
+	DisplayRoot string
+	// StreamTimeout is how long to wait for files that aren't regular
+	// files, such as named pipes, to be written. If zero, including them
+	// is an error rather than blocking until a writer shows up.
+	StreamTimeout time.Duration
+	// NoFinalNewline makes the output end without a newline. By default it
+	// ends with exactly one.
+	NoFinalNewline bool
+	// MarkDisabled leaves a `# (disabled) <path>` comment in place of
+	// disabled include directives instead of dropping them silently.
+	MarkDisabled bool
+	// MaxOutputLines, if positive, aborts the expansion as soon as the
+	// output grows beyond that many lines.
+	MaxOutputLines int
+	// WarnDuplicateIncludes warns about files included more than once, e.g.
+	// by both a directory include and an include of a file inside it.
+	WarnDuplicateIncludes bool
+	// MarkerPathStyle is one of the MarkerPath constants, selecting how
+	// START/END markers show included paths. It defaults to MarkerPathRoot.
+	MarkerPathStyle string
+	// AbsRoot is the absolute path on disk of the root of FS, required by
+	// MarkerPathAbs.
+	AbsRoot string
+	// OnWarning is called with every warning. If nil, warnings are logged.
+	OnWarning func(Warning)
+	// DedupContent makes directory includes skip files whose processed
+	// content is identical to that of a file included before from the same
+	// directory.
+	DedupContent bool
+	// IncludeTags makes `key: !include <path>` YAML tags in block context
+	// be replaced by the content of the file, as a literal block scalar.
+	IncludeTags bool
+	// Stats, if not nil, is set to the statistics of each expansion.
+	Stats *Stats
+	// MaxDirDepth limits how deep directory includes descend into nested
+	// directories. It defaults to defaultMaxDirDepth.
+	MaxDirDepth int
+	// SourceMap, if not nil, is set to the source map of each expansion.
+	SourceMap *SourceMap
+	// Explain, if not nil, is set to where the lines of each expansion
+	// came from, as ranges of lines along with the include directives.
+	Explain *[]Explanation
+	// LintDuplicates warns about distinct included files with identical
+	// content, e.g. fragments copied rather than shared.
+	LintDuplicates bool
+	// Inputs, if not nil, is set to the sorted names of the files each
+	// expansion is made of: the root template and everything it included.
+	// Includes reused from the CacheDir add all names they depend on,
+	// which can include directories and names that don't exist.
+	Inputs *[]string
+	// Profile selects the subdirectory `#include-env:` directives include.
+	// Directories without one for the profile fall back to defaultProfile.
+	Profile string
+	// PreserveDirectives keeps include directive lines in the output, right
+	// above the content they include.
+	PreserveDirectives bool
+	// WarnIncludeBytes, if positive, warns about every include that adds
+	// more than that many bytes to the output.
+	WarnIncludeBytes int
+	// CaseInsensitiveIncludes makes includes of paths that don't exist fall
+	// back to a path differing only in case, with a warning, as they would
+	// resolve on Windows. If several paths differ only in case, the
+	// include is an error.
+	CaseInsensitiveIncludes bool
+	// DirWrap surrounds the content of directory includes with a single
+	// START/END marker pair for the directory, indenting the markers of the
+	// files in it beneath.
+	DirWrap bool
+	// CacheDir, if set, is a directory the processed content of included
+	// files is kept in across expansions. Entries are only used while none
+	// of the files and directories read to produce them have changed.
+	// Warnings aren't repeated for content taken from there.
+	CacheDir string
+	// Base64Width, if positive, wraps base64 encoded content into lines of
+	// that many characters, in a literal block scalar.
+	Base64Width int
+	// SkipEmptyIncludes leaves out includes with nothing but whitespace
+	// and comments, markers and separating blank line included.
+	SkipEmptyIncludes bool
+	// LibDirs are directories in FS searched, in order, for include paths
+	// that don't exist relative to the including file.
+	LibDirs []string
+	// ExpandTabs, if positive, replaces the tabs in the indentation of
+	// every line read from a template by spaces, with tab stops every
+	// ExpandTabs columns.
+	ExpandTabs int
+	// Defines holds the flags that switch on `#if FLAG` blocks.
+	Defines map[string]bool
+	// LineEnding ends the lines of the output that come from the root
+	// template, "\n" or "\r\n". It defaults to "\n", whatever the
+	// templates use.
+	LineEnding string
+	// IncludeLineEnding ends the lines that come from included files. It
+	// defaults to LineEnding.
+	IncludeLineEnding string
+	// ErrorOnEmptyDir makes including a directory without any files to
+	// include an error, rather than including nothing.
+	ErrorOnEmptyDir bool
+	// SortLists maps top-level keys to a field, sorting the entries of the
+	// block sequences under them in the output by the value of that field.
+	// Entries without the field keep their order after the others.
+	SortLists map[string]string
+	// TrimTrailingWhitespace strips the spaces and tabs at the end of the
+	// output lines, except inside block scalars where they're content.
+	TrimTrailingWhitespace bool
+	// NoSeparator leaves out the empty line that otherwise follows the
+	// content of every `#include:`, like its nosep modifier.
+	NoSeparator bool
+	// SearchPath are directories in FS searched, in order, for include
+	// paths without a slash, before the directory of the including file.
+	// The first directory that has the path wins, so earlier directories
+	// shadow later ones.
+	SearchPath []string
+	// Verbose logs which of SearchPath each include was found in.
+	Verbose bool
+	// DirRecursion is one of the DirRecursion constants, deciding whether
+	// directory includes descend into subdirectories. It defaults to
+	// DirRecursionDeep, and a directory's dirConfigName can override it.
+	DirRecursion string
+	// PreprocessOnly substitutes variables and resolves `#if` blocks, but
+	// copies include directives and `!include` tags to the output as they
+	// are, without including anything.
+	PreprocessOnly bool
+	// Progress, if not nil, is called with the number of template bytes
+	// read so far each time a file has been read, so long expansions can
+	// report that they're moving, e.g. as a CI heartbeat. Counts only grow
+	// between calls. It's called synchronously from the goroutine running
+	// the expansion, so it should return quickly, and it's only called
+	// concurrently if the Expander is used by several goroutines at once.
+	Progress func(bytesRead int64)
+	// Strict makes included files whose content ends up empty after
+	// substituting variables and resolving `#if` blocks an error instead
+	// of a warning.
+	Strict bool
+	// MaxFileSize, if positive, makes including a file larger than that
+	// many bytes an error, checked before reading it.
+	MaxFileSize int64
+	// PathRewriter, if not nil, is called with every include path as
+	// written, and the name of the file including it, before the path is
+	// resolved. The path it returns is resolved instead, e.g. to redirect a
+	// fragment that moved, and an error aborts the expansion. CacheDir
+	// isn't used with it, as what it returns can't be known in advance.
+	PathRewriter func(rawPath, fromFile string) (string, error)
+	// CanonicalOrder reorders the top-level keys of the output into the
+	// order of canonicalKeyOrder, with unknown keys after the known ones in
+	// the order they came in. Output with several YAML documents is left
+	// alone, with a warning.
+	CanonicalOrder bool
+	// IncludeOnceGlobal includes every file at most once per expansion,
+	// later includes of it adding nothing, e.g. for headers several
+	// fragments include. By default files can be included any number of
+	// times, and only including a file within itself is an error. CacheDir
+	// isn't used with it, as what a file adds depends on what came before.
+	IncludeOnceGlobal bool
+	// IncludeBase is one of the IncludeBase constants, selecting what
+	// include paths are relative to. It defaults to IncludeBaseFile.
+	// SearchPath and LibDirs are looked in as usual.
+	IncludeBase string
+	// WorkDir is the directory IncludeBaseCwd resolves paths relative to,
+	// as a name in FS, e.g. "../.." for a working directory two levels
+	// above the root of FS.
+	WorkDir string
+	// RequireUTF8 makes invalid UTF-8 in templates an error, instead of a
+	// warning with the bytes copied to the output as they are. Invalid
+	// UTF-8 in the first few KiB of an included file is always an error, as
+	// the file looks binary.
+	RequireUTF8 bool
+	// SingleDocument removes the YAML document markers, `---` and `...`
+	// lines, that fragments bring along, with a warning for each, so the
+	// output stays a single document. A `---` before any content is kept.
+	SingleDocument bool
+	// NoRootDirectives copies every line of the root template as it is,
+	// after substituting variables, for a root that's assembled already.
+	// Directives, `#if` blocks included, only work in included files then.
+	NoRootDirectives bool
+	// Header, if not nil, is called with the name of the root template
+	// once it's expanded, and the comment lines it returns are added after
+	// the leading `## template:` and `#cloud-config` lines. They count as
+	// output lines in the SourceMap and Explain.
+	Header func(root string) (string, error)
+}
+
+// expansion holds the state of a single expansion run.
+type expansion struct {
+	*Expander
+	// stack holds the files currently being processed, outermost first.
+	stack []string
+	// cache holds the processed content of included files by cacheKey,
+	// before any indentation is applied, so fragments included several
+	// times are only read and processed once.
+	cache map[string]fragment
+	// refs collects the names of all `${NAME}` references when non-nil.
+	refs map[string]bool
+	// lines counts the lines produced so far. It never exceeds the number
+	// of lines in the output, as the blank lines separating includes aren't
+	// counted.
+	lines int
+	// includedBy lists the directives, as `file:line`, that included each
+	// file, in the order files were first included.
+	includedBy map[string][]string
+	// includeOrder lists the included files in the order they were first
+	// included.
+	includeOrder []string
+	// stats counts the work done so far.
+	stats Stats
+	// deps holds, for every file on the stack that will be stored in the
+	// CacheDir, the names read from FS while processing it.
+	deps []map[string]bool
+	// indent is how far the output of the file being processed will be
+	// indented in the final output.
+	indent int
+	// topKeys collects the top-level keys of the output so far.
+	topKeys map[string]bool
+	// uncacheable holds the files whose processed content depends on
+	// more than their files, such as topKeys or the files being processed
+	// around them, which mustn't be cached.
+	uncacheable map[string]bool
+	// cacheDeps holds the names read to produce the content in cache, by
+	// the same key, when using the CacheDir.
+	cacheDeps map[string]map[string]bool
+	// within holds, for every file on the stack, the files processed
+	// within it so far, and cacheWithin those of the content in cache, by
+	// the same key. Content is only reused while none of them are on the
+	// stack, as processing it again would skip them or fail.
+	within      []map[string]bool
+	cacheWithin map[string]map[string]bool
+	// checking makes includes of paths that don't exist add to missing
+	// rather than fail, and skips reading the files embedded by
+	// `#include-file:` and `!include`, see CheckIncludes.
+	checking bool
+	missing  []*IncludeNotFoundError
+	// inputs collects the names for Expander.Inputs.
+	inputs map[string]bool
+	// scopes holds the vars of the includes being processed, innermost
+	// last, see includeOptions.
+	scopes []map[string]string
+	// filters holds the globs of the `#include-filter:` directives seen so
+	// far, by name.
+	filters map[string][]string
+	// reported is the byte count last passed to Progress.
+	reported int64
+	// once holds the files included so far, with IncludeOnceGlobal.
+	once map[string]bool
+}
+
+// ExpandFile expands the template stored at name in e.FS.
+func (e *Expander) ExpandFile(name string) (string, error) {
+	return e.expand(name, func(x *expansion) (fragment, error) {
+		return x.processFile(path.Clean(name), true)
+	})
+}
+
+// Expand expands the template read from r as if it were stored at name,
+// so that its includes resolve relative to the directory of name.
+func (e *Expander) Expand(name string, r io.Reader) (string, error) {
+	return e.expand(name, func(x *expansion) (fragment, error) {
+		return x.processReader(path.Clean(name), r, true)
+	})
+}
+
+// Evaluate expands the template parsed into nodes by Parse as if it were
+// stored at name, like Expand.
+func (e *Expander) Evaluate(name string, nodes []Node) (string, error) {
+	return e.expand(name, func(x *expansion) (fragment, error) {
+		return x.processNodes(path.Clean(name), nodes, true)
+	})
+}
+
+// expand runs the expansion of the template name, processed by process.
+func (e *Expander) expand(name string, process func(x *expansion) (fragment, error)) (string, error) {
+	start := time.Now()
+	x := &expansion{Expander: e}
+	if e.CacheDir != "" {
+		// Record what's read, so cache entries know what they depend on.
+		recording := *e
+		recording.FS = recordingFS{FS: e.FS, x: x}
+		x.Expander = &recording
+	}
+	processed, err := process(x)
+	if err != nil {
+		return "", err
+	}
+	if e.WarnDuplicateIncludes {
+		x.warnDuplicateIncludes()
+	}
+	if e.LintDuplicates {
+		x.lintDuplicates()
+	}
+	if e.Stats != nil {
+		x.stats.Duration = time.Since(start)
+		*e.Stats = x.stats
+	}
+	if e.Inputs != nil {
+		x.noteInput(path.Clean(name))
+		inputs := make([]string, 0, len(x.inputs))
+		for input := range x.inputs {
+			inputs = append(inputs, input)
+		}
+		sort.Strings(inputs)
+		*e.Inputs = inputs
+	}
+
+	if e.SingleDocument {
+		processed = x.singleDocument(processed)
+	}
+	if len(e.SortLists) > 0 {
+		processed = processed.sortLists(e.SortLists)
+	}
+	if e.CanonicalOrder {
+		processed = x.canonicalOrder(processed)
+	}
+	if e.TrimTrailingWhitespace {
+		processed = processed.trimTrailingWhitespace()
+	}
+	if e.Header != nil {
+		header, err := e.Header(path.Clean(name))
+		if err != nil {
+			return "", err
+		}
+		processed = processed.insertHeader(header, path.Clean(name))
+	}
+	processed = e.finish(processed)
+	if e.SourceMap != nil {
+		*e.SourceMap = processed.sourceMap()
+	}
+	if e.Explain != nil {
+		*e.Explain = x.explain(processed)
+	}
+	content := e.lineEndings(processed, path.Clean(name))
+	if e.MaxOutputLines > 0 && strings.Count(strings.TrimSuffix(content, "\n")+"\n", "\n") > e.MaxOutputLines {
+		return "", fmt.Errorf("output exceeds the limit of %d lines", e.MaxOutputLines)
+	}
+	return content, nil
+}
+
+// TemplateFunc returns a name and function to add to a text/template
+// FuncMap, so that templates can inline expanded fragments with
+// `{{ cloudinit "path/to/fragment.yaml" }}`. Paths are names in e.FS.
+func (e *Expander) TemplateFunc() (string, func(path string) (string, error)) {
+	return "cloudinit", e.ExpandFile
+}
+
+// finish normalizes the end of the expanded content, which otherwise
+// depends on whether the template ends with an include or a literal line.
+func (e *Expander) finish(f fragment) fragment {
+	f = f.trimRight()
+	if f.content == "" || e.NoFinalNewline {
+		return f
+	}
+	f.content += "\n"
+	return f
+}
+
+// lineEndings returns the content of f with the lines that come from the
+// root template root ending in LineEnding, and all others in
+// IncludeLineEnding.
+func (e *Expander) lineEndings(f fragment, root string) string {
+	rootEnding, includeEnding := e.LineEnding, e.IncludeLineEnding
+	if rootEnding == "" {
+		rootEnding = "\n"
+	}
+	if includeEnding == "" {
+		includeEnding = rootEnding
+	}
+	if rootEnding == "\n" && includeEnding == "\n" {
+		return f.content
+	}
+
+	var b strings.Builder
+	lines := strings.SplitAfter(f.content, "\n")
+	for i, line := range lines {
+		withoutNewline := strings.TrimSuffix(line, "\n")
+		if withoutNewline == line || i >= len(f.origins) {
+			b.WriteString(line)
+		} else if f.origins[i].file == root {
+			b.WriteString(withoutNewline + rootEnding)
+		} else {
+			b.WriteString(withoutNewline + includeEnding)
+		}
+	}
+	return b.String()
+}
+
+// ReferencedVars returns the sorted names of all variables referenced by
+// the template stored at name, including those in included files.
+func (e *Expander) ReferencedVars(name string) ([]string, error) {
+	x := &expansion{Expander: e, refs: make(map[string]bool)}
+	if _, err := x.processFile(path.Clean(name), true); err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(x.refs))
+	for ref := range x.refs {
+		names = append(names, ref)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// CheckIncludes checks that the paths of all includes of the template
+// stored at name exist, following the includes of templates, and returns
+// those that don't. Files embedded by `#include-file:` and `!include` are
+// only looked up, not read. Other errors stop the check as they'd stop an
+// expansion.
+func (e *Expander) CheckIncludes(name string) ([]*IncludeNotFoundError, error) {
+	x := &expansion{Expander: e, checking: true}
+	if _, err := x.processFile(path.Clean(name), true); err != nil {
+		return nil, err
+	}
+	return x.missing, nil
+}
+
+// checkExists adds name, included by the directive on line fromLine of
+// from, to x.missing if it doesn't exist.
+func (x *expansion) checkExists(name string, from string, fromLine int) {
+	if _, err := fs.Stat(x.FS, name); err != nil {
+		x.missing = append(x.missing, &IncludeNotFoundError{Path: x.displayPath(name), FromFile: x.displayPath(from), Line: fromLine, Err: x.displayErr(err)})
+	}
+}
+
+// reportProgress calls Progress if more bytes were read since the last
+// call.
+func (x *expansion) reportProgress() {
+	if x.Progress == nil || x.stats.Bytes == x.reported {
+		return
+	}
+	x.reported = x.stats.Bytes
+	x.Progress(x.reported)
+}
+
+// warn reports w through OnWarning, or logs it.
+func (e *Expander) warn(w Warning) {
+	if e.OnWarning != nil {
+		e.OnWarning(w)
+		return
+	}
+	log.Printf("Warning: %s", w)
+}
+
+// countLines adds n lines to the lines produced so far, failing if they
+// exceed MaxOutputLines.
+func (x *expansion) countLines(n int) error {
+	x.lines += n
+	if x.MaxOutputLines > 0 && x.lines > x.MaxOutputLines {
+		return fmt.Errorf("output exceeds the limit of %d lines", x.MaxOutputLines)
+	}
+	return nil
+}
+
+// substituteVars replaces every `${NAME}` reference in line whose name is
+// defined in Vars.
+func (e *Expander) substituteVars(line string) string {
+	if len(e.Vars) == 0 {
+		return line
+	}
+	return varPattern.ReplaceAllStringFunc(line, func(ref string) string {
+		if value, ok := e.Vars[ref[2:len(ref)-1]]; ok {
+			return value
+		}
+		return ref
+	})
+}
+
+// substituteVars is Expander.substituteVars with the variables of scopes
+// shadowing Vars.
+func (x *expansion) substituteVars(line string) string {
+	if len(x.scopes) == 0 {
+		return x.Expander.substituteVars(line)
+	}
+	return varPattern.ReplaceAllStringFunc(line, func(ref string) string {
+		name := ref[2 : len(ref)-1]
+		for i := len(x.scopes) - 1; i >= 0; i-- {
+			if value, ok := x.scopes[i][name]; ok {
+				return value
+			}
+		}
+		if value, ok := x.Vars[name]; ok {
+			return value
+		}
+		return ref
+	})
+}
+
 // processFile reads a given file, expands any `#include:` directives,
 // and returns the fully processed content as a string.
+func (x *expansion) processFile(name string, isRoot bool) (fragment, error) {
+	key := x.cacheKey(name)
+	if cached, ok := x.cache[key]; ok && !isRoot && !x.IncludeOnceGlobal && x.reusable(x.cacheWithin[key]) {
+		if err := x.countLines(len(cached.origins)); err != nil {
+			return fragment{}, err
+		}
+		x.addDeps(x.cacheDeps[key])
+		x.noteWithin(name, x.cacheWithin[key])
+		return cached, nil
+	}
+
+	var diskKey string
+	if x.CacheDir != "" && x.PathRewriter == nil && !x.IncludeOnceGlobal && x.refs == nil && !x.checking && !isRoot {
+		diskKey = x.diskCacheKey(name)
+		if cached, deps, within, ok := x.loadCached(diskKey); ok && x.reusable(within) {
+			if err := x.countLines(len(cached.origins)); err != nil {
+				return fragment{}, err
+			}
+			x.addDeps(deps)
+			for dep := range deps {
+				x.noteInput(dep)
+			}
+			x.noteWithin(name, within)
+			x.remember(key, cached, deps, within)
+			return cached, nil
+		}
+		x.deps = append(x.deps, make(map[string]bool))
+		defer func() { x.deps = x.deps[:len(x.deps)-1] }()
+	}
+
+	info, err := fs.Stat(x.FS, name)
+	if err != nil {
+		return fragment{}, fmt.Errorf("failed to open file %s: %w", x.displayPath(name), x.displayErr(err))
+	}
+
+	if err := x.checkFileSize(name, info); err != nil {
+		return fragment{}, err
+	}
+
+	var r io.Reader
+	if info.Mode().IsRegular() {
+		file, err := x.FS.Open(name)
+		if err != nil {
+			return fragment{}, fmt.Errorf("failed to open file %s: %w", x.displayPath(name), x.displayErr(err))
+		}
+		defer file.Close()
+		r = file
+	} else {
+		data, err := x.readStream(name)
+		if err != nil {
+			return fragment{}, err
+		}
+		r = bytes.NewReader(data)
+	}
+
+	buffered := bufio.NewReaderSize(r, sniffSize)
+	head, err := buffered.Peek(sniffSize)
+	if err != nil && err != io.EOF && err != bufio.ErrBufferFull {
+		return fragment{}, fmt.Errorf("failed to read file %s: %w", x.displayPath(name), x.displayErr(err))
+	}
+	if reason := binaryReason(head, len(head) < sniffSize); reason != "" {
+		return fragment{}, fmt.Errorf("file %s looks binary (%s), include it with #include-file: to write it out as a file instead", x.displayPath(name), reason)
+	}
+
+	x.stats.Files++
+	x.within = append(x.within, make(map[string]bool))
+	processed, err := x.processReader(name, countingReader{r: buffered, n: &x.stats.Bytes}, isRoot)
+	within := x.within[len(x.within)-1]
+	x.within = x.within[:len(x.within)-1]
+	if err != nil {
+		return fragment{}, err
+	}
+	x.noteWithin(name, within)
+	x.reportProgress()
+	if x.uncacheable[name] || x.IncludeOnceGlobal {
+		return processed, nil
+	}
+	if diskKey != "" {
+		deps := x.deps[len(x.deps)-1]
+		x.remember(key, processed, deps, within)
+		x.storeCached(diskKey, processed, deps, within)
+	} else if !isRoot {
+		x.remember(key, processed, nil, within)
+	}
+	return processed, nil
+}
+
+// remember keeps the processed content f of a file in the cache under
+// key, along with the names read to produce it when using the CacheDir.
+func (x *expansion) remember(key string, f fragment, deps map[string]bool, within map[string]bool) {
+	if x.cache == nil {
+		x.cache = make(map[string]fragment)
+		x.cacheDeps = make(map[string]map[string]bool)
+		x.cacheWithin = make(map[string]map[string]bool)
+	}
+	x.cache[key] = f
+	if deps != nil {
+		x.cacheDeps[key] = deps
+	}
+	x.cacheWithin[key] = within
+}
+
+// reusable reports whether content that processed the files within can
+// be reused, which it can't if any of them is being processed.
+func (x *expansion) reusable(within map[string]bool) bool {
+	for name := range within {
+		if x.onStack(name) {
+			return false
+		}
+	}
+	return true
+}
+
+// noteWithin adds name, and the files processed within it, to those
+// processed within the file it's included by.
+func (x *expansion) noteWithin(name string, within map[string]bool) {
+	if len(x.within) == 0 {
+		return
+	}
+	top := x.within[len(x.within)-1]
+	top[name] = true
+	for file := range within {
+		top[file] = true
+	}
+}
+
+// uncache keeps the files being processed out of the cache, as what they
+// turn out to be depends on more than their files.
+func (x *expansion) uncache() {
+	if x.uncacheable == nil {
+		x.uncacheable = make(map[string]bool)
+	}
+	for _, active := range x.stack {
+		x.uncacheable[active] = true
+	}
+}
+
+// addDeps adds names to the dependencies of all files being processed for
+// the CacheDir, as content taken from a cache doesn't read them again.
+func (x *expansion) addDeps(names map[string]bool) {
+	for _, deps := range x.deps {
+		for name := range names {
+			deps[name] = true
+		}
+	}
+}
+
+// cacheVersion changes whenever the format or meaning of CacheDir entries
+// does, so that old entries are ignored.
+const cacheVersion = "2"
+
+// cacheEntry is the processed content of a file as stored in the CacheDir.
+type cacheEntry struct {
+	Content string        `json:"content"`
+	Origins []cacheOrigin `json:"origins"`
+	// Deps maps the names read from FS to produce the content to their
+	// fingerprints at the time.
+	Deps map[string]string `json:"deps"`
+	// Within lists the files processed to produce the content, which it
+	// can't be reused within.
+	Within []string `json:"within"`
+}
+
+type cacheOrigin struct {
+	File       string       `json:"file"`
+	Line       int          `json:"line"`
+	IncludedAt *cacheOrigin `json:"includedAt,omitempty"`
+}
+
+// recordingFS adds the names opened or stated in FS to the dependencies
+// of all files being processed for the CacheDir.
+type recordingFS struct {
+	fs.FS
+	x *expansion
+}
+
+func (r recordingFS) record(name string) {
+	r.x.addDeps(map[string]bool{path.Clean(name): true})
+}
+
+func (r recordingFS) Open(name string) (fs.File, error) {
+	r.record(name)
+	return r.FS.Open(name)
+}
+
+func (r recordingFS) Stat(name string) (fs.FileInfo, error) {
+	r.record(name)
+	return fs.Stat(r.FS, name)
+}
+
+// fingerprint returns a hash of the content of the file name, of the
+// names in the directory name, or "-" if name doesn't exist. It returns ""
+// for anything else, such as named pipes, which can't be cached. Reading
+// them isn't recorded as a dependency.
+func (x *expansion) fingerprint(name string) string {
+	fsys := x.FS
+	if recording, ok := fsys.(recordingFS); ok {
+		fsys = recording.FS
+	}
+	info, err := fs.Stat(fsys, name)
+	if err != nil {
+		return "-"
+	}
+	h := sha256.New()
+	switch {
+	case info.IsDir():
+		entries, err := fs.ReadDir(fsys, name)
+		if err != nil {
+			return ""
+		}
+		for _, entry := range entries {
+			fmt.Fprintf(h, "%s\x00%t\x00", entry.Name(), entry.IsDir())
+		}
+	case info.Mode().IsRegular():
+		data, err := fs.ReadFile(fsys, name)
+		if err != nil {
+			return ""
+		}
+		h.Write(data)
+	default:
+		return ""
+	}
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
+
+// diskCacheKey returns the name of the CacheDir entry for name, derived
+// from its content and every option that affects how it's processed.
+func (x *expansion) diskCacheKey(name string) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\x00%s\x00%s\x00", cacheVersion, x.cacheKey(name), x.fingerprint(name))
+	fmt.Fprintf(h, "%s\x00%s\x00%t\x00%t\x00%s\x00%t\x00%t\x00%t\x00%t\x00%d\x00%q\x00",
+		x.MarkerPathStyle, x.AbsRoot, x.MarkDisabled, x.IncludeTags, x.Profile, x.PreserveDirectives,
+		x.CaseInsensitiveIncludes, x.DirWrap, x.DedupContent, x.MaxDirDepth, x.Skip)
+	fmt.Fprintf(h, "%d\x00%t\x00%q\x00%d\x00%t\x00", x.Base64Width, x.SkipEmptyIncludes, x.LibDirs, x.ExpandTabs, x.NoSeparator)
+	fmt.Fprintf(h, "%q\x00%s\x00%s\x00%s\x00", x.SearchPath, x.DirRecursion, x.IncludeBase, x.WorkDir)
+	defines := make([]string, 0, len(x.Defines))
+	for define, defined := range x.Defines {
+		if defined {
+			defines = append(defines, define)
+		}
+	}
+	sort.Strings(defines)
+	fmt.Fprintf(h, "%q\x00", defines)
+	names := make([]string, 0, len(x.Vars))
+	for name := range x.Vars {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(h, "%s=%q\x00", name, x.Vars[name])
+	}
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
+
+// loadCached returns the content stored under key in the CacheDir, the
+// names it depends on and the files processed within it, if there is an
+// entry none of whose dependencies have changed since.
+func (x *expansion) loadCached(key string) (fragment, map[string]bool, map[string]bool, bool) {
+	data, err := os.ReadFile(filepath.Join(x.CacheDir, key+".json"))
+	if err != nil {
+		return fragment{}, nil, nil, false
+	}
+	var entry cacheEntry
+	if err := json.Unmarshal(data, &entry); err != nil {
+		return fragment{}, nil, nil, false
+	}
+	deps := make(map[string]bool, len(entry.Deps))
+	for name, fingerprint := range entry.Deps {
+		if x.fingerprint(name) != fingerprint {
+			return fragment{}, nil, nil, false
+		}
+		deps[name] = true
+	}
+	within := make(map[string]bool, len(entry.Within))
+	for _, name := range entry.Within {
+		within[name] = true
+	}
+
+	f := fragment{content: entry.Content, origins: make([]lineOrigin, len(entry.Origins))}
+	for i, origin := range entry.Origins {
+		f.origins[i] = lineOrigin{file: origin.File, line: origin.Line}
+		if site := origin.IncludedAt; site != nil {
+			f.origins[i].includedAt = &lineOrigin{file: site.File, line: site.Line}
+		}
+	}
+	return f, deps, within, true
+}
+
+// storeCached stores f under key in the CacheDir along with the
+// fingerprints of the names in deps and the files processed within it.
+// Failing to do so only warns.
+func (x *expansion) storeCached(key string, f fragment, deps map[string]bool, within map[string]bool) {
+	entry := cacheEntry{Content: f.content, Deps: make(map[string]string)}
+	for name := range within {
+		entry.Within = append(entry.Within, name)
+	}
+	sort.Strings(entry.Within)
+	for name := range deps {
+		fingerprint := x.fingerprint(name)
+		if fingerprint == "" {
+			return
+		}
+		entry.Deps[name] = fingerprint
+	}
+	for _, origin := range f.origins {
+		stored := cacheOrigin{File: origin.file, Line: origin.line}
+		if site := origin.includedAt; site != nil {
+			stored.IncludedAt = &cacheOrigin{File: site.file, Line: site.line}
+		}
+		entry.Origins = append(entry.Origins, stored)
+	}
+
+	data, err := json.Marshal(entry)
+	if err == nil {
+		err = os.MkdirAll(x.CacheDir, 0o755)
+	}
+	if err == nil {
+		// Write to a temporary file first, so readers never see half an entry.
+		tmp := filepath.Join(x.CacheDir, key+".json.tmp")
+		if err = os.WriteFile(tmp, data, 0o644); err == nil {
+			err = os.Rename(tmp, filepath.Join(x.CacheDir, key+".json"))
+		}
+	}
+	if err != nil {
+		x.warn(Warning{Message: fmt.Sprintf("could not write cache entry: %v", err)})
+	}
+}
+
+// cacheKey returns the key the processed content of name is cached under.
+// Markers relative to the including file make it depend on where it's
+// included from, and the filters and scoped vars in effect on what it
+// includes and substitutes.
+func (x *expansion) cacheKey(name string) string {
+	key := name
+	if x.MarkerPathStyle == MarkerPathRelativeToParent && len(x.stack) > 0 {
+		key = path.Dir(x.stack[len(x.stack)-1]) + "\x00" + name
+	}
+	// Filters can be redefined, changing what directory includes using
+	// them include.
+	filterNames := make([]string, 0, len(x.filters))
+	for filterName := range x.filters {
+		filterNames = append(filterNames, filterName)
+	}
+	sort.Strings(filterNames)
+	for _, filterName := range filterNames {
+		key += fmt.Sprintf("\x00#%s=%q", filterName, x.filters[filterName])
+	}
+	// Content included with scoped vars differs by their values.
+	for _, scope := range x.scopes {
+		names := make([]string, 0, len(scope))
+		for name := range scope {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			key += fmt.Sprintf("\x00%s=%q", name, scope[name])
+		}
+	}
+	return key
+}
+
+// markerPath returns the path START/END markers show for name, included
+// by the file parent.
+func (x *expansion) markerPath(name string, parent string) string {
+	switch x.MarkerPathStyle {
+	case MarkerPathAbs:
+		return filepath.ToSlash(filepath.Join(x.AbsRoot, filepath.FromSlash(name)))
+	case MarkerPathRelativeToParent:
+		parentDir := path.Dir(parent)
+		// If Rel fails (e.g., the parent is outside the root), fall back to the root-relative path.
+		if rel, err := filepath.Rel(filepath.FromSlash(parentDir), filepath.FromSlash(name)); err == nil {
+			return filepath.ToSlash(rel)
+		}
+	}
+	return name
+}
+
+// checkFileSize fails if name, a file described by info, is larger than
+// MaxFileSize. Only regular files have a size to check.
+func (x *expansion) checkFileSize(name string, info fs.FileInfo) error {
+	if x.MaxFileSize > 0 && info.Mode().IsRegular() && info.Size() > x.MaxFileSize {
+		return fmt.Errorf("file %s has %d bytes, more than the limit of %d", x.displayPath(name), info.Size(), x.MaxFileSize)
+	}
+	return nil
+}
+
+// readFile reads all of name, after checking its size against
+// MaxFileSize.
+func (x *expansion) readFile(name string) ([]byte, error) {
+	if x.MaxFileSize > 0 {
+		info, err := fs.Stat(x.FS, name)
+		if err != nil {
+			return nil, err
+		}
+		if err := x.checkFileSize(name, info); err != nil {
+			return nil, err
+		}
+	}
+	return fs.ReadFile(x.FS, name)
+}
+
+// readStream reads all of name, a file that isn't a regular file such as
+// a named pipe. Opening a pipe blocks until a writer shows up, so it's read
+// in its own goroutine, which is abandoned if StreamTimeout expires first.
+func (x *expansion) readStream(name string) ([]byte, error) {
+	if x.StreamTimeout <= 0 {
+		return nil, fmt.Errorf("%s is not a regular file, set a stream timeout to read named pipes", x.displayPath(name))
+	}
+
+	type result struct {
+		data []byte
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		file, err := x.FS.Open(name)
+		if err != nil {
+			done <- result{err: err}
+			return
+		}
+		defer file.Close()
+		data, err := io.ReadAll(file)
+		done <- result{data: data, err: err}
+	}()
+
+	timer := time.NewTimer(x.StreamTimeout)
+	defer timer.Stop()
+	select {
+	case res := <-done:
+		if res.err != nil {
+			return nil, fmt.Errorf("failed to read stream %s: %w", x.displayPath(name), x.displayErr(res.err))
+		}
+		return res.data, nil
+	case <-timer.C:
+		return nil, fmt.Errorf("timed out after %s waiting for stream %s", x.StreamTimeout, x.displayPath(name))
+	}
+}
+
+// processReader expands the content of the file name read from r.
+func (x *expansion) processReader(name string, r io.Reader, isRoot bool) (fragment, error) {
+	checked := &utf8Reader{r: r, invalid: -1}
+	nodes, err := Parse(checked)
+	if err != nil {
+		return fragment{}, fmt.Errorf("error reading file %s: %w", x.displayPath(name), x.displayErr(err))
+	}
+	if isRoot && x.NoRootDirectives {
+		nodes = literalNodes(nodes)
+	}
+	if checked.invalid >= 0 {
+		message := fmt.Sprintf("invalid UTF-8 at byte offset %d", checked.invalid)
+		if x.RequireUTF8 {
+			return fragment{}, fmt.Errorf("%s:%d: %s", x.displayPath(name), checked.lines+1, message)
+		}
+		x.warn(Warning{File: x.displayPath(name), Line: checked.lines + 1, Message: message + ", copying it as is"})
+	}
+	return x.processNodes(name, nodes, isRoot)
+}
+
+// literalNodes returns nodes with every line as a NodeLiteral of its own.
+func literalNodes(nodes []Node) []Node {
+	var literals []Node
+	for _, node := range nodes {
+		for i, line := range node.Lines {
+			literals = append(literals, Node{Kind: NodeLiteral, Line: node.Line + i, Lines: []string{line}, Indentation: leadingWhitespace(line)})
+		}
+	}
+	return literals
+}
+
+// utf8Reader passes on what it reads from r, looking for the first
+// invalid UTF-8 sequence.
+type utf8Reader struct {
+	r io.Reader
+	// offset is the offset of the bytes in tail, checked is everything
+	// before it.
+	offset int64
+	// tail is the start of a rune cut off at the end of the last read.
+	tail []byte
+	// lines counts the newlines before offset.
+	lines int
+	// invalid is the offset of the first invalid sequence, -1 if there's
+	// none so far.
+	invalid int64
+}
+
+func (u *utf8Reader) Read(p []byte) (int, error) {
+	n, err := u.r.Read(p)
+	if u.invalid >= 0 {
+		return n, err
+	}
+	data := append(u.tail, p[:n]...)
+	i := 0
+	for i < len(data) {
+		r, size := utf8.DecodeRune(data[i:])
+		if r == utf8.RuneError && size <= 1 {
+			// The rest of a cut off rune comes with the next read.
+			if err == nil && !utf8.FullRune(data[i:]) {
+				break
+			}
+			u.invalid = u.offset + int64(i)
+			break
+		}
+		i += size
+	}
+	u.lines += bytes.Count(data[:i], []byte("\n"))
+	u.offset += int64(i)
+	u.tail = append(u.tail[:0], data[i:]...)
+	return n, err
+}
+
+// processNodes expands nodes, the parsed content of the file name.
 // This is the core recursive function.
-func processFile(filePath string, rootDir string, isRoot bool) (string, error) {
-	// Prevent reading the same file multiple times in a circular dependency
-	// by checking the absolute path. This is a simple form of cycle detection.
-	absPath, err := filepath.Abs(filePath)
+func (x *expansion) processNodes(name string, nodes []Node, isRoot bool) (fragment, error) {
+	// Refuse to process a file that is already being processed further up,
+	// as that would recurse forever.
+	for _, active := range x.stack {
+		if x.sameFile(active, name) {
+			chain := make([]string, 0, len(x.stack)+1)
+			for _, file := range append(x.stack, name) {
+				chain = append(chain, x.displayPath(file))
+			}
+			return fragment{}, &CycleError{Chain: chain}
+		}
+	}
+	x.stack = append(x.stack, name)
+	defer func() { x.stack = x.stack[:len(x.stack)-1] }()
+	if depth := len(x.stack) - 1; depth > x.stats.MaxDepth {
+		x.stats.MaxDepth = depth
+	}
+
+	var output fragmentBuilder
+	var parent string
+	// Add a START comment with the relative path if this is an included file.
+	if !isRoot {
+		parent = x.stack[len(x.stack)-2]
+		output.writeLine(fmt.Sprintf("# START %s", x.markerPath(name, parent)), lineOrigin{file: name})
+		// Count the END comment right away as well.
+		if err := x.countLines(2); err != nil {
+			return fragment{}, err
+		}
+	}
+
+	// conditions holds the #if blocks the current node is in.
+	var conditions []condition
+
+	for _, node := range nodes {
+		line := node.Lines[0]
+		lineNo := node.Line
+		if x.ExpandTabs > 0 {
+			line = expandLeadingTabs(line, x.ExpandTabs)
+		}
+		// Capture the indentation from the original line.
+		indentation := line[:len(line)-len(strings.TrimLeft(line, " \t"))]
+
+		// Conditional blocks are resolved before anything else, nodes in
+		// blocks that are switched off are dropped unseen.
+		switch node.Kind {
+		case NodeIf:
+			conditions = append(conditions, condition{line: lineNo, value: x.Defines[node.Args[0]]})
+			continue
+		case NodeElse, NodeEndif:
+			if len(conditions) == 0 {
+				return fragment{}, fmt.Errorf("%s:%d: #%s without #if", x.displayPath(name), lineNo, node.Kind)
+			}
+			if node.Kind == NodeEndif {
+				conditions = conditions[:len(conditions)-1]
+			} else if last := &conditions[len(conditions)-1]; last.inElse {
+				return fragment{}, fmt.Errorf("%s:%d: second #else for the #if on line %d", x.displayPath(name), lineNo, last.line)
+			} else {
+				last.inElse = true
+			}
+			continue
+		}
+		if !activeConditions(conditions) {
+			continue
+		}
+		if x.PreprocessOnly && node.Kind != NodeLiteral {
+			if err := x.countLines(len(node.Lines)); err != nil {
+				return fragment{}, err
+			}
+			for i, directiveLine := range node.Lines {
+				output.writeLine(directiveLine, lineOrigin{file: name, line: lineNo + i})
+			}
+			continue
+		}
+
+		switch node.Kind {
+		case NodeIncludeFilter:
+			if err := checkIncludeFilter(node.Args); err != nil {
+				return fragment{}, fmt.Errorf("%s:%d: %w", x.displayPath(name), lineNo, err)
+			}
+			if x.filters == nil {
+				x.filters = make(map[string][]string)
+			}
+			x.filters[node.Args[0]] = node.Args[1:]
+			// Reusing the content would leave the filter undefined.
+			x.uncache()
+		case NodeIncludeLiteral:
+			block, err := x.processIncludeLiteral(name, lineNo, node.Args)
+			if err != nil {
+				return fragment{}, err
+			}
+			if err := x.countLines(len(block.origins)); err != nil {
+				return fragment{}, err
+			}
+			output.writeFragment(block, "")
+		case NodeIncludeFile:
+			entry, err := x.processIncludeFile(name, lineNo, indentation, node.Args)
+			if err != nil {
+				return fragment{}, err
+			}
+			if err := x.countLines(len(entry.origins)); err != nil {
+				return fragment{}, err
+			}
+			output.writeFragment(entry, "")
+		case NodeIncludeDiff:
+			diff, err := x.processIncludeDiff(name, lineNo, node.Args)
+			if err != nil {
+				return fragment{}, err
+			}
+			if x.indent == 0 && indentation == "" {
+				for _, diffLine := range strings.Split(diff.content, "\n") {
+					x.noteTopKey(diffLine)
+				}
+			}
+			output.writeFragment(diff, indentation)
+		case NodeDisabledInclude:
+			// Disabled includes contribute nothing but an optional marker.
+			if x.MarkDisabled {
+				if err := x.countLines(1); err != nil {
+					return fragment{}, err
+				}
+				output.writeLine(fmt.Sprintf("%s# (disabled) %s", indentation, node.Args[0]), lineOrigin{file: name, line: lineNo})
+			}
+		case NodeInclude, NodeIncludeEnv, NodeIncludeUnlessKey, NodeRepeat:
+			includePaths := node.Args
+			// copies is how many times the paths are included, each copy
+			// with its index in a variable.
+			copies := 1
+			if node.Kind == NodeRepeat && len(includePaths) > 0 {
+				var err error
+				if copies, err = repeatCount(includePaths[0]); err != nil {
+					return fragment{}, fmt.Errorf("%s:%d: %w", x.displayPath(name), lineNo, err)
+				}
+				includePaths = includePaths[1:]
+			}
+			if node.Kind == NodeIncludeUnlessKey && len(includePaths) > 0 {
+				// The key comes first, and preempts the include if the
+				// output so far has it. What's included then depends on
+				// more than the files, so don't reuse it.
+				x.uncache()
+				if x.topKeys[includePaths[0]] {
+					continue
+				}
+				includePaths = includePaths[1:]
+			}
+			if len(includePaths) == 0 {
+				x.warn(Warning{File: x.displayPath(name), Line: lineNo + len(node.Lines) - 1, Message: fmt.Sprintf("found empty #%s directive, skipping it", node.Kind)})
+				continue
+			}
+
+			if x.PreserveDirectives {
+				if err := x.countLines(len(node.Lines)); err != nil {
+					return fragment{}, err
+				}
+				for i, directiveLine := range node.Lines {
+					output.writeLine(directiveLine, lineOrigin{file: name, line: lineNo + i})
+				}
+			}
+
+			for i := 0; i < copies*len(includePaths); i++ {
+				// Options change how the included content is pasted.
+				includePathStr, options, err := parseIncludeOptions(includePaths[i%len(includePaths)])
+				if err != nil {
+					return fragment{}, fmt.Errorf("%s:%d: %w", x.displayPath(name), lineNo, err)
+				}
+				var index map[string]string
+				if node.Kind == NodeRepeat {
+					if options.index == "" {
+						options.index = defaultIndexVar
+					}
+					index = map[string]string{options.index: strconv.Itoa(i / len(includePaths))}
+				} else if options.index != "" {
+					return fragment{}, fmt.Errorf("%s:%d: the index option only applies to #repeat:", x.displayPath(name), lineNo)
+				}
+				indentation := indentation + strings.Repeat(" ", options.indent)
+				// The content goes under the key, indented beneath it.
+				keyIndentation, underKey := indentation, ""
+				if options.under != "" {
+					if underKey, err = x.underKey(options.under); err != nil {
+						return fragment{}, fmt.Errorf("%s:%d: %w", x.displayPath(name), lineNo, err)
+					}
+					indentation += "  "
+				}
+				var filter []string
+				if options.filter != "" {
+					var ok bool
+					if filter, ok = x.filters[options.filter]; !ok {
+						return fragment{}, fmt.Errorf("%s:%d: unknown filter %q, it needs an #include-filter: line before it", x.displayPath(name), lineNo, options.filter)
+					}
+				}
+
+				fullIncludePath, err := x.resolveInclude(name, includePathStr)
+				if err != nil {
+					return fragment{}, fmt.Errorf("%s:%d: %w", x.displayPath(name), lineNo, err)
+				}
+
+				// Process the included path (which could be a file or directory).
+				x.indent += len(indentation)
+				scopes := len(x.scopes)
+				if index != nil {
+					x.scopes = append(x.scopes, index)
+				}
+				if options.vars != nil {
+					x.scopes = append(x.scopes, options.vars)
+				}
+				included, err := x.processIncludePath(fullIncludePath, name, lineNo, node.Kind == NodeIncludeEnv, filter, options.where)
+				x.scopes = x.scopes[:scopes]
+				x.indent -= len(indentation)
+				var notFound *IncludeNotFoundError
+				if errors.As(err, &notFound) && notFound.FromFile == x.displayPath(name) && notFound.Line == lineNo {
+					if options.optional {
+						continue
+					}
+					if x.checking {
+						x.missing = append(x.missing, notFound)
+						continue
+					}
+				}
+				if err != nil {
+					return fragment{}, fmt.Errorf("error processing include '%s' in file %s: %w", includePathStr, x.displayPath(name), err)
+				}
+				if options.dedent {
+					included = included.dedent()
+				}
+				if options.fold || options.foldPlain {
+					folded, err := included.fold(options.foldPlain)
+					if err != nil {
+						return fragment{}, fmt.Errorf("error processing include '%s' in file %s: %w", includePathStr, x.displayPath(name), err)
+					}
+					// Only the folded line is left of the counted lines.
+					x.lines -= len(included.origins) - len(folded.origins)
+					included = folded
+				}
+				if x.SkipEmptyIncludes && included.isEmpty() {
+					x.lines -= len(included.origins)
+					continue
+				}
+				if size := len(included.content) + len(indentation)*len(included.origins); x.WarnIncludeBytes > 0 && size > x.WarnIncludeBytes {
+					x.warn(Warning{File: x.displayPath(name), Line: lineNo + len(node.Lines) - 1, Message: fmt.Sprintf("include '%s' adds %d bytes, more than %d", includePathStr, size, x.WarnIncludeBytes)})
+				}
+
+				if x.indent == 0 && indentation == "" {
+					for _, includedLine := range strings.Split(included.content, "\n") {
+						x.noteTopKey(includedLine)
+					}
+				}
+				if underKey != "" {
+					if err := x.countLines(1); err != nil {
+						return fragment{}, err
+					}
+					if x.indent == 0 && keyIndentation == "" {
+						x.noteTopKey(underKey + ":")
+					}
+					output.writeLine(keyIndentation+underKey+":", lineOrigin{file: name, line: lineNo})
+				}
+
+				// Apply the captured indentation to each line of the included content.
+				output.writeFragment(included.includedAt(lineOrigin{file: name, line: lineNo}), indentation)
+				// Separate the included content from what follows with a single empty line.
+				if !x.NoSeparator && !options.noSeparator {
+					output.writeLine("", lineOrigin{file: name})
+				}
+			}
+		default:
+			if x.IncludeTags && !x.PreprocessOnly && strings.Contains(line, "!include") && !strings.HasPrefix(strings.TrimSpace(line), "#") {
+				replaced, err := x.processIncludeTag(name, lineNo, line)
+				if err != nil {
+					return fragment{}, err
+				}
+				if err := x.countLines(len(replaced.origins)); err != nil {
+					return fragment{}, err
+				}
+				output.writeFragment(replaced, "")
+				continue
+			}
+
+			// If it's not an include directive, just add the line to the output.
+			if err := x.countLines(1); err != nil {
+				return fragment{}, err
+			}
+			if x.refs != nil {
+				for _, match := range varPattern.FindAllStringSubmatch(line, -1) {
+					x.refs[match[1]] = true
+				}
+			}
+			if x.indent == 0 {
+				x.noteTopKey(line)
+			}
+			output.writeLine(x.substituteVars(line), lineOrigin{file: name, line: lineNo})
+		}
+	}
+
+	if len(conditions) > 0 {
+		return fragment{}, fmt.Errorf("%s:%d: #if without #endif", x.displayPath(name), conditions[len(conditions)-1].line)
+	}
+
+	finalResult := output.fragment()
+
+	// Content that disappears entirely usually means a variable or flag
+	// wasn't set.
+	if size := contentBytes(nodes); !isRoot && size > 0 && finalResult.isEmpty() {
+		message := fmt.Sprintf("%d bytes of content are empty after substituting variables and resolving #if blocks, is a variable or --define missing?", size)
+		if x.Strict {
+			return fragment{}, fmt.Errorf("%s: %s", x.displayPath(name), message)
+		}
+		x.warn(Warning{File: x.displayPath(name), Message: message})
+	}
+
+	// Add an END comment if this is an included file.
+	if !isRoot {
+		// Tidy up trailing newlines before adding the final comment.
+		finalResult = finalResult.trimRight()
+		finalResult.content += fmt.Sprintf("\n# END %s\n", x.markerPath(name, parent))
+		finalResult.origins = append(finalResult.origins, lineOrigin{file: name})
+	}
+
+	return finalResult, nil
+}
+
+// contentBytes returns the size of the literal lines of nodes that aren't
+// blank or comments, as written in the file.
+func contentBytes(nodes []Node) int {
+	size := 0
+	for _, node := range nodes {
+		if node.Kind != NodeLiteral {
+			continue
+		}
+		for _, line := range node.Lines {
+			if trimmedLine := strings.TrimSpace(line); trimmedLine != "" && !strings.HasPrefix(trimmedLine, "#") {
+				size += len(line) + 1
+			}
+		}
+	}
+	return size
+}
+
+// resolveInclude returns the name of includePathStr, an include path in
+// the file name. Paths without a slash are looked up in SearchPath first.
+// Otherwise it's relative to the directory of name, or the one
+// IncludeBase selects instead, or if there's nothing there, to the first
+// of LibDirs that has it. PathRewriter gets to rewrite includePathStr
+// first.
+func (x *expansion) resolveInclude(name string, includePathStr string) (string, error) {
+	if x.PathRewriter != nil {
+		rewritten, err := x.PathRewriter(includePathStr, name)
+		if err != nil {
+			return "", fmt.Errorf("cannot rewrite include path '%s': %w", includePathStr, err)
+		}
+		includePathStr = rewritten
+	}
+	if !strings.ContainsAny(includePathStr, `/\`) {
+		for _, searchDir := range x.SearchPath {
+			candidate := path.Join(searchDir, includePathStr)
+			if _, err := fs.Stat(x.FS, candidate); err == nil {
+				if x.Verbose {
+					log.Printf("%s: include %s found in search path directory %s", x.displayPath(name), includePathStr, x.displayPath(searchDir))
+				}
+				return candidate, nil
+			}
+		}
+	}
+	base := path.Dir(name)
+	switch x.IncludeBase {
+	case IncludeBaseRoot:
+		base = "."
+	case IncludeBaseCwd:
+		base = x.WorkDir
+	}
+	fullIncludePath := path.Join(base, filepath.ToSlash(includePathStr))
+	if len(x.LibDirs) == 0 {
+		return fullIncludePath, nil
+	}
+	if _, err := fs.Stat(x.FS, fullIncludePath); !errors.Is(err, fs.ErrNotExist) {
+		return fullIncludePath, nil
+	}
+	for _, libDir := range x.LibDirs {
+		candidate := path.Join(libDir, filepath.ToSlash(includePathStr))
+		if _, err := fs.Stat(x.FS, candidate); err == nil {
+			return candidate, nil
+		}
+	}
+	return fullIncludePath, nil
+}
+
+// sameFile reports whether the names a and b refer to the same file, which
+// they can do with different names, e.g. by leading out of FS and back in.
+func (x *expansion) sameFile(a string, b string) bool {
+	if a == b {
+		return true
+	}
+	infoA, errA := fs.Stat(x.FS, a)
+	infoB, errB := fs.Stat(x.FS, b)
+	return errA == nil && errB == nil && os.SameFile(infoA, infoB)
+}
+
+// onStack reports whether the file name is being processed.
+func (x *expansion) onStack(name string) bool {
+	for _, active := range x.stack {
+		if x.sameFile(active, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// processIncludeTag replaces a `!include <path>` YAML tag on line, which
+// is line lineNo of the file name, by the content of the file at path as a
+// literal block scalar. Lines that merely mention `!include`, e.g. in a
+// quoted string, are returned unchanged.
+func (x *expansion) processIncludeTag(name string, lineNo int, line string) (fragment, error) {
+	match := includeTagPattern.FindStringSubmatch(line)
+	if match == nil {
+		if flowIncludeTagPattern.MatchString(line) {
+			return fragment{}, fmt.Errorf("%s:%d: !include tags are not supported in flow collections", x.displayPath(name), lineNo)
+		}
+		var output fragmentBuilder
+		output.writeLine(x.substituteVars(line), lineOrigin{file: name, line: lineNo})
+		return output.fragment(), nil
+	}
+	return x.embedLiteral(name, lineNo, match[1], match[2], match[3], "!include", "")
+}
+
+// processIncludeLiteral replaces an `#include-literal:` directive, which is
+// line lineNo of the file name, by the content of the file as a literal
+// block scalar. args are those of its Node.
+func (x *expansion) processIncludeLiteral(name string, lineNo int, args []string) (fragment, error) {
+	prefix, keyIndentation, includePathStr, chomp := args[0], args[1], args[2], args[3]
+	if strings.TrimSpace(prefix) == "" {
+		return fragment{}, fmt.Errorf("%s:%d: #include-literal: needs a key or list item in front of it, e.g. `content: #include-literal: %s`", x.displayPath(name), lineNo, includePathStr)
+	}
+	return x.embedLiteral(name, lineNo, prefix, keyIndentation, includePathStr, "#include-literal:", chomp)
+}
+
+// embedLiteral returns prefix, the key or sequence item on line lineNo of
+// the file name indented by keyIndentation, followed by the content of the
+// file at includePathStr as a literal block scalar. chomp is "strip",
+// "clip", or "keep" or "" to keep the file's trailing newlines exactly.
+// directive names what included it in errors.
+func (x *expansion) embedLiteral(name string, lineNo int, prefix string, keyIndentation string, includePathStr string, directive string, chomp string) (fragment, error) {
+	fullIncludePath, err := x.resolveInclude(name, includePathStr)
+	if err != nil {
+		return fragment{}, fmt.Errorf("%s:%d: %w", x.displayPath(name), lineNo, err)
+	}
+	x.recordInclude(fullIncludePath, fmt.Sprintf("%s:%d", x.displayPath(name), lineNo))
+	if x.checking {
+		x.checkExists(fullIncludePath, name, lineNo)
+		return fragment{}, nil
+	}
+	data, err := x.readFile(fullIncludePath)
+	if err != nil {
+		return fragment{}, fmt.Errorf("error processing %s '%s' in file %s: %w", directive, includePathStr, x.displayPath(name), x.displayErr(err))
+	}
+	content := string(data)
+	x.stats.Files++
+	x.stats.Bytes += int64(len(data))
+	switch chomp {
+	case "strip":
+		content = strings.TrimRight(content, "\n")
+	case "clip":
+		content = strings.TrimRight(content, "\n") + "\n"
+	}
+
+	// The scalar is indented two spaces more than its key, or than the dash
+	// of a sequence item without a key.
+	base := len(keyIndentation)
+	if strings.HasSuffix(strings.TrimSpace(prefix), ":") {
+		base = len(prefix) - len(strings.TrimLeft(prefix[base:], "- "))
+	}
+	indentation := strings.Repeat(" ", base+2)
+
+	var output fragmentBuilder
+	output.writeLiteralBlock(x.substituteVars(prefix), lineOrigin{file: name, line: lineNo}, fullIncludePath, content, indentation)
+	return output.fragment(), nil
+}
+
+// parseIncludeFileArgs returns the path, dest and mode of an
+// `#include-file:` directive with the given fields.
+func parseIncludeFileArgs(fields []string) (includePathStr string, dest string, mode string, err error) {
+	if len(fields) == 0 {
+		return "", "", "", errors.New("#include-file needs a path")
+	}
+	for _, field := range fields[1:] {
+		key, value, _ := strings.Cut(field, "=")
+		switch key {
+		case "dest":
+			dest = value
+		case "mode":
+			if _, err := strconv.ParseUint(value, 8, 32); err != nil {
+				return "", "", "", fmt.Errorf("invalid mode '%s', expected an octal number like 0644", value)
+			}
+			mode = value
+		default:
+			return "", "", "", fmt.Errorf("unknown #include-file option '%s', expected dest= or mode=", field)
+		}
+	}
+	if dest == "" {
+		return "", "", "", errors.New("#include-file needs a dest=<path>")
+	}
+	return fields[0], dest, mode, nil
+}
+
+// processIncludeFile replaces an `#include-file: <path> dest=<path>
+// [mode=<mode>]` directive with the given fields, which is line lineNo of
+// the file name, by a write_files entry shipping the file at path to dest,
+// indented by indentation. Text files are embedded as a literal block
+// scalar, anything else is base64 encoded.
+func (x *expansion) processIncludeFile(name string, lineNo int, indentation string, fields []string) (fragment, error) {
+	location := fmt.Sprintf("%s:%d", x.displayPath(name), lineNo)
+	includePathStr, dest, mode, err := parseIncludeFileArgs(fields)
+	if err != nil {
+		return fragment{}, fmt.Errorf("%s: %w", location, err)
+	}
+
+	fullIncludePath, err := x.resolveInclude(name, includePathStr)
+	if err != nil {
+		return fragment{}, fmt.Errorf("%s: %w", location, err)
+	}
+	x.recordInclude(fullIncludePath, location)
+	if x.checking {
+		x.checkExists(fullIncludePath, name, lineNo)
+		return fragment{}, nil
+	}
+	data, err := x.readFile(fullIncludePath)
+	if err != nil {
+		return fragment{}, fmt.Errorf("error processing #include-file '%s' in file %s: %w", includePathStr, x.displayPath(name), x.displayErr(err))
+	}
+	x.stats.Files++
+	x.stats.Bytes += int64(len(data))
+
+	origin := lineOrigin{file: name, line: lineNo}
+	var output fragmentBuilder
+	output.writeLine(fmt.Sprintf("%s- path: %s", indentation, strconv.Quote(dest)), origin)
+	if mode != "" {
+		output.writeLine(fmt.Sprintf("%s  permissions: '%s'", indentation, mode), origin)
+	}
+	if isText(data) {
+		output.writeLiteralBlock(indentation+"  content: ", origin, fullIncludePath, string(data), indentation+"    ")
+	} else {
+		output.writeLine(indentation+"  encoding: b64", origin)
+		encoded := base64.StdEncoding.EncodeToString(data)
+		if x.Base64Width <= 0 || len(encoded) <= x.Base64Width {
+			output.writeLine(indentation+"  content: "+encoded, origin)
+		} else {
+			// Decoding base64 skips the line breaks.
+			output.writeLine(indentation+"  content: |", origin)
+			for len(encoded) > 0 {
+				n := x.Base64Width
+				if n > len(encoded) {
+					n = len(encoded)
+				}
+				output.writeLine(indentation+"    "+encoded[:n], origin)
+				encoded = encoded[n:]
+			}
+		}
+	}
+	return output.fragment(), nil
+}
+
+// checkIncludeDiff checks the args of an `#include-diff:` directive.
+func checkIncludeDiff(args []string) error {
+	if len(args) != 2 {
+		return fmt.Errorf("#include-diff: needs two paths, the base and the overlay, found %d", len(args))
+	}
+	return nil
+}
+
+// processIncludeDiff replaces an `#include-diff: <base> <overlay>`
+// directive with the given args, which is line lineNo of the file name, by
+// what the overlay sets that the base doesn't, see diffYAML. Both are
+// processed like includes first.
+func (x *expansion) processIncludeDiff(name string, lineNo int, args []string) (fragment, error) {
+	location := fmt.Sprintf("%s:%d", x.displayPath(name), lineNo)
+	if err := checkIncludeDiff(args); err != nil {
+		return fragment{}, fmt.Errorf("%s: %w", location, err)
+	}
+	var sides [2]fragment
+	for i, includePathStr := range args {
+		fullIncludePath, err := x.resolveInclude(name, includePathStr)
+		if err != nil {
+			return fragment{}, fmt.Errorf("%s: %w", location, err)
+		}
+		sides[i], err = x.processIncludePath(fullIncludePath, name, lineNo, false, nil, "")
+		var notFound *IncludeNotFoundError
+		if errors.As(err, &notFound) && x.checking && notFound.FromFile == x.displayPath(name) && notFound.Line == lineNo {
+			x.missing = append(x.missing, notFound)
+			continue
+		}
+		if err != nil {
+			return fragment{}, fmt.Errorf("error processing #include-diff '%s' in file %s: %w", includePathStr, x.displayPath(name), err)
+		}
+	}
+	diff, err := x.diffYAML(sides[0], sides[1])
+	if err != nil {
+		return fragment{}, fmt.Errorf("%s: %w", location, err)
+	}
+	// Only the lines of the diff are left of the counted lines.
+	x.lines -= len(sides[0].origins) + len(sides[1].origins) - len(diff.origins)
+	return diff, nil
+}
+
+// diffYAML returns the lines of overlay, a block mapping, that set what
+// the block mapping base doesn't: the keys base doesn't have, and the keys
+// whose values differ. Where both values are block mappings themselves
+// only what differs within them is kept, beneath their key. Any other
+// value is kept whole, so sequences replace rather than extend those of
+// base. Keys only base has are left out, there's no way to remove a key by
+// merging. Blank lines and comments don't count as differences, and the
+// START and END markers of both are dropped.
+func (x *expansion) diffYAML(base fragment, overlay fragment) (fragment, error) {
+	var sides [2]yamlLines
+	for i, f := range [2]fragment{base, overlay} {
+		content := strings.TrimSuffix(f.content, "\n")
+		if content == "" {
+			continue
+		}
+		for j, line := range strings.Split(content, "\n") {
+			if !isMarkerLine(strings.TrimSpace(line), f.origins[j]) {
+				sides[i].lines = append(sides[i].lines, line)
+				sides[i].origins = append(sides[i].origins, f.origins[j])
+			}
+		}
+	}
+	var entries [2][]yamlEntry
+	for i, side := range sides {
+		var bad int
+		if entries[i], bad = side.entries(0, len(side.lines)); bad >= 0 {
+			origin := side.origins[bad]
+			return fragment{}, fmt.Errorf("%s:%d: can only diff block mappings, found %q", x.displayPath(origin.file), origin.line, strings.TrimSpace(side.lines[bad]))
+		}
+	}
+
+	keep := make([]bool, len(sides[1].lines))
+	diffEntries(sides[0], entries[0], sides[1], entries[1], keep)
+	var output fragmentBuilder
+	for i, line := range sides[1].lines {
+		if keep[i] {
+			output.writeLine(line, sides[1].origins[i])
+		}
+	}
+	return output.fragment().trimRight(), nil
+}
+
+// yamlLines are the lines of a YAML document and where they come from.
+type yamlLines struct {
+	lines   []string
+	origins []lineOrigin
+}
+
+// yamlEntry is a `key:` line of a block mapping along with the lines of
+// its value.
+type yamlEntry struct {
+	key string
+	// keyLine is the index of the key line.
+	keyLine int
+	// start and end bound the lines of the entry, including the blank
+	// lines and comments before its key line.
+	start, end int
+}
+
+// entries splits lines start to end of y, a block mapping, into its
+// entries. If the lines aren't a block mapping, bad is the index of the
+// first line that doesn't fit, otherwise it's -1.
+func (y yamlLines) entries(start int, end int) (entries []yamlEntry, bad int) {
+	level := -1
+	// next is where the next entry starts, after the last content line.
+	next := start
+	for i := start; i < end; i++ {
+		line := y.lines[i]
+		trimmedLine := strings.TrimSpace(line)
+		if trimmedLine == "" || strings.HasPrefix(trimmedLine, "#") {
+			continue
+		}
+		indentation := len(leadingWhitespace(line))
+		if level < 0 {
+			level = indentation
+		}
+		switch {
+		case indentation > level:
+		case indentation < level:
+			return nil, i
+		case trimmedLine == "-" || strings.HasPrefix(trimmedLine, "- "):
+			// A sequence may be as indented as the key it's the value of.
+			if len(entries) == 0 {
+				return nil, i
+			}
+		default:
+			key, ok := topLevelKey(trimmedLine)
+			if !ok {
+				return nil, i
+			}
+			if len(entries) > 0 {
+				entries[len(entries)-1].end = next
+			}
+			entries = append(entries, yamlEntry{key: key, keyLine: i, start: next})
+		}
+		next = i + 1
+	}
+	if len(entries) > 0 {
+		entries[len(entries)-1].end = end
+	}
+	return entries, -1
+}
+
+// nested returns the entries of the value of e if it's a block mapping.
+func (y yamlLines) nested(e yamlEntry) ([]yamlEntry, bool) {
+	_, value, _ := strings.Cut(y.lines[e.keyLine], ":")
+	if value = strings.TrimSpace(value); value != "" && !strings.HasPrefix(value, "#") {
+		return nil, false
+	}
+	entries, bad := y.entries(e.keyLine+1, e.end)
+	return entries, bad < 0 && len(entries) > 0
+}
+
+// content returns the lines of e that aren't blank or comments, without
+// the indentation of its key line.
+func (y yamlLines) content(e yamlEntry) []string {
+	level := len(leadingWhitespace(y.lines[e.keyLine]))
+	var lines []string
+	for _, line := range y.lines[e.keyLine:e.end] {
+		if trimmedLine := strings.TrimSpace(line); trimmedLine != "" && !strings.HasPrefix(trimmedLine, "#") {
+			lines = append(lines, strings.TrimRight(line[level:], " \t"))
+		}
+	}
+	return lines
+}
+
+// diffEntries sets keep for the lines of the entries of overlay that set
+// what the entries of base don't, see diffYAML, and reports whether it
+// set any.
+func diffEntries(base yamlLines, baseEntries []yamlEntry, overlay yamlLines, overlayEntries []yamlEntry, keep []bool) bool {
+	byKey := make(map[string]yamlEntry, len(baseEntries))
+	for _, e := range baseEntries {
+		byKey[e.key] = e
+	}
+	kept := false
+	for _, e := range overlayEntries {
+		end := e.end
+		if b, ok := byKey[e.key]; ok {
+			if strings.Join(base.content(b), "\n") == strings.Join(overlay.content(e), "\n") {
+				continue
+			}
+			baseNested, baseMapping := base.nested(b)
+			overlayNested, overlayMapping := overlay.nested(e)
+			if baseMapping && overlayMapping {
+				// Keep the key along with what differs beneath it.
+				if !diffEntries(base, baseNested, overlay, overlayNested, keep) {
+					continue
+				}
+				end = e.keyLine + 1
+			}
+		}
+		for i := e.start; i < end; i++ {
+			keep[i] = true
+		}
+		kept = true
+	}
+	return kept
+}
+
+// isText reports whether data can be embedded in a literal block scalar
+// unchanged, i.e. it's UTF-8 without control characters other than tabs
+// and newlines.
+func isText(data []byte) bool {
+	if !utf8.Valid(data) {
+		return false
+	}
+	for _, r := range string(data) {
+		if unicode.IsControl(r) && r != '\t' && r != '\n' {
+			return false
+		}
+	}
+	return true
+}
+
+// binaryReason returns why head, the start of a file, looks like binary
+// data rather than text, or "" if it doesn't. A rune cut off at the end of
+// head only counts as invalid if head is the whole file.
+func binaryReason(head []byte, whole bool) string {
+	if i := bytes.IndexByte(head, 0); i >= 0 {
+		return fmt.Sprintf("a NUL byte at offset %d", i)
+	}
+	for i := 0; i < len(head); {
+		r, size := utf8.DecodeRune(head[i:])
+		if r == utf8.RuneError && size <= 1 {
+			if !whole && !utf8.FullRune(head[i:]) {
+				break
+			}
+			return fmt.Sprintf("invalid UTF-8 at offset %d", i)
+		}
+		i += size
+	}
+	return ""
+}
+
+// expandLeadingTabs replaces the tabs in the leading whitespace of line by
+// spaces up to the next multiple of width columns.
+func expandLeadingTabs(line string, width int) string {
+	column := 0
+	for i := 0; i < len(line); i++ {
+		switch line[i] {
+		case ' ':
+			column++
+		case '\t':
+			column = (column/width + 1) * width
+		default:
+			return strings.Repeat(" ", column) + line[i:]
+		}
+	}
+	return strings.Repeat(" ", column)
+}
+
+// parseScopedVars parses the value of the vars include option, an object
+// of variable names and values like `{NAME: alice, GROUP: "admins"}`.
+func parseScopedVars(object string) (map[string]string, error) {
+	if !strings.HasPrefix(object, "{") || !strings.HasSuffix(object, "}") {
+		return nil, fmt.Errorf("include option vars must be an object like {NAME: value}, got %q", object)
+	}
+	vars := make(map[string]string)
+	for _, pair := range splitIncludeList(object[1 : len(object)-1]) {
+		name, value, ok := strings.Cut(pair, ":")
+		name = strings.TrimSpace(name)
+		if !ok || !varPattern.MatchString("${"+name+"}") {
+			return nil, fmt.Errorf("include option vars expects NAME: value pairs, got %q", pair)
+		}
+		vars[name] = unquote(strings.TrimSpace(value))
+	}
+	return vars, nil
+}
+
+// splitIncludeList splits the comma-separated paths of an include
+// directive, dropping empty entries such as those left by trailing commas.
+// Commas inside the `{...}` options of a path, or in quoted values, don't
+// split it. Like in YAML, a quote only starts a value at its beginning.
+func splitIncludeList(list string) []string {
+	var paths []string
+	depth, start := 0, 0
+	var quote byte
+	for i := 0; i <= len(list); i++ {
+		switch {
+		case i < len(list) && quote != 0:
+			if list[i] == quote {
+				quote = 0
+			}
+		case i < len(list) && (list[i] == '"' || list[i] == '\'') && (i == 0 || strings.IndexByte(" \t:{,", list[i-1]) >= 0):
+			quote = list[i]
+		case i < len(list) && list[i] == '{':
+			depth++
+		case i < len(list) && list[i] == '}' && depth > 0:
+			depth--
+		case i == len(list) || list[i] == ',' && depth == 0:
+			if entry := strings.TrimSpace(list[start:i]); entry != "" {
+				paths = append(paths, entry)
+			}
+			start = i + 1
+		}
+	}
+	return paths
+}
+
+// includeOptions change how the content of an include is pasted, given
+// as an options object after its path, e.g. `frag.yaml {dedent: true}`,
+// or as the modifiers of includeModifiers.
+type includeOptions struct {
+	// dedent, fold, foldPlain and noSeparator are the includeModifiers of
+	// those names.
+	dedent, fold, foldPlain, noSeparator bool
+	// indent is the number of spaces the content is indented by on top of
+	// the indentation of the directive.
+	indent int
+	// optional makes an include of a path that doesn't exist include
+	// nothing instead of failing.
+	optional bool
+	// vars are substituted in the included files, and the files they
+	// include, shadowing Expander.Vars.
+	vars map[string]string
+	// filter names the `#include-filter:` that selects the files of an
+	// included directory.
+	filter string
+	// where names the contentPredicates entry that selects the files of an
+	// included directory.
+	where string
+	// index names the variable holding the index of each copy included by
+	// `#repeat:`, defaultIndexVar if empty.
+	index string
+	// under is a key the content is placed under, after substituting
+	// variables in it.
+	under string
+}
+
+// parseIncludeOptions splits entry, one of the paths of an include
+// directive, into the path and its options: an options object at its end
+// and the modifiers before it.
+func parseIncludeOptions(entry string) (string, includeOptions, error) {
+	var options includeOptions
+	// A `${NAME}` reference at the end, e.g. in under=${NAME}, isn't an
+	// object.
+	refs := varPattern.FindAllStringIndex(entry, -1)
+	if strings.HasSuffix(entry, "}") && (len(refs) == 0 || refs[len(refs)-1][1] != len(entry)) {
+		open, depth := -1, 0
+		for i := len(entry) - 1; i >= 0 && open < 0; i-- {
+			switch entry[i] {
+			case '}':
+				depth++
+			case '{':
+				if depth--; depth == 0 {
+					open = i
+				}
+			}
+		}
+		if open < 0 {
+			return "", options, fmt.Errorf("unbalanced '}' in %q", entry)
+		}
+		object := entry[open+1 : len(entry)-1]
+		entry = strings.TrimSpace(entry[:open])
+		for _, pair := range splitIncludeList(object) {
+			key, value, ok := strings.Cut(pair, ":")
+			key, value = strings.TrimSpace(key), strings.TrimSpace(value)
+			if !ok || value == "" {
+				return "", options, fmt.Errorf("include option %q has no value, expected key: value", key)
+			}
+			var err error
+			switch key {
+			case "dedent":
+				options.dedent, err = strconv.ParseBool(value)
+			case "fold":
+				options.fold, err = strconv.ParseBool(value)
+			case "fold-plain":
+				options.foldPlain, err = strconv.ParseBool(value)
+			case "nosep":
+				options.noSeparator, err = strconv.ParseBool(value)
+			case "optional":
+				options.optional, err = strconv.ParseBool(value)
+			case "indent":
+				options.indent, err = strconv.Atoi(value)
+				if err == nil && options.indent < 0 {
+					err = errors.New("negative")
+				}
+			case "vars":
+				if options.vars, err = parseScopedVars(value); err != nil {
+					return "", options, err
+				}
+			case "filter":
+				options.filter = unquote(value)
+			case "where":
+				options.where = unquote(value)
+			case "under":
+				options.under = unquote(value)
+			case "index":
+				options.index = unquote(value)
+				if !varPattern.MatchString("${" + options.index + "}") {
+					err = errors.New("not a variable name")
+				}
+			default:
+				return "", options, fmt.Errorf("unknown include option %q, expected dedent, filter, fold, fold-plain, indent, index, nosep, optional, under, vars or where", key)
+			}
+			if err != nil {
+				return "", options, fmt.Errorf("bad value %q for include option %s", value, key)
+			}
+		}
+	}
+
+	// Trailing modifiers are shorthands for the boolean options, and
+	// where=<predicate> and under=<key> for those options.
+	for {
+		fields := strings.Fields(entry)
+		if len(fields) < 2 || !includeModifiers[fields[len(fields)-1]] && !strings.HasPrefix(fields[len(fields)-1], "where=") && !strings.HasPrefix(fields[len(fields)-1], "under=") {
+			break
+		}
+		switch modifier := fields[len(fields)-1]; modifier {
+		case "dedent":
+			options.dedent = true
+		case "fold":
+			options.fold = true
+		case "fold-plain":
+			options.foldPlain = true
+		case "nosep":
+			options.noSeparator = true
+		default:
+			if key, ok := strings.CutPrefix(modifier, "under="); ok {
+				options.under = key
+			} else {
+				options.where = strings.TrimPrefix(modifier, "where=")
+			}
+		}
+		entry = strings.TrimSpace(entry[:len(entry)-len(fields[len(fields)-1])])
+	}
+	if entry == "" {
+		return "", options, errors.New("include options without a path")
+	}
+	if _, ok := contentPredicates[options.where]; options.where != "" && !ok {
+		return "", options, fmt.Errorf("unknown where predicate %q, expected cloud-config, no-shebang or shebang", options.where)
+	}
+	return entry, options, nil
+}
+
+// NodeKind is the kind of a Node.
+type NodeKind string
+
+// Kinds of nodes returned by Parse.
+const (
+	// NodeLiteral is a line copied to the output, after substituting
+	// variables and, with Expander.IncludeTags, `!include` tags.
+	NodeLiteral NodeKind = "literal"
+	// NodeInclude is an `#include:` directive, Args holds its paths along
+	// with their modifiers, e.g. "frag.yaml dedent".
+	NodeInclude NodeKind = "include"
+	// NodeIncludeEnv is an `#include-env:` directive, Args as for NodeInclude.
+	NodeIncludeEnv NodeKind = "include-env"
+	// NodeIncludeUnlessKey is an `#include-unless-key:` directive, Args
+	// holds the key followed by the paths.
+	NodeIncludeUnlessKey NodeKind = "include-unless-key"
+	// NodeRepeat is a `#repeat:` directive, Args holds the number of
+	// copies followed by the paths.
+	NodeRepeat NodeKind = "repeat"
+	// NodeIncludeFile is an `#include-file:` directive, Args holds the path
+	// followed by the options, e.g. "dest=/etc/foo.conf".
+	NodeIncludeFile NodeKind = "include-file"
+	// NodeIncludeDiff is an `#include-diff:` directive, Args holds the
+	// paths of the base and the overlay.
+	NodeIncludeDiff NodeKind = "include-diff"
+	// NodeIncludeFilter is an `#include-filter:` directive, Args holds
+	// the name of the filter followed by its globs.
+	NodeIncludeFilter NodeKind = "include-filter"
+	// NodeIncludeLiteral is a line ending in an `#include-literal:`
+	// directive, Args holds the text before it, its indentation, the path
+	// and the chomping, which may be "".
+	NodeIncludeLiteral NodeKind = "include-literal"
+	// NodeDisabledInclude is a disabled include, Args holds its path.
+	NodeDisabledInclude NodeKind = "disabled-include"
+	// NodeIf starts an `#if FLAG` block, Args holds the flag.
+	NodeIf NodeKind = "if"
+	// NodeElse is the `#else` of an #if block.
+	NodeElse NodeKind = "else"
+	// NodeEndif ends an #if block.
+	NodeEndif NodeKind = "endif"
+)
+
+// Node is a line of a template, or several lines for include directives
+// continued with a backslash.
+type Node struct {
+	Kind NodeKind `json:"kind"`
+	// Line is the number of the first line of the node, starting at 1.
+	Line int `json:"line"`
+	// Lines holds the lines of the node as they are in the template.
+	Lines []string `json:"lines"`
+	// Indentation is the whitespace the first line starts with.
+	Indentation string `json:"indentation"`
+	// Args holds the arguments of directives, see the NodeKind constants.
+	Args []string `json:"args,omitempty"`
+}
+
+// Parse splits the template read from r into nodes, without reading any
+// included files or evaluating anything.
+func Parse(r io.Reader) ([]Node, error) {
+	var nodes []Node
+	scanner := bufio.NewScanner(r)
+	lineNo := 0
+	for scanner.Scan() {
+		line := scanner.Text()
+		lineNo++
+		trimmedLine := strings.TrimSpace(line)
+		node := Node{
+			Kind:        NodeLiteral,
+			Line:        lineNo,
+			Lines:       []string{line},
+			Indentation: line[:len(line)-len(strings.TrimLeft(line, " \t"))],
+		}
+
+		if flagName, ok := strings.CutPrefix(trimmedLine, "#if "); ok {
+			node.Kind, node.Args = NodeIf, []string{strings.TrimSpace(flagName)}
+		} else if trimmedLine == "#else" {
+			node.Kind = NodeElse
+		} else if trimmedLine == "#endif" {
+			node.Kind = NodeEndif
+		} else if args, ok := strings.CutPrefix(trimmedLine, "#include-file:"); ok {
+			node.Kind, node.Args = NodeIncludeFile, strings.Fields(args)
+		} else if args, ok := strings.CutPrefix(trimmedLine, "#include-filter:"); ok {
+			node.Kind, node.Args = NodeIncludeFilter, strings.Fields(args)
+		} else if args, ok := strings.CutPrefix(trimmedLine, "#include-diff:"); ok {
+			node.Kind, node.Args = NodeIncludeDiff, strings.Fields(args)
+		} else if m := includeLiteralPattern.FindStringSubmatch(line); m != nil {
+			node.Kind, node.Args = NodeIncludeLiteral, m[1:]
+		} else if includePathStr, ok := disabledInclude(trimmedLine); ok {
+			node.Kind, node.Args = NodeDisabledInclude, []string{includePathStr}
+		} else if prefix, ok := includePrefix(trimmedLine); ok {
+			node.Kind = NodeKind(strings.TrimSuffix(strings.TrimPrefix(prefix, "#"), ":"))
+			// The paths are a comma-separated list, which may be continued on
+			// the following lines by ending a line with a backslash.
+			includeList := strings.TrimSpace(strings.TrimPrefix(trimmedLine, prefix))
+			for strings.HasSuffix(includeList, `\`) && scanner.Scan() {
+				lineNo++
+				node.Lines = append(node.Lines, scanner.Text())
+				continued := strings.TrimPrefix(strings.TrimSpace(scanner.Text()), "#")
+				includeList = strings.TrimSuffix(includeList, `\`) + "," + continued
+			}
+			includeList = strings.TrimSuffix(includeList, `\`)
+			if node.Kind == NodeIncludeUnlessKey || node.Kind == NodeRepeat {
+				key, rest, _ := strings.Cut(strings.TrimSpace(includeList), " ")
+				if key != "" {
+					node.Args = []string{key}
+				}
+				includeList = rest
+			}
+			node.Args = append(node.Args, splitIncludeList(includeList)...)
+		}
+		nodes = append(nodes, node)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return nodes, nil
+}
+
+// DumpNodes writes nodes, as parsed by Parse, to w as indented text, one
+// line per node with its line number, kind, indentation and Args. Nodes
+// within `#if` blocks are indented beneath them. Runs of literal lines are
+// summarized, except comments, as that's what a directive that wasn't
+// recognized ends up as.
+func DumpNodes(w io.Writer, nodes []Node) error {
+	depth := 0
+	for i := 0; i < len(nodes); i++ {
+		node := nodes[i]
+		if (node.Kind == NodeElse || node.Kind == NodeEndif) && depth > 0 {
+			depth--
+		}
+		prefix := strings.Repeat("  ", depth)
+		var err error
+		switch {
+		case node.Kind == NodeLiteral && !strings.HasPrefix(strings.TrimSpace(node.Lines[0]), "#"):
+			end := i
+			for end+1 < len(nodes) && nodes[end+1].Kind == NodeLiteral && !strings.HasPrefix(strings.TrimSpace(nodes[end+1].Lines[0]), "#") {
+				end++
+			}
+			if end == i {
+				_, err = fmt.Fprintf(w, "%s%d literal %q\n", prefix, node.Line, node.Lines[0])
+			} else {
+				_, err = fmt.Fprintf(w, "%s%d-%d literal, %d lines\n", prefix, node.Line, nodes[end].Line, end-i+1)
+			}
+			i = end
+		case node.Kind == NodeLiteral:
+			_, err = fmt.Fprintf(w, "%s%d literal %q\n", prefix, node.Line, node.Lines[0])
+		default:
+			line := fmt.Sprintf("%s%d %s", prefix, node.Line, node.Kind)
+			if node.Indentation != "" {
+				line += fmt.Sprintf(" indent=%q", node.Indentation)
+			}
+			if len(node.Args) > 0 {
+				line += fmt.Sprintf(" args=%q", node.Args)
+			}
+			_, err = fmt.Fprintln(w, line)
+		}
+		if err != nil {
+			return err
+		}
+		if node.Kind == NodeIf || node.Kind == NodeElse {
+			depth++
+		}
+	}
+	return nil
+}
+
+// Lint returns the malformed directives among nodes, as parsed by Parse,
+// with their line numbers, without looking at any files: includes without
+// paths, paths followed by words that aren't modifiers, invalid options,
+// `#include-literal:` without a key, and unbalanced `#if` blocks. The File
+// of the warnings is left empty.
+func Lint(nodes []Node) []Warning {
+	var problems []Warning
+	report := func(line int, format string, args ...any) {
+		problems = append(problems, Warning{Line: line, Message: fmt.Sprintf(format, args...)})
+	}
+
+	var conditions []condition
+	for _, node := range nodes {
+		switch node.Kind {
+		case NodeIf:
+			conditions = append(conditions, condition{line: node.Line})
+		case NodeElse, NodeEndif:
+			switch {
+			case len(conditions) == 0:
+				report(node.Line, "#%s without #if", node.Kind)
+			case node.Kind == NodeEndif:
+				conditions = conditions[:len(conditions)-1]
+			case conditions[len(conditions)-1].inElse:
+				report(node.Line, "second #else for the #if on line %d", conditions[len(conditions)-1].line)
+			default:
+				conditions[len(conditions)-1].inElse = true
+			}
+		case NodeIncludeFile:
+			if _, _, _, err := parseIncludeFileArgs(node.Args); err != nil {
+				report(node.Line, "%v", err)
+			}
+		case NodeIncludeFilter:
+			if err := checkIncludeFilter(node.Args); err != nil {
+				report(node.Line, "%v", err)
+			}
+		case NodeIncludeDiff:
+			if err := checkIncludeDiff(node.Args); err != nil {
+				report(node.Line, "%v", err)
+			}
+		case NodeIncludeLiteral:
+			if strings.TrimSpace(node.Args[0]) == "" {
+				report(node.Line, "#include-literal: needs a key or list item in front of it")
+			}
+		case NodeInclude, NodeIncludeEnv, NodeIncludeUnlessKey, NodeRepeat:
+			paths := node.Args
+			if node.Kind == NodeRepeat && len(paths) > 0 {
+				if _, err := repeatCount(paths[0]); err != nil {
+					report(node.Line, "%v", err)
+				}
+			}
+			if (node.Kind == NodeIncludeUnlessKey || node.Kind == NodeRepeat) && len(paths) > 0 {
+				paths = paths[1:]
+			}
+			if len(paths) == 0 {
+				report(node.Line, "#%s: without a path", node.Kind)
+			}
+			for _, entry := range paths {
+				includePathStr, _, err := parseIncludeOptions(entry)
+				if err != nil {
+					report(node.Line, "%v", err)
+					continue
+				}
+				if fields := strings.Fields(includePathStr); len(fields) > 1 {
+					report(node.Line, "unknown modifier '%s' after %s, expected one of dedent, fold, fold-plain, nosep, under=<key> or where=<predicate>", fields[len(fields)-1], fields[0])
+				}
+			}
+		}
+	}
+	for _, c := range conditions {
+		report(c.line, "#if without #endif")
+	}
+	return problems
+}
+
+// condition is an `#if FLAG` block, and whether its lines are included.
+type condition struct {
+	// line is the line of the #if.
+	line int
+	// value is whether FLAG is defined.
+	value bool
+	// inElse is set after the #else of the block.
+	inElse bool
+}
+
+// activeConditions reports whether lines inside all of conditions are
+// included.
+func activeConditions(conditions []condition) bool {
+	for _, c := range conditions {
+		if c.value == c.inElse {
+			return false
+		}
+	}
+	return true
+}
+
+// defaultIndexVar is the variable `#repeat:` sets to the index of each
+// copy, unless its index option names another.
+const defaultIndexVar = "INDEX"
+
+// repeatCount parses the number of copies of a `#repeat:` directive.
+func repeatCount(count string) (int, error) {
+	copies, err := strconv.Atoi(count)
+	if err != nil || copies < 0 {
+		return 0, fmt.Errorf("#repeat: needs a number of copies before the paths, got %q", count)
+	}
+	return copies, nil
+}
+
+// plainKeyPattern matches the keys `under=` can place content under,
+// which need no quoting.
+var plainKeyPattern = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9_.-]*$`)
+
+// underKey returns the key of the under option under, after substituting
+// variables in it, failing unless it's a plain key.
+func (x *expansion) underKey(under string) (string, error) {
+	if x.refs != nil {
+		for _, match := range varPattern.FindAllStringSubmatch(under, -1) {
+			x.refs[match[1]] = true
+		}
+	}
+	key := x.substituteVars(under)
+	if ref := varPattern.FindString(key); ref != "" {
+		return "", fmt.Errorf("under key %q has the undefined variable %s", under, ref)
+	}
+	if !plainKeyPattern.MatchString(key) {
+		return "", fmt.Errorf("under key %q is %q, expected a plain key of letters, digits, '_', '.' and '-'", under, key)
+	}
+	return key, nil
+}
+
+// includePrefixes start the include directives that take paths.
+var includePrefixes = []string{"#include:", "#include-env:", "#include-unless-key:", "#repeat:"}
+
+// includePrefix returns which of includePrefixes trimmedLine starts with.
+func includePrefix(trimmedLine string) (string, bool) {
+	for _, prefix := range includePrefixes {
+		if strings.HasPrefix(trimmedLine, prefix) {
+			return prefix, true
+		}
+	}
+	return "", false
+}
+
+// noteTopKey adds the key of line to topKeys if it's a top-level key.
+func (x *expansion) noteTopKey(line string) {
+	if key, ok := topLevelKey(line); ok {
+		if x.topKeys == nil {
+			x.topKeys = make(map[string]bool)
+		}
+		x.topKeys[key] = true
+	}
+}
+
+// disabledInclude reports whether trimmedLine is a disabled include
+// directive, and returns the path it names.
+func disabledInclude(trimmedLine string) (string, bool) {
+	for _, prefix := range disabledPrefixes {
+		if strings.HasPrefix(trimmedLine, prefix) {
+			return strings.TrimSpace(strings.TrimPrefix(trimmedLine, prefix)), true
+		}
+	}
+	return "", false
+}
+
+// processIncludePath determines if a path is a file or a directory and
+// processes it accordingly. from and fromLine are where the directive that
+// includes it is. If env is set, name is a directory of profiles and the
+// subdirectory for the active profile is included instead.
+func (x *expansion) processIncludePath(name string, from string, fromLine int, env bool, filter []string, where string) (fragment, error) {
+	directive := fmt.Sprintf("%s:%d", x.displayPath(from), fromLine)
+	if env {
+		profileDir, err := x.profileDir(name)
+		if err != nil {
+			return fragment{}, err
+		}
+		name = profileDir
+	}
+
+	info, err := fs.Stat(x.FS, name)
+	if err != nil && x.CaseInsensitiveIncludes {
+		switch matches := x.resolveCase(name); len(matches) {
+		case 0:
+		case 1:
+			x.warn(Warning{Message: fmt.Sprintf("%s: include path %s only matches %s ignoring case", directive, x.displayPath(name), x.displayPath(matches[0]))})
+			name = matches[0]
+			info, err = fs.Stat(x.FS, name)
+		default:
+			for i := range matches {
+				matches[i] = x.displayPath(matches[i])
+			}
+			return fragment{}, fmt.Errorf("%s: include path %s is ambiguous ignoring case, it matches %s", directive, x.displayPath(name), strings.Join(matches, " and "))
+		}
+	}
+	if err != nil {
+		return fragment{}, &IncludeNotFoundError{Path: x.displayPath(name), FromFile: x.displayPath(from), Line: fromLine, Err: x.displayErr(err)}
+	}
+
+	if info.IsDir() {
+		config, err := x.readDirConfig(name)
+		if err != nil {
+			return fragment{}, err
+		}
+		config.Filter, config.Where = filter, where
+
+		// If it's a directory, walk through it and collect all files.
+		files, excluded, err := x.walkDir(name, config)
+		if err != nil {
+			return fragment{}, err
+		}
+		if len(files) == 0 && x.ErrorOnEmptyDir {
+			if excluded > 0 {
+				return fragment{}, fmt.Errorf("directory %s has no files to include, the %d it has are excluded by its %s or skipped", x.displayPath(name), excluded, dirConfigName)
+			}
+			return fragment{}, fmt.Errorf("directory %s has no files", x.displayPath(name))
+		}
+		if config.Order == dirOrderReverse {
+			sort.Sort(sort.Reverse(sort.StringSlice(files)))
+		}
+		if err := x.sortByPriority(files); err != nil {
+			return fragment{}, err
+		}
+
+		var dirContent fragmentBuilder
+		parent := x.stack[len(x.stack)-1]
+		if x.DirWrap {
+			if err := x.countLines(2); err != nil {
+				return fragment{}, err
+			}
+			dirContent.writeLine(fmt.Sprintf("# START %s/", x.markerPath(name, parent)), lineOrigin{file: name})
+		}
+		// seen maps the hashes of the included content to the files it came from.
+		seen := make(map[[sha256.Size]byte]string)
+		for _, p := range files {
+			// A directory containing a file being processed, such as the
+			// root template, would otherwise include it within itself.
+			if x.onStack(p) {
+				// Elsewhere it wouldn't be skipped.
+				x.uncache()
+				x.warn(Warning{Message: fmt.Sprintf("%s: skipping %s in directory %s, it's already being processed", directive, x.displayPath(p), x.displayPath(name))})
+				continue
+			}
+			if x.includedBefore(p) {
+				continue
+			}
+			// Recursively process the file to handle nested includes.
+			x.recordInclude(p, directive)
+			x.indent += config.Indent
+			fileContent, err := x.processFile(p, false)
+			x.indent -= config.Indent
+			if err != nil {
+				return fragment{}, fmt.Errorf("failed to process file in directory %s: %w", x.displayPath(p), err)
+			}
+			if x.DedupContent {
+				sum := sha256.Sum256([]byte(stripMarkers(fileContent.content)))
+				if first, ok := seen[sum]; ok {
+					x.warn(Warning{File: x.displayPath(p), Message: fmt.Sprintf("skipped, same content as %s", x.displayPath(first))})
+					// Its lines won't be part of the output after all.
+					x.lines -= len(fileContent.origins)
+					continue
+				}
+				seen[sum] = p
+			}
+			if x.SkipEmptyIncludes && fileContent.isEmpty() {
+				x.lines -= len(fileContent.origins)
+				continue
+			}
+			if x.DirWrap {
+				fileContent = fileContent.nestMarkers("  ")
+			}
+			dirContent.writeFragment(fileContent, strings.Repeat(" ", config.Indent))
+		}
+		if x.DirWrap {
+			dirContent.writeLine(fmt.Sprintf("# END %s/", x.markerPath(name, parent)), lineOrigin{file: name})
+		}
+		return dirContent.fragment(), nil
+	}
+
+	// If it's a single file, just process that file.
+	if filter != nil || where != "" {
+		return fragment{}, fmt.Errorf("%s: %s is a file, filters and where= only apply to directories", directive, x.displayPath(name))
+	}
+	if x.includedBefore(name) {
+		return fragment{}, nil
+	}
+	x.recordInclude(name, directive)
+	return x.processFile(name, false)
+}
+
+// includedBefore reports whether name was included before, with
+// IncludeOnceGlobal, and from now on has it count as included.
+func (x *expansion) includedBefore(name string) bool {
+	if !x.IncludeOnceGlobal {
+		return false
+	}
+	if x.once == nil {
+		x.once = make(map[string]bool)
+	}
+	if x.once[name] {
+		return true
+	}
+	x.once[name] = true
+	return false
+}
+
+// resolveCase finds the path that matches name when ignoring the case of
+// its elements, preferring exact matches. It returns nothing if there's
+// none, and if an element matches several entries ignoring case, the
+// paths up to each of them.
+func (x *expansion) resolveCase(name string) []string {
+	resolved := "."
+	for _, elem := range strings.Split(name, "/") {
+		candidate := path.Join(resolved, elem)
+		if _, err := fs.Stat(x.FS, candidate); err == nil || elem == ".." {
+			resolved = candidate
+			continue
+		}
+		entries, err := fs.ReadDir(x.FS, resolved)
+		if err != nil {
+			return nil
+		}
+		var matches []string
+		for _, entry := range entries {
+			if strings.EqualFold(entry.Name(), elem) {
+				matches = append(matches, path.Join(resolved, entry.Name()))
+			}
+		}
+		if len(matches) != 1 {
+			return matches
+		}
+		resolved = matches[0]
+	}
+	return []string{resolved}
+}
+
+// profileDir returns the subdirectory of name for the active profile, or
+// its defaultProfile subdirectory if there is none for the profile.
+func (x *expansion) profileDir(name string) (string, error) {
+	candidates := []string{path.Join(name, defaultProfile)}
+	if x.Profile != "" && x.Profile != defaultProfile {
+		candidates = append([]string{path.Join(name, x.Profile)}, candidates...)
+	}
+	for _, candidate := range candidates {
+		if info, err := fs.Stat(x.FS, candidate); err == nil && info.IsDir() {
+			return candidate, nil
+		}
+	}
+	if len(candidates) == 1 {
+		return "", fmt.Errorf("no %s directory in %s", defaultProfile, x.displayPath(name))
+	}
+	return "", fmt.Errorf("neither a %s nor a %s directory in %s", x.Profile, defaultProfile, x.displayPath(name))
+}
+
+// walkDir returns the files below the directory name that are included,
+// in the order of fs.WalkDir, along with the number of files left out. It
+// walks with a stack rather than recursing, failing once directories are
+// nested deeper than MaxDirDepth.
+func (x *expansion) walkDir(name string, config dirConfig) ([]string, int, error) {
+	maxDepth := x.MaxDirDepth
+	if maxDepth <= 0 {
+		maxDepth = defaultMaxDirDepth
+	}
+	recursion := x.DirRecursion
+	if config.Recursion != "" {
+		recursion = config.Recursion
+	}
+	descend := recursion == "" || recursion == DirRecursionDeep
+
+	type walkEntry struct {
+		path  string
+		isDir bool
+		depth int
+	}
+	var files []string
+	excluded := 0
+	stack := []walkEntry{{path: name, isDir: true}}
+	for len(stack) > 0 {
+		entry := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+
+		// We only want to include the content of files, not directories.
+		if !entry.isDir {
+			switch {
+			case path.Base(entry.path) == dirConfigName:
+			case !x.skipped(entry.path) && config.matches(entry.path) && config.filterMatches(strings.TrimPrefix(entry.path, name+"/")):
+				if config.Where != "" {
+					ok, err := x.satisfies(entry.path, config.Where)
+					if err != nil {
+						return nil, 0, err
+					}
+					if !ok {
+						excluded++
+						continue
+					}
+				}
+				files = append(files, entry.path)
+			default:
+				excluded++
+			}
+			continue
+		}
+		if entry.depth > 0 && !descend {
+			continue
+		}
+		if entry.depth > maxDepth {
+			return nil, 0, &DepthExceededError{File: x.displayPath(name), Depth: maxDepth}
+		}
+
+		children, err := fs.ReadDir(x.FS, entry.path)
+		if err != nil {
+			return nil, 0, x.displayErr(err)
+		}
+		// Children are sorted by name, push them in reverse to pop them in order.
+		for i := len(children) - 1; i >= 0; i-- {
+			stack = append(stack, walkEntry{
+				path:  path.Join(entry.path, children[i].Name()),
+				isDir: children[i].IsDir(),
+				depth: entry.depth + 1,
+			})
+		}
+	}
+	return files, excluded, nil
+}
+
+// stripMarkers returns the processed content of an included file without
+// its START and END markers.
+func stripMarkers(content string) string {
+	_, body, _ := strings.Cut(content, "\n")
+	body = strings.TrimSuffix(body, "\n")
+	if i := strings.LastIndex(body, "\n"); i >= 0 {
+		return body[:i+1]
+	}
+	return ""
+}
+
+// orderDirective, followed by a number on the first line of a file in an
+// included directory, sets its priority: files are included by ascending
+// priority, then in the directory's order.
+const orderDirective = "# cloud-init-order:"
+
+// defaultPriority is the priority of files without an orderDirective.
+const defaultPriority = 50
+
+// sortByPriority stably sorts files, the files of an included directory in
+// its order, by the priority their first line sets.
+func (x *expansion) sortByPriority(files []string) error {
+	priorities := make(map[string]int, len(files))
+	for _, name := range files {
+		priority, err := x.filePriority(name)
+		if err != nil {
+			return err
+		}
+		priorities[name] = priority
+	}
+	sort.SliceStable(files, func(i, j int) bool {
+		return priorities[files[i]] < priorities[files[j]]
+	})
+	return nil
+}
+
+// filePriority returns the priority set by the orderDirective on the first
+// line of the file name, or defaultPriority. Only regular files are read.
+func (x *expansion) filePriority(name string) (int, error) {
+	info, err := fs.Stat(x.FS, name)
+	if err != nil || !info.Mode().IsRegular() {
+		return defaultPriority, nil
+	}
+	firstLine, err := x.firstLine(name)
+	if err != nil {
+		return 0, err
+	}
+	value, ok := strings.CutPrefix(strings.TrimSpace(firstLine), orderDirective)
+	if !ok {
+		return defaultPriority, nil
+	}
+	priority, err := strconv.Atoi(strings.TrimSpace(value))
+	if err != nil {
+		return 0, fmt.Errorf("%s:1: %s needs a number, got %q", x.displayPath(name), orderDirective, strings.TrimSpace(value))
+	}
+	return priority, nil
+}
+
+// firstLine returns the first line of the file name, without its line
+// ending.
+func (x *expansion) firstLine(name string) (string, error) {
+	file, err := x.FS.Open(name)
+	if err != nil {
+		return "", fmt.Errorf("failed to open file %s: %w", x.displayPath(name), x.displayErr(err))
+	}
+	defer file.Close()
+	line, err := bufio.NewReader(file).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return "", fmt.Errorf("failed to read file %s: %w", x.displayPath(name), x.displayErr(err))
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// contentPredicates are the conditions on the first line of a file that
+// `where=` selects the files of a directory include by.
+var contentPredicates = map[string]func(firstLine string) bool{
+	// shebang selects scripts, starting with `#!`.
+	"shebang": func(firstLine string) bool { return strings.HasPrefix(firstLine, "#!") },
+	// no-shebang selects everything but scripts.
+	"no-shebang": func(firstLine string) bool { return !strings.HasPrefix(firstLine, "#!") },
+	// cloud-config selects files starting with a `#cloud-config` line.
+	"cloud-config": func(firstLine string) bool { return strings.HasPrefix(firstLine, "#cloud-config") },
+}
+
+// satisfies reports whether the file name satisfies the contentPredicates
+// entry where. Files that aren't regular files, such as named pipes, never
+// do, as reading them could block.
+func (x *expansion) satisfies(name string, where string) (bool, error) {
+	info, err := fs.Stat(x.FS, name)
+	if err != nil || !info.Mode().IsRegular() {
+		return false, nil
+	}
+	firstLine, err := x.firstLine(name)
+	if err != nil {
+		return false, err
+	}
+	return contentPredicates[where](firstLine), nil
+}
+
+// Orders in which the files of an included directory are included.
+const (
+	// dirOrderName includes files sorted by their path.
+	dirOrderName = "name"
+	// dirOrderReverse includes files reverse sorted by their path.
+	dirOrderReverse = "reverse"
+)
+
+// How far directory includes descend into subdirectories.
+const (
+	// DirRecursionNone includes only the files directly in the directory.
+	DirRecursionNone = "none"
+	// DirRecursionShallow is the same as DirRecursionNone.
+	DirRecursionShallow = "shallow"
+	// DirRecursionDeep includes the files in all subdirectories as well,
+	// up to MaxDirDepth levels down.
+	DirRecursionDeep = "deep"
+)
+
+// Directories include paths are relative to.
+const (
+	// IncludeBaseFile resolves include paths relative to the directory of
+	// the including file.
+	IncludeBaseFile = "file"
+	// IncludeBaseRoot resolves include paths relative to the root of FS.
+	IncludeBaseRoot = "root"
+	// IncludeBaseCwd resolves include paths relative to WorkDir.
+	IncludeBaseCwd = "cwd"
+)
+
+// dirConfig configures how a directory is included. It's read from the
+// dirConfigName file in the directory, and applies to all files below it.
+type dirConfig struct {
+	// Extensions, if not empty, restricts the included files to those
+	// with one of these extensions.
+	Extensions []string
+	// Order is one of the dirOrder constants.
+	Order string
+	// Indent is the number of spaces added in front of every line of the
+	// included files, on top of the indentation of the directive.
+	Indent int
+	// Recursion is one of the DirRecursion constants, overriding
+	// Expander.DirRecursion if set.
+	Recursion string
+	// Filter holds the globs of the `#include-filter:` the directory is
+	// included with, if any, see filterMatches.
+	Filter []string
+	// Where names the contentPredicates entry the files have to satisfy,
+	// if any.
+	Where string
+}
+
+// matches reports whether the file name passes the extension filter.
+func (c dirConfig) matches(name string) bool {
+	if len(c.Extensions) == 0 {
+		return true
+	}
+	for _, ext := range c.Extensions {
+		if path.Ext(name) == ext {
+			return true
+		}
+	}
+	return false
+}
+
+// filterMatches reports whether the file rel, relative to the directory,
+// passes the Filter: it has to match one of its globs, unless they're
+// all exclusions, and none of its exclusions, which start with `!`.
+// Globs without a slash match the file name only.
+func (c dirConfig) filterMatches(rel string) bool {
+	included, hasIncludes := false, false
+	for _, glob := range c.Filter {
+		exclude := strings.HasPrefix(glob, "!")
+		glob = strings.TrimPrefix(glob, "!")
+		subject := rel
+		if !strings.Contains(glob, "/") {
+			subject = path.Base(rel)
+		}
+		matched, _ := path.Match(glob, subject)
+		switch {
+		case exclude && matched:
+			return false
+		case !exclude:
+			hasIncludes = true
+			included = included || matched
+		}
+	}
+	return included || !hasIncludes
+}
+
+// checkIncludeFilter checks the Args of an `#include-filter:` directive,
+// a name followed by at least one glob.
+func checkIncludeFilter(args []string) error {
+	if len(args) < 2 {
+		return errors.New("#include-filter: needs a name and at least one glob, e.g. `#include-filter: enabled *.yaml !*.disabled.yaml`")
+	}
+	for _, glob := range args[1:] {
+		if _, err := path.Match(strings.TrimPrefix(glob, "!"), ""); err != nil {
+			return fmt.Errorf("invalid glob %q in #include-filter: %w", glob, err)
+		}
+	}
+	return nil
+}
+
+// readDirConfig reads the configuration of the directory name, returning
+// the defaults if it has none.
+func (x *expansion) readDirConfig(name string) (dirConfig, error) {
+	config := dirConfig{Order: dirOrderName}
+	configPath := path.Join(name, dirConfigName)
+	data, err := fs.ReadFile(x.FS, configPath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return config, nil
+	}
+	if err != nil {
+		return config, fmt.Errorf("failed to read %s: %w", x.displayPath(configPath), x.displayErr(err))
+	}
+
+	settings, err := parseFlatYAML(string(data))
+	if err != nil {
+		return config, fmt.Errorf("invalid %s: %w", x.displayPath(configPath), err)
+	}
+	for key, values := range settings {
+		switch key {
+		case "extensions":
+			for _, ext := range values {
+				if !strings.HasPrefix(ext, ".") {
+					ext = "." + ext
+				}
+				config.Extensions = append(config.Extensions, ext)
+			}
+		case "order":
+			if len(values) != 1 || (values[0] != dirOrderName && values[0] != dirOrderReverse) {
+				return config, fmt.Errorf("invalid %s: order must be %s or %s", x.displayPath(configPath), dirOrderName, dirOrderReverse)
+			}
+			config.Order = values[0]
+		case "indent":
+			indent, err := strconv.Atoi(strings.Join(values, ""))
+			if err != nil || indent < 0 {
+				return config, fmt.Errorf("invalid %s: indent must be a number of spaces", x.displayPath(configPath))
+			}
+			config.Indent = indent
+		case "recursion":
+			if len(values) != 1 || !validDirRecursion(values[0]) {
+				return config, fmt.Errorf("invalid %s: recursion must be %s, %s or %s", x.displayPath(configPath), DirRecursionNone, DirRecursionShallow, DirRecursionDeep)
+			}
+			config.Recursion = values[0]
+		default:
+			return config, fmt.Errorf("invalid %s: unknown setting '%s'", x.displayPath(configPath), key)
+		}
+	}
+	return config, nil
+}
+
+// validDirRecursion reports whether recursion is one of the DirRecursion
+// constants.
+func validDirRecursion(recursion string) bool {
+	return recursion == DirRecursionNone || recursion == DirRecursionShallow || recursion == DirRecursionDeep
+}
+
+// parseFlatYAML parses the small subset of YAML used by configuration
+// files: a mapping of keys to scalars or lists of scalars, either in flow
+// style (`[a, b]`), comma-separated, or as a block of `- item` lines.
+// Every value is returned as a list.
+func parseFlatYAML(data string) (map[string][]string, error) {
+	settings := make(map[string][]string)
+	var listKey string
+	for lineNo, line := range strings.Split(data, "\n") {
+		trimmedLine := strings.TrimSpace(line)
+		if trimmedLine == "" || strings.HasPrefix(trimmedLine, "#") {
+			continue
+		}
+
+		if item, ok := strings.CutPrefix(trimmedLine, "- "); ok && listKey != "" {
+			settings[listKey] = append(settings[listKey], unquote(strings.TrimSpace(item)))
+			continue
+		}
+
+		key, value, ok := strings.Cut(trimmedLine, ":")
+		if !ok || strings.TrimSpace(key) == "" || line != strings.TrimLeft(line, " \t") {
+			return nil, fmt.Errorf("line %d: expected `key: value`", lineNo+1)
+		}
+		key = strings.TrimSpace(key)
+		value = strings.TrimSpace(value)
+		if value == "" {
+			// The values follow as a block of `- item` lines.
+			listKey = key
+			settings[key] = nil
+			continue
+		}
+		listKey = ""
+		value = strings.TrimSuffix(strings.TrimPrefix(value, "["), "]")
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				settings[key] = append(settings[key], unquote(item))
+			}
+		}
+	}
+	return settings, nil
+}
+
+// unquote strips the quotes from a single- or double-quoted YAML scalar.
+func unquote(s string) string {
+	if len(s) >= 2 && (s[0] == '"' || s[0] == '\'') && s[len(s)-1] == s[0] {
+		return s[1 : len(s)-1]
+	}
+	return s
+}
+
+// recordInclude notes that directive included the file name.
+func (x *expansion) recordInclude(name string, directive string) {
+	x.noteInput(name)
+	if x.includedBy == nil {
+		x.includedBy = make(map[string][]string)
+	}
+	if _, ok := x.includedBy[name]; !ok {
+		x.includeOrder = append(x.includeOrder, name)
+	}
+	x.includedBy[name] = append(x.includedBy[name], directive)
+}
+
+// noteInput adds name to the inputs of the expansion, if they're asked for.
+func (x *expansion) noteInput(name string) {
+	if x.Inputs == nil {
+		return
+	}
+	if x.inputs == nil {
+		x.inputs = make(map[string]bool)
+	}
+	x.inputs[name] = true
+}
+
+// warnDuplicateIncludes warns about every file that was included more
+// than once, listing the directives that included it.
+func (x *expansion) warnDuplicateIncludes() {
+	for _, name := range x.includeOrder {
+		if directives := x.includedBy[name]; len(directives) > 1 {
+			x.warn(Warning{
+				File:    x.displayPath(name),
+				Message: fmt.Sprintf("included %d times, by %s", len(directives), strings.Join(directives, ", ")),
+			})
+		}
+	}
+}
+
+// lintDuplicates warns about distinct included files with the same
+// content, which are better off as one file included in several places.
+// Files with nothing but whitespace don't count.
+func (x *expansion) lintDuplicates() {
+	byHash := make(map[[sha256.Size]byte][]string)
+	var hashes [][sha256.Size]byte
+	for _, name := range x.includeOrder {
+		info, err := fs.Stat(x.FS, name)
+		if err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+		data, err := fs.ReadFile(x.FS, name)
+		if err != nil || len(bytes.TrimSpace(data)) == 0 {
+			continue
+		}
+		hash := sha256.Sum256(data)
+		if byHash[hash] == nil {
+			hashes = append(hashes, hash)
+		}
+		byHash[hash] = append(byHash[hash], name)
+	}
+
+	for _, hash := range hashes {
+		names := byHash[hash]
+		if len(names) < 2 {
+			continue
+		}
+		others := make([]string, len(names)-1)
+		for i, name := range names[1:] {
+			others[i] = x.displayPath(name)
+		}
+		x.warn(Warning{
+			File:    x.displayPath(names[0]),
+			Message: fmt.Sprintf("has the same content as %s, consider including one file instead", strings.Join(others, ", ")),
+		})
+	}
+}
+
+// skipped reports whether directory includes must pass over the file name.
+func (x *expansion) skipped(name string) bool {
+	for _, skip := range x.Skip {
+		if path.Clean(skip) == name {
+			return true
+		}
+	}
+	return false
+}
+
+// displayPath returns name the way it's shown in errors and warnings.
+func (x *expansion) displayPath(name string) string {
+	if x.DisplayRoot == "" {
+		return name
+	}
+	return filepath.Join(x.DisplayRoot, filepath.FromSlash(name))
+}
+
+// displayErr rewrites the path of an fs.PathError, which holds a name in
+// FS, the way it's shown in errors and warnings.
+func (x *expansion) displayErr(err error) error {
+	var pathErr *fs.PathError
+	if errors.As(err, &pathErr) {
+		pathErr.Path = x.displayPath(pathErr.Path)
+	}
+	return err
+}
+
+// dirFS is an fs.FS rooted at a directory on disk. Unlike os.DirFS it
+// accepts names starting with "../", so includes may reach outside of it.
+type dirFS string
+
+func (d dirFS) Open(name string) (fs.File, error) {
+	file, err := os.Open(filepath.Join(string(d), filepath.FromSlash(name)))
+	if err != nil {
+		// Report the name in FS rather than the path on disk, like os.DirFS.
+		var pathErr *fs.PathError
+		if errors.As(err, &pathErr) {
+			pathErr.Path = name
+		}
+		return nil, err
+	}
+	return file, nil
+}
+
+// Stat implements fs.StatFS, so that stating a named pipe doesn't open it.
+func (d dirFS) Stat(name string) (fs.FileInfo, error) {
+	info, err := os.Stat(filepath.Join(string(d), filepath.FromSlash(name)))
+	if err != nil {
+		var pathErr *fs.PathError
+		if errors.As(err, &pathErr) {
+			pathErr.Path = name
+		}
+		return nil, err
+	}
+	return info, nil
+}
+
+// mapFS is a read-only filesystem of files held in memory, which map
+// slash-separated paths to contents. The directories the paths are in are
+// implied.
+type mapFS map[string][]byte
+
+func (m mapFS) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+	if data, ok := m[name]; ok {
+		return &mapFile{Reader: bytes.NewReader(data), info: mapFileInfo{name: path.Base(name), size: int64(len(data))}}, nil
+	}
+
+	// Otherwise name is a directory if there are files below it.
+	prefix := name + "/"
+	if name == "." {
+		prefix = ""
+	}
+	dir := &mapDir{info: mapFileInfo{name: path.Base(name), dir: true}}
+	seen := make(map[string]bool)
+	for p, data := range m {
+		rest, ok := strings.CutPrefix(p, prefix)
+		if !ok {
+			continue
+		}
+		child, _, isDir := strings.Cut(rest, "/")
+		if seen[child] {
+			continue
+		}
+		seen[child] = true
+		info := mapFileInfo{name: child, dir: isDir}
+		if !isDir {
+			info.size = int64(len(data))
+		}
+		dir.entries = append(dir.entries, fs.FileInfoToDirEntry(info))
+	}
+	if len(dir.entries) == 0 && name != "." {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	sort.Slice(dir.entries, func(i, j int) bool { return dir.entries[i].Name() < dir.entries[j].Name() })
+	return dir, nil
+}
+
+// mapFileInfo describes a file or directory of a mapFS.
+type mapFileInfo struct {
+	name string
+	size int64
+	dir  bool
+}
+
+func (i mapFileInfo) Name() string       { return i.name }
+func (i mapFileInfo) Size() int64        { return i.size }
+func (i mapFileInfo) ModTime() time.Time { return time.Time{} }
+func (i mapFileInfo) IsDir() bool        { return i.dir }
+func (i mapFileInfo) Sys() any           { return nil }
+
+func (i mapFileInfo) Mode() fs.FileMode {
+	if i.dir {
+		return fs.ModeDir | 0o755
+	}
+	return 0o644
+}
+
+// mapFile is a file of a mapFS opened for reading.
+type mapFile struct {
+	*bytes.Reader
+	info mapFileInfo
+}
+
+func (f *mapFile) Stat() (fs.FileInfo, error) { return f.info, nil }
+func (f *mapFile) Close() error               { return nil }
+
+// mapDir is a directory of a mapFS opened for reading its entries.
+type mapDir struct {
+	info    mapFileInfo
+	entries []fs.DirEntry
+	// read is the number of entries ReadDir returned so far.
+	read int
+}
+
+func (d *mapDir) Stat() (fs.FileInfo, error) { return d.info, nil }
+func (d *mapDir) Close() error               { return nil }
+
+func (d *mapDir) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.info.name, Err: errors.New("is a directory")}
+}
+
+func (d *mapDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	rest := d.entries[d.read:]
+	if n <= 0 {
+		d.read = len(d.entries)
+		return rest, nil
+	}
+	if len(rest) == 0 {
+		return nil, io.EOF
+	}
+	if n > len(rest) {
+		n = len(rest)
+	}
+	d.read += n
+	return rest[:n], nil
+}
+
+// errNotGitRepo is returned by gitFS for directories outside of a git
+// repository.
+var errNotGitRepo = errors.New("not a git repository")
+
+// gitFS returns the files below dir as they are in the commit ref of the
+// git repository dir is in, read with the git command. Files outside of
+// dir, symbolic links and submodules aren't included.
+func gitFS(dir string, ref string) (fs.FS, error) {
+	git := func(stdin io.Reader, args ...string) ([]byte, error) {
+		cmd := exec.Command("git", append([]string{"-C", dir}, args...)...)
+		cmd.Stdin = stdin
+		var stderr bytes.Buffer
+		cmd.Stderr = &stderr
+		out, err := cmd.Output()
+		if err != nil {
+			return nil, fmt.Errorf("git %s: %w\n%s", args[0], err, strings.TrimRight(stderr.String(), "\n"))
+		}
+		return out, nil
+	}
+
+	if _, err := git(nil, "rev-parse", "--git-dir"); err != nil {
+		if _, lookErr := exec.LookPath("git"); lookErr != nil {
+			return nil, fmt.Errorf("cannot read %s: %w", ref, lookErr)
+		}
+		return nil, errNotGitRepo
+	}
+	if _, err := git(nil, "rev-parse", "--verify", "--quiet", ref+"^{commit}"); err != nil {
+		return nil, fmt.Errorf("unknown git ref '%s'", ref)
+	}
+
+	// Paths are listed relative to dir.
+	out, err := git(nil, "ls-tree", "-r", "-z", ref, "--", ".")
+	if err != nil {
+		return nil, err
+	}
+	var names, objects []string
+	for _, entry := range strings.Split(strings.TrimSuffix(string(out), "\x00"), "\x00") {
+		// Entries look like `<mode> <type> <object>\t<path>`.
+		info, name, ok := strings.Cut(entry, "\t")
+		fields := strings.Fields(info)
+		if !ok || len(fields) != 3 || fields[1] != "blob" || fields[0] == "120000" {
+			continue
+		}
+		names = append(names, name)
+		objects = append(objects, fields[2])
+	}
+
+	files := make(mapFS)
+	if len(objects) == 0 {
+		return files, nil
+	}
+
+	// Read all blobs with a single git process.
+	out, err = git(strings.NewReader(strings.Join(objects, "\n")+"\n"), "cat-file", "--batch")
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range names {
+		// Each blob is `<object> blob <size>\n<content>\n`.
+		header, rest, ok := bytes.Cut(out, []byte("\n"))
+		fields := strings.Fields(string(header))
+		if !ok || len(fields) != 3 {
+			return nil, fmt.Errorf("unexpected output of git cat-file for %s", name)
+		}
+		size, err := strconv.Atoi(fields[2])
+		if err != nil || size+1 > len(rest) {
+			return nil, fmt.Errorf("unexpected output of git cat-file for %s", name)
+		}
+		files[name] = rest[:size]
+		out = rest[size+1:]
+	}
+	return files, nil
+}
+
+// MapFS returns a filesystem holding files, which map paths to contents,
+// for an Expander to read templates assembled in memory, e.g. from a
+// database. Paths are slash-separated and relative, like "fragments/a.yaml",
+// and the directories they name are implied, so including "fragments/"
+// includes every file under it.
+func MapFS(files map[string]string) (fs.FS, error) {
+	fsys := make(mapFS, len(files))
+	for name, content := range files {
+		clean := path.Clean(name)
+		if !fs.ValidPath(clean) || clean == "." {
+			return nil, fmt.Errorf("invalid file path %q, expected a relative slash-separated path", name)
+		}
+		if _, ok := fsys[clean]; ok {
+			return nil, fmt.Errorf("file path %q is given twice", clean)
+		}
+		fsys[clean] = []byte(content)
+	}
+	for name := range fsys {
+		for dir := path.Dir(name); dir != "."; dir = path.Dir(dir) {
+			if _, ok := fsys[dir]; ok {
+				return nil, fmt.Errorf("file path %q is also the directory of %q", dir, name)
+			}
+		}
+	}
+	return fsys, nil
+}
+
+// ANSI escape sequences used for colored diagnostics.
+const (
+	ansiRed    = "\x1b[31m"
+	ansiYellow = "\x1b[33m"
+	ansiBold   = "\x1b[1m"
+	// ansiNormal ends bold text without resetting the color.
+	ansiNormal = "\x1b[22m"
+	ansiReset  = "\x1b[0m"
+)
+
+// useColor decides from a `--color` mode whether diagnostics on standard
+// error are colored. In auto mode they are if standard error is a terminal
+// and NO_COLOR isn't set.
+func useColor(mode string) (bool, error) {
+	switch mode {
+	case "always":
+		return true, nil
+	case "never":
+		return false, nil
+	case "auto":
+		if os.Getenv("NO_COLOR") != "" || os.Getenv("TERM") == "dumb" {
+			return false, nil
+		}
+		info, err := os.Stderr.Stat()
+		return err == nil && info.Mode()&os.ModeCharDevice != 0, nil
+	}
+	return false, fmt.Errorf("unknown color mode '%s', expected auto, always or never", mode)
+}
+
+// colorWriter colors the log messages written to it, warnings in yellow
+// and everything else, which are errors, in red.
+type colorWriter struct {
+	w io.Writer
+}
+
+func (c colorWriter) Write(p []byte) (int, error) {
+	color := ansiRed
+	if bytes.Contains(p, []byte("Warning: ")) {
+		color = ansiYellow
+	}
+	colored := color + strings.TrimSuffix(string(p), "\n") + ansiReset + "\n"
+	if _, err := io.WriteString(c.w, colored); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// appendWarnings returns content followed by a comment listing warnings,
+// so they're kept with the file. The comment comes right after the last
+// line, as a blank line in between would add to a block scalar with keep
+// chomping (`|+`) ending the document. Whether content ends in a newline
+// is kept.
+func appendWarnings(content string, warnings []Warning) string {
+	body := strings.TrimSuffix(content, "\n")
+	var b strings.Builder
+	if body != "" {
+		b.WriteString(body + "\n")
+	}
+	fmt.Fprintf(&b, "# %d warning(s) while expanding:", len(warnings))
+	for _, w := range warnings {
+		b.WriteString("\n# " + strings.ReplaceAll(w.String(), "\n", " "))
+	}
+	if body != content || content == "" {
+		b.WriteString("\n")
+	}
+	return b.String()
+}
+
+// projectConfigPaths are the options whose relative paths are relative to
+// the directory of the project config they're set in.
+var projectConfigPaths = map[string]bool{"o": true, "into": true, "sourcemap": true, "cache-dir": true, "lib-dir": true, "output-dir": true, "sign-key": true}
+
+// findProjectConfig returns the path of the projectConfigName file in dir
+// or the closest directory above it, or "" if there is none.
+func findProjectConfig(dir string) string {
+	for {
+		candidate := filepath.Join(dir, projectConfigName)
+		if info, err := os.Stat(candidate); err == nil && !info.IsDir() {
+			return candidate
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return ""
+		}
+		dir = parent
+	}
+}
+
+// applyProjectConfig sets the flags named in the project config file at
+// configPath, unless they were given on the command line. Its keys are
+// flag names, and repeatable flags take a list of values.
+func applyProjectConfig(flags *flag.FlagSet, configPath string) error {
+	data, err := os.ReadFile(configPath)
+	if err != nil {
+		return err
+	}
+	settings, err := parseFlatYAML(string(data))
+	if err != nil {
+		return err
+	}
+	given := make(map[string]bool)
+	flags.Visit(func(f *flag.Flag) { given[f.Name] = true })
+
+	keys := make([]string, 0, len(settings))
+	for key := range settings {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if flags.Lookup(key) == nil {
+			return fmt.Errorf("unknown option '%s'", key)
+		}
+		if given[key] {
+			continue
+		}
+		for _, value := range settings[key] {
+			if projectConfigPaths[key] && value != "" && !filepath.IsAbs(value) {
+				value = filepath.Join(filepath.Dir(configPath), value)
+			}
+			if err := flags.Set(key, value); err != nil {
+				return fmt.Errorf("bad value '%s' for %s: %v", value, key, err)
+			}
+		}
+	}
+	return nil
+}
+
+// lineRange describes the lines first to last, e.g. "lines 3-5".
+func lineRange(first int, last int) string {
+	if first == last {
+		return fmt.Sprintf("line %d", first)
+	}
+	return fmt.Sprintf("lines %d-%d", first, last)
+}
+
+// logWarning logs w, highlighting its location if color is set.
+func logWarning(w Warning, color bool) {
+	if color && w.File != "" {
+		log.Printf("Warning: %s%s%s: %s", ansiBold, w.location(), ansiNormal, w.Message)
+		return
+	}
+	log.Printf("Warning: %s", w)
+}
+
+// errorAnnotation returns the GitHub Actions annotation for err, which
+// expanding the template file failed with, pointing at the include that
+// wasn't found if that's what it was.
+func errorAnnotation(dir string, file string, err error) string {
+	var line int
+	var notFound *IncludeNotFoundError
+	if errors.As(err, &notFound) {
+		file, line = notFound.FromFile, notFound.Line
+	}
+	return githubAnnotation("error", dir, file, line, err.Error())
+}
+
+// githubAnnotation formats message as a GitHub Actions workflow command
+// annotating line of file, a path shown in errors relative to dir, at
+// level "warning" or "error". file may be empty and line 0.
+func githubAnnotation(level string, dir string, file string, line int, message string) string {
+	escape := strings.NewReplacer("%", "%25", "\r", "%0D", "\n", "%0A")
+	escapeProperty := strings.NewReplacer("%", "%25", "\r", "%0D", "\n", "%0A", ":", "%3A", ",", "%2C")
+
+	var properties []string
+	if file != "" {
+		// GitHub expects paths relative to the checkout, the working directory.
+		if !filepath.IsAbs(file) {
+			file = filepath.Join(dir, filepath.FromSlash(file))
+		}
+		if cwd, err := os.Getwd(); err == nil {
+			if rel, err := filepath.Rel(cwd, file); err == nil {
+				file = rel
+			}
+		}
+		properties = append(properties, "file="+escapeProperty.Replace(filepath.ToSlash(file)))
+		if line > 0 {
+			properties = append(properties, fmt.Sprintf("line=%d", line))
+		}
+	}
+	if len(properties) == 0 {
+		return fmt.Sprintf("::%s::%s", level, escape.Replace(message))
+	}
+	return fmt.Sprintf("::%s %s::%s", level, strings.Join(properties, ","), escape.Replace(message))
+}
+
+// runPostHook runs command through the shell with content on its standard
+// input. If replace is set, what the command prints replaces content,
+// otherwise it's passed on to standard error.
+func runPostHook(command string, content string, replace bool) (string, error) {
+	var cmd *exec.Cmd
+	if runtime.GOOS == "windows" {
+		cmd = exec.Command("cmd", "/C", command)
+	} else {
+		cmd = exec.Command("sh", "-c", command)
+	}
+	cmd.Stdin = strings.NewReader(content)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if !replace {
+		cmd.Stdout = os.Stderr
+	}
+
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("post hook '%s' failed: %w\n%s", command, err, strings.TrimRight(stderr.String(), "\n"))
+	}
+	os.Stderr.Write(stderr.Bytes())
+	if replace {
+		return stdout.String(), nil
+	}
+	return content, nil
+}
+
+// cloudInitPath returns the path of the cloud-init command, or "" if it
+// isn't installed, in which case schema validation is skipped with a
+// warning through warn.
+func cloudInitPath(warn func(Warning)) string {
+	cloudInit, err := exec.LookPath("cloud-init")
+	if err != nil {
+		warn(Warning{Message: "cloud-init not found on PATH, skipping schema validation"})
+		return ""
+	}
+	return cloudInit
+}
+
+// validateSchema runs content through `cloud-init schema`, the command at
+// cloudInit, returning its diagnostics as the error if the schema is
+// invalid. The file passed to it is created in tempDir, or the default
+// directory for temporary files if that's "".
+func validateSchema(content string, tempDir string, cloudInit string) error {
+	tmp, err := os.CreateTemp(tempDir, "cloud-init-*.yaml")
+	if err != nil {
+		return fmt.Errorf("could not create file for schema validation: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.WriteString(content)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("could not write file for schema validation: %w", err)
+	}
+
+	out, err := exec.Command(cloudInit, "schema", "--config-file", tmp.Name()).CombinedOutput()
+	if err == nil {
+		return nil
+	}
+	// Refer to the expanded template rather than the temporary file.
+	diagnostics := strings.ReplaceAll(strings.TrimRight(string(out), "\n"), tmp.Name(), "expanded "+rootTemplateName)
+	var lines []string
+	for _, line := range strings.Split(diagnostics, "\n") {
+		lines = append(lines, "  "+line)
+	}
+	return fmt.Errorf("schema validation failed: %w\n%s", err, strings.Join(lines, "\n"))
+}
+
+// blockScalarPattern matches the end of a line starting a block scalar.
+var blockScalarPattern = regexp.MustCompile(`(^|[\s:-])[|>][0-9+-]*\s*$`)
+
+// quotedMarkers returns the numbers of the START/END marker lines of
+// content that are inside a quoted scalar spanning several lines, where
+// they'd become part of its value. Quotes are tracked line by line rather
+// than by parsing the YAML: a quote starts a scalar only at the start of a
+// value, and lines of block scalars are skipped.
+func quotedMarkers(content string) []int {
+	var markers []int
+	var quote byte
+	blockIndent := -1
+	for lineNo, line := range strings.Split(content, "\n") {
+		trimmedLine := strings.TrimSpace(line)
+		if quote != 0 && (strings.HasPrefix(trimmedLine, "# START ") || strings.HasPrefix(trimmedLine, "# END ")) {
+			markers = append(markers, lineNo+1)
+			continue
+		}
+		indent := len(line) - len(strings.TrimLeft(line, " "))
+		if quote == 0 && blockIndent >= 0 {
+			if trimmedLine == "" || indent > blockIndent {
+				continue
+			}
+			blockIndent = -1
+		}
+
+		end := len(line)
+		for i := 0; i < len(line); i++ {
+			c := line[i]
+			switch {
+			case quote == '"' && c == '\\':
+				i++
+			case quote == '"' && c == '"':
+				quote = 0
+			case quote == '\'' && c == '\'':
+				if i+1 < len(line) && line[i+1] == '\'' {
+					i++
+				} else {
+					quote = 0
+				}
+			case quote != 0:
+			case c == '#' && (i == 0 || line[i-1] == ' ' || line[i-1] == '\t'):
+				end = i
+				i = len(line)
+			case (c == '"' || c == '\'') && (i == 0 || strings.IndexByte(" \t:-[{,", line[i-1]) >= 0):
+				quote = c
+			}
+		}
+		if quote == 0 && blockScalarPattern.MatchString(line[:end]) {
+			blockIndent = indent
+		}
+	}
+	return markers
+}
+
+// mixedIndentation returns warnings about the lines of content whose
+// indentation mixes tabs and spaces, and, if others are indented with
+// spaces, about the lines indented with tabs, grouped by the included file
+// they're in as the START and END markers tell. Lines in block scalars,
+// whose content may start with tabs, aren't checked.
+func mixedIndentation(content string) []Warning {
+	var warnings []Warning
+	// tabbed maps the files to their lines indented with tabs, in order
+	// of the first such line.
+	tabbed := make(map[string][]string)
+	var files []string
+	spaced := false
+	open := []string{"the root template"}
+	blockIndent := -1
+	for i, line := range strings.Split(content, "\n") {
+		indentation := leadingWhitespace(line)
+		trimmedLine := strings.TrimSpace(line)
+		if blockIndent >= 0 {
+			if trimmedLine == "" || len(indentation) > blockIndent {
+				continue
+			}
+			blockIndent = -1
+		}
+		if name, ok := strings.CutPrefix(trimmedLine, "# START "); ok {
+			open = append(open, name)
+		} else if strings.HasPrefix(trimmedLine, "# END ") && len(open) > 1 {
+			open = open[:len(open)-1]
+		}
+		if blockScalarPattern.MatchString(line) {
+			blockIndent = len(indentation)
+		}
+		if trimmedLine == "" {
+			continue
+		}
+		file := open[len(open)-1]
+		switch hasTabs, hasSpaces := strings.Contains(indentation, "\t"), strings.Contains(indentation, " "); {
+		case hasTabs && hasSpaces:
+			warnings = append(warnings, Warning{Message: fmt.Sprintf("line %d of the output, from %s, mixes tabs and spaces in its indentation", i+1, file)})
+		case hasTabs:
+			if _, ok := tabbed[file]; !ok {
+				files = append(files, file)
+			}
+			tabbed[file] = append(tabbed[file], strconv.Itoa(i+1))
+		case hasSpaces:
+			spaced = true
+		}
+	}
+	if spaced {
+		for _, file := range files {
+			lines, are := "lines "+strings.Join(tabbed[file], ", "), "are"
+			if len(tabbed[file]) == 1 {
+				lines, are = "line "+tabbed[file][0], "is"
+			}
+			warnings = append(warnings, Warning{Message: fmt.Sprintf("%s of the output, from %s, %s indented with tabs while others are indented with spaces", lines, file, are)})
+		}
+	}
+	return warnings
+}
+
+// commandKeys are the top-level keys whose items --validate checks, as
+// cloud-init fails on commands that are null or empty.
+var commandKeys = map[string]bool{"bootcmd": true, "runcmd": true}
+
+// emptyCommands describes the items of the commandKeys block sequences of
+// content that are null, empty strings or empty lists, with their index
+// and line. Sequences in flow style (`[...]`) aren't checked.
+func emptyCommands(content string) []string {
+	lines := strings.Split(content, "\n")
+	var problems []string
+	// key is the command key whose items come next, itemIndent the
+	// indentation of its items once known.
+	key, itemIndent, index := "", -1, 0
+	for i, line := range lines {
+		trimmedLine := strings.TrimSpace(line)
+		if trimmedLine == "" || strings.HasPrefix(trimmedLine, "#") {
+			continue
+		}
+		if k, ok := topLevelKey(line); ok {
+			key, itemIndent, index = "", -1, 0
+			if _, value, _ := strings.Cut(line, ":"); commandKeys[k] && strings.TrimSpace(value) == "" {
+				key = k
+			}
+			continue
+		}
+		if key == "" || trimmedLine != "-" && !strings.HasPrefix(trimmedLine, "- ") {
+			continue
+		}
+		indent := len(leadingWhitespace(line))
+		if itemIndent < 0 {
+			itemIndent = indent
+		}
+		if indent != itemIndent {
+			continue
+		}
+		value := strings.TrimSpace(trimmedLine[1:])
+		if j := strings.Index(" "+value, " #"); j >= 0 {
+			value = strings.TrimSpace(value[:j])
+		}
+		var what string
+		switch value {
+		case "":
+			// The value may be on the following lines, e.g. a nested list.
+			if !indentedAfter(lines[i+1:], indent) {
+				what = "null"
+			}
+		case "null", "Null", "NULL", "~":
+			what = "null"
+		case `""`, "''":
+			what = "an empty string"
+		case "[]":
+			what = "an empty list"
+		}
+		if what != "" {
+			problems = append(problems, fmt.Sprintf("%s item %d on line %d is %s", key, index, i+1, what))
+		}
+		index++
+	}
+	return problems
+}
+
+// indentedAfter reports whether the first of lines that isn't blank or a
+// comment is indented more than indent.
+func indentedAfter(lines []string, indent int) bool {
+	for _, line := range lines {
+		if trimmedLine := strings.TrimSpace(line); trimmedLine != "" && !strings.HasPrefix(trimmedLine, "#") {
+			return len(leadingWhitespace(line)) > indent
+		}
+	}
+	return false
+}
+
+// YAMLSyntaxError is a problem checkYAMLSyntax found in a YAML document.
+type YAMLSyntaxError struct {
+	// Line and Column are where the problem is, starting at 1.
+	Line    int
+	Column  int
+	Message string
+}
+
+func (e *YAMLSyntaxError) Error() string {
+	return fmt.Sprintf("line %d, column %d: %s", e.Line, e.Column, e.Message)
+}
+
+// checkYAMLSyntax checks content for the YAML errors that can be told
+// without a full parser, tracking quotes and flow collections line by line
+// like quotedMarkers: tabs in indentation, unindented lines that are
+// neither a `key:` nor a `- item`, duplicate top-level keys, quoted
+// scalars that aren't closed, and flow collections (`[...]`, `{...}`) that
+// aren't balanced. Jinja templates (`## template: jinja`) aren't YAML yet,
+// and aren't checked.
+func checkYAMLSyntax(content string) error {
+	if strings.HasPrefix(content, "## template:") {
+		return nil
+	}
+	keys := make(map[string]int)
+	var quote byte
+	var quoteAt YAMLSyntaxError
+	// flow holds where the open flow collections start, innermost last,
+	// and opens their brackets.
+	var flow []YAMLSyntaxError
+	var opens []byte
+	blockIndent := -1
+	for i, line := range strings.Split(content, "\n") {
+		lineNo := i + 1
+		trimmedLine := strings.TrimSpace(line)
+		indent := len(line) - len(strings.TrimLeft(line, " \t"))
+		if quote == 0 && len(flow) == 0 {
+			if blockIndent >= 0 {
+				if trimmedLine == "" || indent > blockIndent {
+					continue
+				}
+				blockIndent = -1
+			}
+			if trimmedLine == "" || trimmedLine[0] == '#' {
+				continue
+			}
+			if tab := strings.IndexByte(leadingWhitespace(line), '\t'); tab >= 0 {
+				return &YAMLSyntaxError{Line: lineNo, Column: tab + 1, Message: "tab in indentation, YAML only allows spaces"}
+			}
+			if line == "---" || strings.HasPrefix(line, "--- ") || line == "..." {
+				keys = make(map[string]int)
+				continue
+			}
+			if indent == 0 && trimmedLine != "-" && !strings.HasPrefix(trimmedLine, "- ") && trimmedLine[0] != '[' && trimmedLine[0] != '{' {
+				key, ok := topLevelKey(line)
+				if !ok {
+					return &YAMLSyntaxError{Line: lineNo, Column: 1, Message: "expected `key:` or `- item`"}
+				}
+				if first, ok := keys[key]; ok {
+					return &YAMLSyntaxError{Line: lineNo, Column: 1, Message: fmt.Sprintf("duplicate top-level key %q, first on line %d", key, first)}
+				}
+				keys[key] = lineNo
+			}
+		}
+
+		end := len(line)
+		for j := 0; j < len(line); j++ {
+			c := line[j]
+			// Quotes and flow collections only start values.
+			before := strings.TrimRight(line[:j], " \t")
+			valueStart := before == "" || strings.IndexByte(":-[{,?", before[len(before)-1]) >= 0 && (j > len(before) || strings.IndexByte("[{,", before[len(before)-1]) >= 0)
+			switch {
+			case quote == '"' && c == '\\':
+				j++
+			case quote == '"' && c == '"':
+				quote = 0
+			case quote == '\'' && c == '\'':
+				if j+1 < len(line) && line[j+1] == '\'' {
+					j++
+				} else {
+					quote = 0
+				}
+			case quote != 0:
+			case c == '#' && (j == 0 || line[j-1] == ' ' || line[j-1] == '\t'):
+				end = j
+				j = len(line)
+			case (c == '"' || c == '\'') && valueStart:
+				quote = c
+				quoteAt = YAMLSyntaxError{Line: lineNo, Column: j + 1, Message: fmt.Sprintf("quoted scalar starting with %c isn't closed", c)}
+			case (c == '[' || c == '{') && (valueStart || len(flow) > 0):
+				flow = append(flow, YAMLSyntaxError{Line: lineNo, Column: j + 1, Message: fmt.Sprintf("%c isn't closed", c)})
+				opens = append(opens, c)
+			case (c == ']' || c == '}') && len(flow) > 0:
+				open, at := opens[len(opens)-1], flow[len(flow)-1]
+				if open == '[' && c != ']' || open == '{' && c != '}' {
+					return &YAMLSyntaxError{Line: lineNo, Column: j + 1, Message: fmt.Sprintf("%c doesn't match the %c on line %d, column %d", c, open, at.Line, at.Column)}
+				}
+				flow, opens = flow[:len(flow)-1], opens[:len(opens)-1]
+			}
+		}
+		if quote == 0 && len(flow) == 0 && blockScalarPattern.MatchString(line[:end]) {
+			blockIndent = indent
+		}
+	}
+	if quote != 0 {
+		return &quoteAt
+	}
+	if len(flow) > 0 {
+		return &flow[len(flow)-1]
+	}
+	return nil
+}
+
+// topLevelKey returns the key of line if it's an unindented `key: value`
+// line.
+func topLevelKey(line string) (string, bool) {
+	if line == "" || strings.ContainsRune(" \t#-.", rune(line[0])) {
+		return "", false
+	}
+	key, rest, ok := strings.Cut(line, ":")
+	if !ok || rest != "" && rest[0] != ' ' && rest[0] != '\t' {
+		return "", false
+	}
+	return unquote(strings.TrimSpace(key)), true
+}
+
+// missingKeys returns the keys in required that aren't top-level keys of
+// the YAML document content, in the order given. Only unindented
+// `key: value` lines count, so the document isn't fully parsed.
+func missingKeys(content string, required []string) []string {
+	present := make(map[string]bool)
+	for _, line := range strings.Split(content, "\n") {
+		if key, ok := topLevelKey(line); ok {
+			present[key] = true
+		}
+	}
+
+	var missing []string
+	for _, key := range required {
+		if !present[key] {
+			missing = append(missing, key)
+		}
+	}
+	return missing
+}
+
+// userDataTypes maps the first line prefixes cloud-init recognizes user
+// data by to its media types.
+var userDataTypes = []struct{ prefix, mediaType string }{
+	{"#cloud-config", "text/cloud-config"},
+	{"## template: jinja", "text/jinja2"},
+	{"#cloud-boothook", "text/cloud-boothook"},
+	{"#include", "text/x-include-url"},
+	{"#!", "text/x-shellscript"},
+}
+
+// dataURL returns content as a base64 data URL, of the media type its first
+// line stands for, or with encoding "gzip" gzip compressed.
+func dataURL(content string, encoding string) (string, error) {
+	switch encoding {
+	case "text":
+		mediaType := "text/plain"
+		for _, t := range userDataTypes {
+			if strings.HasPrefix(content, t.prefix) {
+				mediaType = t.mediaType
+				break
+			}
+		}
+		return fmt.Sprintf("data:%s;charset=utf-8;base64,%s\n", mediaType, base64.StdEncoding.EncodeToString([]byte(content))), nil
+	case "gzip":
+		// The header has no time or name, so the same content gives the
+		// same URL.
+		var b bytes.Buffer
+		w := gzip.NewWriter(&b)
+		if _, err := io.WriteString(w, content); err != nil {
+			return "", err
+		}
+		if err := w.Close(); err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("data:application/gzip;base64,%s\n", base64.StdEncoding.EncodeToString(b.Bytes())), nil
+	default:
+		return "", fmt.Errorf("unknown --data-url encoding '%s', expected text or gzip", encoding)
+	}
+}
+
+// shellQuote returns content quoted for a shell script in the given style:
+//   - heredoc wraps it in a `cat <<'EOF'` here-document, with a delimiter
+//     that isn't a line of content.
+//   - single wraps it in single quotes, quoting single quotes in it.
+//   - double wraps it in double quotes, escaping `$`, backticks, double
+//     quotes and backslashes.
+func shellQuote(content string, style string) (string, error) {
+	switch style {
+	case "heredoc":
+		lines := make(map[string]bool)
+		for _, line := range strings.Split(content, "\n") {
+			lines[line] = true
+		}
+		delimiter := "EOF"
+		for i := 1; lines[delimiter]; i++ {
+			delimiter = fmt.Sprintf("EOF_%d", i)
+		}
+		if content != "" && !strings.HasSuffix(content, "\n") {
+			content += "\n"
+		}
+		return fmt.Sprintf("cat <<'%s'\n%s%s\n", delimiter, content, delimiter), nil
+	case "single":
+		return "'" + strings.ReplaceAll(content, "'", `'\''`) + "'\n", nil
+	case "double":
+		var b strings.Builder
+		b.WriteByte('"')
+		for _, r := range content {
+			if strings.ContainsRune("$`\"\\", r) {
+				b.WriteByte('\\')
+			}
+			b.WriteRune(r)
+		}
+		b.WriteString("\"\n")
+		return b.String(), nil
+	default:
+		return "", fmt.Errorf("unknown --shell-quote style '%s', expected heredoc, single or double", style)
+	}
+}
+
+// loadSigningKey reads the ed25519 private key in the PEM encoded PKCS #8
+// file at keyPath, as written by `openssl genpkey -algorithm ed25519`.
+func loadSigningKey(keyPath string) (ed25519.PrivateKey, error) {
+	data, err := os.ReadFile(keyPath)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "PRIVATE KEY" {
+		return nil, fmt.Errorf("%s is not a PEM encoded PRIVATE KEY", keyPath)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", keyPath, err)
+	}
+	edKey, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%s holds a %T, expected an ed25519 key", keyPath, key)
+	}
+	return edKey, nil
+}
+
+// writeSignature writes the detached ed25519 signature of content, the
+// content of the file at outputPath, next to it with .sig appended to its
+// name. The signature is the raw 64 bytes.
+func writeSignature(key ed25519.PrivateKey, outputPath string, content string) error {
+	return os.WriteFile(outputPath+".sig", ed25519.Sign(key, []byte(content)), 0o644)
+}
+
+// version is the version of the tool shown by --provenance, set when
+// building releases with `-ldflags "-X main.version=v1.2.3"`.
+var version = "devel"
+
+// provenanceHeader returns the comment block --provenance adds, recording
+// the version, the time of generation unless it's the zero time, the root
+// template and a hash of the regular files among inputs, read from fsys.
+func provenanceHeader(fsys fs.FS, root string, inputs []string, generated time.Time) (string, error) {
+	h := sha256.New()
+	for _, input := range inputs {
+		info, err := fs.Stat(fsys, input)
+		if err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+		data, err := fs.ReadFile(fsys, input)
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(h, "%s\x00%x\x00", input, sha256.Sum256(data))
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "# Generated by cloud-init-builder %s\n", version)
+	if !generated.IsZero() {
+		fmt.Fprintf(&b, "# Generated at: %s\n", generated.UTC().Format(time.RFC3339))
+	}
+	fmt.Fprintf(&b, "# Root template: %s\n", root)
+	fmt.Fprintf(&b, "# Inputs sha256: %x\n", h.Sum(nil))
+	return b.String(), nil
+}
+
+// insertHeader returns f with the lines of header, as lines generated for
+// the root template root, inserted after the leading `## template:` and
+// `#cloud-config` lines cloud-init expects first.
+func (f fragment) insertHeader(header string, root string) fragment {
+	lines := strings.SplitAfter(f.content, "\n")
+	n := 0
+	for ; n < len(lines) && strings.HasSuffix(lines[n], "\n"); n++ {
+		if trimmed := strings.TrimSpace(lines[n]); !strings.HasPrefix(trimmed, "#cloud-config") && !strings.HasPrefix(trimmed, "## template:") {
+			break
+		}
+	}
+	var b fragmentBuilder
+	for i, line := range lines[:n] {
+		b.writeLine(strings.TrimSuffix(line, "\n"), f.origins[i])
+	}
+	for _, line := range strings.Split(strings.TrimSuffix(header, "\n"), "\n") {
+		b.writeLine(line, lineOrigin{file: root})
+	}
+	b.content.WriteString(strings.Join(lines[n:], ""))
+	b.origins = append(b.origins, f.origins[n:]...)
+	return b.fragment()
+}
+
+// Sentinels around the managed block replaceManagedBlock replaces.
+const (
+	beginGenerated = "# BEGIN GENERATED"
+	endGenerated   = "# END GENERATED"
+)
+
+// replaceManagedBlock returns target with the lines between its
+// beginGenerated and endGenerated lines replaced by content, indented like
+// the beginGenerated line. It's an error unless there's exactly one pair.
+func replaceManagedBlock(target string, content string) (string, error) {
+	lines := strings.SplitAfter(target, "\n")
+	begin, end := -1, -1
+	for i, line := range lines {
+		switch strings.TrimSpace(line) {
+		case beginGenerated:
+			if begin >= 0 {
+				return "", fmt.Errorf("line %d: second %q, the first is on line %d", i+1, beginGenerated, begin+1)
+			}
+			begin = i
+		case endGenerated:
+			if begin < 0 || end >= 0 {
+				return "", fmt.Errorf("line %d: %q without a %q before it", i+1, endGenerated, beginGenerated)
+			}
+			end = i
+		}
+	}
+	if begin < 0 {
+		return "", fmt.Errorf("no %q line", beginGenerated)
+	}
+	if end < 0 {
+		return "", fmt.Errorf("line %d: %q without a %q after it", begin+1, beginGenerated, endGenerated)
+	}
+
+	beginLine := lines[begin]
+	indentation := beginLine[:len(beginLine)-len(strings.TrimLeft(beginLine, " \t"))]
+	var b strings.Builder
+	for _, line := range lines[:begin+1] {
+		b.WriteString(line)
+	}
+	if content = strings.TrimSuffix(content, "\n"); content != "" {
+		for _, line := range strings.Split(content, "\n") {
+			if line != "" {
+				line = indentation + line
+			}
+			b.WriteString(line + "\n")
+		}
+	}
+	for _, line := range lines[end:] {
+		b.WriteString(line)
+	}
+	return b.String(), nil
+}
+
+// lineEnding returns the line ending named by value, the value of the
+// flag option, exiting if it's neither lf nor crlf.
+func lineEnding(option string, value string) string {
+	switch value {
+	case "lf":
+		return "\n"
+	case "crlf":
+		return "\r\n"
+	}
+	log.Fatalf("Error: Unknown --%s '%s', expected lf or crlf.", option, value)
+	return ""
+}
+
+// listFlag collects the values of a repeated flag.
+type listFlag []string
+
+func (l *listFlag) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *listFlag) Set(s string) error {
+	*l = append(*l, s)
+	return nil
+}
+
+// varsFlag collects repeated `--set NAME=VALUE` flags.
+type varsFlag map[string]string
+
+func (v varsFlag) String() string {
+	pairs := make([]string, 0, len(v))
+	for name, value := range v {
+		pairs = append(pairs, name+"="+value)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+func (v varsFlag) Set(s string) error {
+	name, value, ok := strings.Cut(s, "=")
+	if !ok || !varPattern.MatchString("${"+name+"}") {
+		return fmt.Errorf("expected NAME=VALUE, got %q", s)
+	}
+	v[name] = value
+	return nil
+}
+
+// parseEnvFile parses a dotenv file: `NAME=VALUE` lines, optionally
+// starting with `export `, with blank lines and `#` comments in between.
+// Unquoted values end at ` #`, and have their surrounding whitespace
+// trimmed. Single-quoted values are taken as they are. Double-quoted
+// values can span lines and have the escapes \n, \t, \", \\ and \$.
+// `${NAME}` in unquoted and double-quoted values is replaced by the value
+// of an earlier line, or else by lookup, or else nothing.
+func parseEnvFile(data string, lookup func(string) (string, bool)) (map[string]string, error) {
+	vars := make(map[string]string)
+	resolve := func(ref string) string {
+		name := ref[2 : len(ref)-1]
+		if value, ok := vars[name]; ok {
+			return value
+		}
+		value, _ := lookup(name)
+		return value
+	}
+
+	lines := strings.Split(strings.ReplaceAll(data, "\r\n", "\n"), "\n")
+	for i := 0; i < len(lines); i++ {
+		lineNo := i + 1
+		trimmedLine := strings.TrimSpace(lines[i])
+		if trimmedLine == "" || strings.HasPrefix(trimmedLine, "#") {
+			continue
+		}
+		trimmedLine = strings.TrimPrefix(trimmedLine, "export ")
+		name, value, ok := strings.Cut(trimmedLine, "=")
+		name = strings.TrimSpace(name)
+		if !ok || !varPattern.MatchString("${"+name+"}") {
+			return nil, fmt.Errorf("line %d: expected NAME=VALUE", lineNo)
+		}
+		value = strings.TrimSpace(value)
+
+		switch {
+		case strings.HasPrefix(value, "'"):
+			end := strings.Index(value[1:], "'")
+			if end < 0 {
+				return nil, fmt.Errorf("line %d: unterminated single-quoted value", lineNo)
+			}
+			vars[name] = value[1 : end+1]
+		case strings.HasPrefix(value, `"`):
+			var b strings.Builder
+			rest := value[1:]
+			for closed := false; !closed; {
+				for j := 0; j < len(rest) && !closed; j++ {
+					switch {
+					case rest[j] == '"':
+						closed = true
+					case rest[j] == '$':
+						if loc := varPattern.FindStringIndex(rest[j:]); loc != nil && loc[0] == 0 {
+							b.WriteString(resolve(rest[j : j+loc[1]]))
+							j += loc[1] - 1
+						} else {
+							b.WriteByte('$')
+						}
+					case rest[j] == '\\' && j+1 < len(rest):
+						j++
+						switch rest[j] {
+						case 'n':
+							b.WriteByte('\n')
+						case 't':
+							b.WriteByte('\t')
+						default:
+							b.WriteByte(rest[j])
+						}
+					default:
+						b.WriteByte(rest[j])
+					}
+				}
+				if closed {
+					break
+				}
+				if i+1 == len(lines) {
+					return nil, fmt.Errorf("line %d: unterminated double-quoted value", lineNo)
+				}
+				i++
+				b.WriteByte('\n')
+				rest = lines[i]
+			}
+			vars[name] = b.String()
+		default:
+			if comment := strings.Index(value, " #"); comment >= 0 {
+				value = strings.TrimSpace(value[:comment])
+			}
+			vars[name] = varPattern.ReplaceAllStringFunc(value, resolve)
+		}
+	}
+	return vars, nil
+}
+
+// sortListsFlag collects repeated `--sort-list key=field` flags.
+type sortListsFlag map[string]string
+
+func (l sortListsFlag) String() string {
+	pairs := make([]string, 0, len(l))
+	for key, field := range l {
+		pairs = append(pairs, key+"="+field)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+func (l sortListsFlag) Set(s string) error {
+	key, field, ok := strings.Cut(s, "=")
+	if !ok || key == "" || field == "" {
+		return fmt.Errorf("expected key=field, got %q", s)
+	}
+	l[key] = field
+	return nil
+}
+
+// expandRequest is the JSON body accepted by `POST /expand`.
+type expandRequest struct {
+	Template string            `json:"template"`
+	Vars     map[string]string `json:"vars"`
+	// Files, if given, are what includes are resolved in instead of the
+	// served directory.
+	Files map[string]string `json:"files"`
+}
+
+// newServeHandler returns the HTTP handler of the `serve` subcommand.
+// Templates posted to it resolve their includes inside fsys, and request
+// bodies larger than maxBody bytes are rejected.
+func newServeHandler(fsys fs.FS, maxBody int64) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/expand", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var req expandRequest
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBody)).Decode(&req); err != nil {
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				http.Error(w, fmt.Sprintf("request body exceeds %d bytes", maxBody), http.StatusRequestEntityTooLarge)
+				return
+			}
+			http.Error(w, fmt.Sprintf("invalid request body: %v", err), http.StatusBadRequest)
+			return
+		}
+
+		expander := &Expander{FS: fsys, Vars: req.Vars}
+		if req.Files != nil {
+			files, err := MapFS(req.Files)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("invalid files: %v", err), http.StatusBadRequest)
+				return
+			}
+			expander.FS = files
+		}
+		finalContent, err := expander.Expand(rootTemplateName, strings.NewReader(req.Template))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		io.WriteString(w, finalContent)
+	})
+	return mux
+}
+
+// runServe implements the `serve` subcommand, which exposes the expander
+// over HTTP with includes resolved inside a single directory.
+func runServe(args []string) {
+	flags := flag.NewFlagSet("serve", flag.ExitOnError)
+	addr := flags.String("addr", ":8080", "address to listen on")
+	maxBody := flags.Int64("max-body", 1<<20, "maximum size of a request body in bytes")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: expander.exe serve [flags] <directory>")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(1)
+	}
+	rootDir := flags.Arg(0)
+	info, err := os.Stat(rootDir)
+	if err != nil {
+		log.Fatalf("Error: Cannot access directory '%s': %v", rootDir, err)
+	}
+	if !info.IsDir() {
+		log.Fatalf("Error: The provided path '%s' is not a directory.", rootDir)
+	}
+
+	// os.DirFS refuses paths leading outside rootDir, so requests can't
+	// include arbitrary files from the host.
+	server := &http.Server{
+		Addr:              *addr,
+		Handler:           newServeHandler(os.DirFS(rootDir), *maxBody),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	log.Printf("Serving templates from '%s' on %s", rootDir, *addr)
+	log.Fatal(server.ListenAndServe())
+}
+
+// RunGolden expands the root template of the fixture directory dir and
+// compares the result with its golden file. If update is set, or the
+// UPDATE_GOLDEN environment variable is 1, the golden file is rewritten
+// instead, for when the output changes on purpose. Fixtures with an
+// expectedErrorName file instead must fail with an error containing it.
+// Options are read from its optionsName file, if it has one.
+func RunGolden(dir string, update bool) error {
+	expander := &Expander{}
+	if data, err := os.ReadFile(filepath.Join(dir, optionsName)); err == nil {
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(expander); err != nil {
+			return fmt.Errorf("invalid %s: %w", optionsName, err)
+		}
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	expander.FS = dirFS(dir)
+	expander.Skip = append(expander.Skip, goldenName, expectedErrorName, optionsName)
+	got, err := expander.ExpandFile(rootTemplateName)
+
+	errorPath := filepath.Join(dir, expectedErrorName)
+	if wantErr, readErr := os.ReadFile(errorPath); readErr == nil {
+		want := strings.TrimSpace(string(wantErr))
+		switch {
+		case err == nil:
+			return fmt.Errorf("expansion succeeded, %s expects it to fail", expectedErrorName)
+		case strings.Contains(err.Error(), want):
+			// Updating leaves a matching file alone, as it's often only the
+			// part of the error that matters.
+			return nil
+		case update || os.Getenv("UPDATE_GOLDEN") == "1":
+			return os.WriteFile(errorPath, []byte(err.Error()+"\n"), 0o644)
+		}
+		return fmt.Errorf("error differs from %s:\n  got:  %q\n  want: %q", expectedErrorName, err.Error(), want)
+	}
 	if err != nil {
-		return "", fmt.Errorf("could not get absolute path for %s: %w", filePath, err)
+		return err
 	}
 
-	file, err := os.Open(absPath)
+	goldenPath := filepath.Join(dir, goldenName)
+	if update || os.Getenv("UPDATE_GOLDEN") == "1" {
+		return os.WriteFile(goldenPath, []byte(got), 0o644)
+	}
+	want, err := os.ReadFile(goldenPath)
 	if err != nil {
-		return "", fmt.Errorf("failed to open file %s: %w", filePath, err)
+		return err
 	}
-	defer file.Close()
+	if got == string(want) {
+		return nil
+	}
+
+	gotLines, wantLines := strings.Split(got, "\n"), strings.Split(string(want), "\n")
+	for i := 0; ; i++ {
+		var gotLine, wantLine string
+		if i < len(gotLines) {
+			gotLine = gotLines[i]
+		}
+		if i < len(wantLines) {
+			wantLine = wantLines[i]
+		}
+		if gotLine != wantLine || i >= len(gotLines) || i >= len(wantLines) {
+			return fmt.Errorf("output differs from %s at line %d:\n  got:  %q\n  want: %q", goldenName, i+1, gotLine, wantLine)
+		}
+	}
+}
+
+// runSelftest checks the expansion of every fixture directory below the
+// given directory against its golden file.
+func runSelftest(args []string) {
+	flags := flag.NewFlagSet("selftest", flag.ExitOnError)
+	update := flags.Bool("update", false, "rewrite the golden files with the current output instead of comparing")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: expander.exe selftest [flags] <fixtures directory>")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
 
-	// Get the relative path for the comments
-	relativePath, err := filepath.Rel(rootDir, absPath)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(1)
+	}
+	entries, err := os.ReadDir(flags.Arg(0))
 	if err != nil {
-		// If Rel fails (e.g., different drive on Windows), fallback to the original path.
-		relativePath = filePath
+		log.Fatalf("Error: Cannot read fixtures directory '%s': %v", flags.Arg(0), err)
 	}
 
-	var output strings.Builder
-	// Add a START comment with the relative path if this is an included file.
-	if !isRoot {
-		output.WriteString(fmt.Sprintf("# START %s\n", filepath.ToSlash(relativePath)))
+	failed := 0
+	for _, entry := range entries {
+		dir := filepath.Join(flags.Arg(0), entry.Name())
+		if !entry.IsDir() {
+			continue
+		}
+		if _, err := os.Stat(filepath.Join(dir, rootTemplateName)); err != nil {
+			continue
+		}
+		if err := RunGolden(dir, *update); err != nil {
+			log.Printf("FAIL %s: %v", entry.Name(), err)
+			failed++
+			continue
+		}
+		fmt.Printf("ok   %s\n", entry.Name())
 	}
+	if failed > 0 {
+		log.Fatalf("%d fixture(s) failed", failed)
+	}
+}
 
-	scanner := bufio.NewScanner(file)
+// looseDirectivePattern matches directives written with extra or missing
+// whitespace around the colon, such as `#include :x`, capturing the
+// indentation, the directive and its arguments. Lines with whitespace
+// after the `#`, such as `# include: x`, are comments.
+var looseDirectivePattern = regexp.MustCompile(`^(\s*)(#include(?:-env|-unless-key|-file|-filter|-diff|-disabled)?|##include|#repeat)[ \t]*:\s*(.*?)\s*$`)
 
-	for scanner.Scan() {
-		line := scanner.Text()
-		trimmedLine := strings.TrimSpace(line)
+// looseLiteralPattern is includeLiteralPattern with extra or missing
+// whitespace around the colon, capturing the text before the directive,
+// the path and the chomping indicator.
+var looseLiteralPattern = regexp.MustCompile(`^(\s*(?:- +)?(?:[^\s#{\[-][^#]*?: +)?)#include-literal[ \t]*:\s*(\S+)(?:\s+(strip|clip|keep))?\s*$`)
 
-		if strings.HasPrefix(trimmedLine, "#include:") {
-			// Capture the indentation from the original line.
-			// This is everything before the '#' character.
-			indentation := line[:strings.Index(line, "#")]
+// looseConditionPattern matches `#if`, `#else` and `#endif` lines written
+// with extra whitespace.
+var looseConditionPattern = regexp.MustCompile(`^(\s*)#(if|else|endif)\b\s*(.*?)\s*$`)
 
-			// Extract the relative path from the include directive.
-			includePathStr := strings.TrimSpace(strings.TrimPrefix(trimmedLine, "#include:"))
-			if includePathStr == "" {
-				log.Printf("Warning: Found empty #include directive in %s. Skipping.", filePath)
-				continue
-			}
+// formatTemplate rewrites the directives in content to their canonical
+// form, e.g. `#include :  a.yaml,b.yaml` to `#include: a.yaml, b.yaml`.
+// Other lines, and the line endings, are left as they are.
+func formatTemplate(content string) string {
+	lines := strings.Split(content, "\n")
+	continued := false
+	for i, line := range lines {
+		// Continuation lines of include lists are left alone.
+		if continued {
+			continued = strings.HasSuffix(strings.TrimRight(line, " \t\r"), `\`)
+			continue
+		}
+		body := strings.TrimSuffix(line, "\r")
+		cr := line[len(body):]
 
-			// The include path is relative to the file it's in.
-			// Get the directory of the current file.
-			baseDir := filepath.Dir(filePath)
-			// Join it with the relative path from the directive.
-			fullIncludePath := filepath.Join(baseDir, includePathStr)
+		if m := looseConditionPattern.FindStringSubmatch(body); m != nil && (m[2] == "if") == (m[3] != "") {
+			lines[i] = strings.TrimRight(m[1]+"#"+m[2]+" "+strings.Join(strings.Fields(m[3]), " "), " ") + cr
+			continue
+		}
+		if m := looseLiteralPattern.FindStringSubmatch(body); m != nil {
+			lines[i] = strings.TrimRight(m[1]+"#include-literal: "+m[2]+" "+m[3], " ") + cr
+			continue
+		}
+		m := looseDirectivePattern.FindStringSubmatch(body)
+		if m == nil {
+			continue
+		}
+		indentation, directive, args := m[1], m[2], m[3]
 
-			// Process the included path (which could be a file or directory).
-			includedContent, err := processIncludePath(fullIncludePath, rootDir)
-			if err != nil {
-				return "", fmt.Errorf("error processing include '%s' in file %s: %w", includePathStr, filePath, err)
+		var formatted string
+		switch directive {
+		case "#include-file", "#include-filter", "#include-diff":
+			formatted = strings.Join(strings.Fields(args), " ")
+		case "##include", "#include-disabled":
+			formatted = args
+		default:
+			// Canonical include lists have one space after each comma.
+			continued = strings.HasSuffix(args, `\`)
+			args = strings.TrimSuffix(args, `\`)
+			var key string
+			if directive == "#include-unless-key" || directive == "#repeat" {
+				key, args, _ = strings.Cut(args, " ")
 			}
-
-			// Apply the captured indentation to each line of the included content.
-			// We trim a single trailing newline to avoid creating an extra empty indented line.
-			contentToIndent := strings.TrimSuffix(includedContent, "\n")
-			if contentToIndent != "" {
-				contentScanner := bufio.NewScanner(strings.NewReader(contentToIndent))
-				for contentScanner.Scan() {
-					output.WriteString(indentation)
-					output.WriteString(contentScanner.Text())
-					output.WriteString("\n") // CORRECTED: This should only be one newline.
-				}
+			var entries []string
+			for _, entry := range splitIncludeList(args) {
+				entries = append(entries, strings.Join(strings.Fields(entry), " "))
+			}
+			formatted = strings.TrimSpace(key + " " + strings.Join(entries, ", "))
+			if continued {
+				formatted += `, \`
 			}
-			// Your line now works as intended, adding a single empty line after the content.
-			output.WriteString("\n")
-		} else {
-			// If it's not an include directive, just add the line to the output.
-			output.WriteString(line + "\n")
 		}
+		lines[i] = strings.TrimRight(indentation+directive+": "+formatted, " ") + cr
 	}
+	return strings.Join(lines, "\n")
+}
 
-	if err := scanner.Err(); err != nil {
-		return "", fmt.Errorf("error reading file %s: %w", filePath, err)
-	}
-
-	finalResult := output.String()
+// diffContext is the number of unchanged lines lineDiff shows around
+// changed ones.
+const diffContext = 3
 
-	// Add an END comment if this is an included file.
-	if !isRoot {
-		// Tidy up trailing newlines before adding the final comment.
-		finalResult = strings.TrimRight(finalResult, "\n")
-		finalResult += fmt.Sprintf("\n# END %s\n", filepath.ToSlash(relativePath))
+// lineDiff returns a unified diff from old to new, the content of file
+// before and after changing lines in place, as formatTemplate does, so
+// both have the same number of lines.
+func lineDiff(file string, old string, new string) string {
+	oldLines, newLines := strings.Split(strings.TrimSuffix(old, "\n"), "\n"), strings.Split(strings.TrimSuffix(new, "\n"), "\n")
+	var changed []int
+	for i := range oldLines {
+		if oldLines[i] != newLines[i] {
+			changed = append(changed, i)
+		}
 	}
-
-	return finalResult, nil
+	if len(changed) == 0 {
+		return ""
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "--- %s\n+++ %s\n", file, file)
+	for len(changed) > 0 {
+		// A hunk runs until the next changed line is too far away to
+		// share context with it.
+		last := 0
+		for last+1 < len(changed) && changed[last+1]-changed[last] <= 2*diffContext {
+			last++
+		}
+		start, end := changed[0]-diffContext, changed[last]+diffContext+1
+		if start < 0 {
+			start = 0
+		}
+		if end > len(oldLines) {
+			end = len(oldLines)
+		}
+		fmt.Fprintf(&b, "@@ -%d,%d +%d,%d @@\n", start+1, end-start, start+1, end-start)
+		for i := start; i < end; {
+			if oldLines[i] == newLines[i] {
+				fmt.Fprintf(&b, " %s\n", strings.TrimSuffix(oldLines[i], "\r"))
+				i++
+				continue
+			}
+			j := i
+			for j < end && oldLines[j] != newLines[j] {
+				j++
+			}
+			for _, line := range oldLines[i:j] {
+				fmt.Fprintf(&b, "-%s\n", strings.TrimSuffix(line, "\r"))
+			}
+			for _, line := range newLines[i:j] {
+				fmt.Fprintf(&b, "+%s\n", strings.TrimSuffix(line, "\r"))
+			}
+			i = j
+		}
+		changed = changed[last+1:]
+	}
+	return b.String()
 }
 
-// processIncludePath determines if a path is a file or a directory and
-// processes it accordingly.
-func processIncludePath(path string, rootDir string) (string, error) {
-	info, err := os.Stat(path)
-	if err != nil {
-		return "", fmt.Errorf("include path not found %s: %w", path, err)
+// runFmt rewrites the directives in the given template files, or the
+// .yaml and .yml files below the given directories, to their canonical
+// form.
+func runFmt(args []string) {
+	flags := flag.NewFlagSet("fmt", flag.ExitOnError)
+	diff := flags.Bool("d", false, "print a unified diff of the changes instead of the formatted files")
+	write := flags.Bool("w", false, "write the formatted files back instead of printing them")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: expander.exe fmt [flags] <file or directory>...")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() == 0 {
+		flags.Usage()
+		os.Exit(1)
 	}
 
-	if info.IsDir() {
-		// If it's a directory, walk through it and process all files.
-		var dirContent strings.Builder
-		// filepath.Walk is automatically recursive.
-		walkErr := filepath.Walk(path, func(p string, f os.FileInfo, err error) error {
+	var files []string
+	for _, arg := range flags.Args() {
+		err := filepath.WalkDir(arg, func(p string, d fs.DirEntry, err error) error {
 			if err != nil {
-				return err // Propagate errors from walking.
+				return err
 			}
-			// We only want to include the content of files, not directories.
-			if !f.IsDir() {
-				// Recursively process the file to handle nested includes.
-				fileContent, err := processFile(p, rootDir, false)
-				if err != nil {
-					return fmt.Errorf("failed to process file in directory %s: %w", p, err)
-				}
-				dirContent.WriteString(fileContent)
+			if p == arg && !d.IsDir() || !d.IsDir() && (strings.HasSuffix(p, ".yaml") || strings.HasSuffix(p, ".yml")) {
+				files = append(files, p)
 			}
 			return nil
 		})
-		if walkErr != nil {
-			return "", walkErr
+		if err != nil {
+			log.Fatalf("Error: %v", err)
 		}
-		return dirContent.String(), nil
 	}
 
-	// If it's a single file, just process that file.
-	return processFile(path, rootDir, false)
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			log.Fatalf("Error: %v", err)
+		}
+		formatted := formatTemplate(string(data))
+		switch {
+		case *diff:
+			if formatted == string(data) {
+				continue
+			}
+			fmt.Print(lineDiff(file, string(data), formatted))
+		case *write:
+			if formatted == string(data) {
+				continue
+			}
+			if err := os.WriteFile(file, []byte(formatted), 0o644); err != nil {
+				log.Fatalf("Error: %v", err)
+			}
+		default:
+			fmt.Print(formatted)
+		}
+	}
+}
+
+// batchOutputs returns the paths the templates roots, names in the
+// directory rootDir, are written to in outputDir by --input-glob: their
+// path within rootDir without `.tmpl`. Two templates written to the same
+// path, or a template written over one of them, are an error.
+func batchOutputs(rootDir string, outputDir string, roots []string) ([]string, error) {
+	templates := make(map[string]string, len(roots))
+	for _, root := range roots {
+		templates[filepath.Join(rootDir, filepath.FromSlash(root))] = root
+	}
+	outputs := make([]string, len(roots))
+	writtenBy := make(map[string]string, len(roots))
+	for i, root := range roots {
+		dir, base := path.Split(root)
+		output := filepath.Join(outputDir, filepath.FromSlash(dir), strings.Replace(base, ".tmpl", "", 1))
+		if other, ok := writtenBy[output]; ok {
+			return nil, fmt.Errorf("%s and %s would both be written to '%s'", other, root, output)
+		}
+		if template, ok := templates[output]; ok {
+			return nil, fmt.Errorf("%s would be written over the template %s", root, template)
+		}
+		writtenBy[output] = root
+		outputs[i] = output
+	}
+	return outputs, nil
+}
+
+// expandBatch runs expand for each of roots and the output at the same
+// index, writing an `ok` or `FAIL` line for each to w. It stops at the
+// first failure unless keepGoing is set, like `make -k`, in which case the
+// failures are repeated at the end, as they're easy to miss among many ok
+// lines. It returns the failed roots.
+func expandBatch(w io.Writer, roots []string, outputs []string, keepGoing bool, expand func(root string, output string) error) []string {
+	var failed, failures []string
+	for i, root := range roots {
+		if err := expand(root, outputs[i]); err != nil {
+			fmt.Fprintf(w, "FAIL %s: %v\n", root, err)
+			if !keepGoing {
+				return []string{root}
+			}
+			failed = append(failed, root)
+			failures = append(failures, fmt.Sprintf("%s: %v", root, err))
+			continue
+		}
+		fmt.Fprintf(w, "ok   %s -> %s\n", root, outputs[i])
+	}
+	if len(failures) > 0 {
+		fmt.Fprintf(w, "\nFailed:\n")
+		for _, failure := range failures {
+			fmt.Fprintf(w, "  %s\n", failure)
+		}
+	}
+	return failed
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "serve" {
+		runServe(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "fmt" {
+		runFmt(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "selftest" {
+		runSelftest(os.Args[2:])
+		return
+	}
+
+	vars := make(varsFlag)
+	flag.Var(vars, "set", "substitute VALUE for ${NAME} references, given as `NAME=VALUE` (repeatable)")
+	outputPath := flag.String("o", "", "write the expanded template to `file` instead of standard output")
+	relativizeErrors := flag.Bool("relativize-errors", true, "show paths in errors and warnings relative to the directory, use =false for absolute paths")
+	streamTimeout := flag.Duration("stream-timeout", 0, "read included named pipes, waiting at most `duration` for each, instead of failing")
+	finalNewline := flag.Bool("final-newline", true, "end the output with exactly one newline")
+	noFinalNewline := flag.Bool("no-final-newline", false, "end the output without a newline, same as --final-newline=false")
+	markDisabled := flag.Bool("mark-disabled", false, "leave a `# (disabled) <path>` comment where a disabled include was")
+	maxOutputLines := flag.Int("max-output-lines", 0, "fail if the output exceeds `n` lines (0 means unlimited)")
+	warnDuplicateIncludes := flag.Bool("warn-duplicate-includes", false, "warn about files included more than once")
+	markerPathStyle := flag.String("marker-path-style", MarkerPathRoot, "how START/END markers show paths: `root`, abs or relative-to-parent")
+	postHook := flag.String("post-hook", "", "run `command` through the shell with the expanded template on its standard input, failing if it fails")
+	postHookReplace := flag.Bool("post-hook-replace", false, "replace the expanded template with what the post hook prints")
+	validate := flag.Bool("validate", false, "fail if START/END markers end up inside quoted strings, or runcmd or bootcmd have null or empty items, and warn about indentation mixing tabs and spaces")
+	schemaValidate := flag.Bool("schema-validate", false, "validate the expanded template with `cloud-init schema` if it's installed")
+	colorMode := flag.String("color", "auto", "color warnings and errors: `auto`, always or never")
+	dedupContent := flag.Bool("dedup-content", false, "include files with identical content only once per directory include")
+	includeTags := flag.Bool("include-tags", false, "replace `key: !include <path>` YAML tags by the file's content as a literal block scalar. Only block style is supported, tags inside flow collections ({...}, [...]) are an error")
+	showStats := flag.Bool("stats", false, "print the number of files read, their size, the deepest include nesting and the time taken to standard error")
+	maxDirDepth := flag.Int("max-dir-depth", defaultMaxDirDepth, "fail if directory includes find directories nested more than `n` levels deep")
+	sourceMapPath := flag.String("sourcemap", "", "write a JSON map from output lines to the source lines they came from to `file`")
+	var requiredKeys listFlag
+	flag.Var(&requiredKeys, "require-key", "fail if the expanded template has no top-level `key` (repeatable)")
+	preserveDirectives := flag.Bool("preserve-directives", false, "keep include directive lines in the output above the content they include")
+	warnIncludeBytes := flag.Int("warn-include-bytes", 0, "warn about includes adding more than `n` bytes to the output (0 means never)")
+	caseInsensitiveIncludes := flag.Bool("case-insensitive-includes", false, "fall back to paths differing only in case for includes that don't exist, with a warning")
+	dirWrap := flag.Bool("dir-wrap", false, "wrap directory includes in START/END markers of their own, with the markers of their files indented")
+	gitRef := flag.String("git-ref", "", "read the templates from the git commit, tag or branch `ref` instead of the working tree")
+	cacheDir := flag.String("cache-dir", "", "keep processed includes in `directory` across runs, reusing them while their files are unchanged")
+	base64Width := flag.Int("base64-width", 0, "wrap base64 encoded #include-file content at `n` characters per line (0 means no wrapping)")
+	skipEmptyIncludes := flag.Bool("skip-empty-includes", false, "leave out includes with nothing but whitespace and comments, markers included")
+	var libDirs listFlag
+	flag.Var(&libDirs, "lib-dir", "look for includes not found relative to the including file in `directory` (repeatable, searched in order)")
+	expandTabs := flag.Int("expand-tabs", 0, "replace tabs in indentation by spaces, with tab stops every `n` columns (0 means keep tabs)")
+	var defines listFlag
+	flag.Var(&defines, "define", "switch on `#if FLAG` blocks for FLAG (repeatable)")
+	lineEndings := flag.String("line-endings", "lf", "end the lines of the output with `lf` or crlf")
+	includeLineEndings := flag.String("include-line-endings", "", "end the lines that come from included files with `lf` or crlf, instead of --line-endings")
+	annotations := flag.String("annotations", "", "report warnings and errors as `github` Actions annotations on standard error")
+	errorOnEmptyDir := flag.Bool("error-on-empty-dir", false, "fail if a directory include finds no files to include")
+	sortLists := make(sortListsFlag)
+	flag.Var(sortLists, "sort-list", "sort the entries of the top-level list `key=field` by the value of their field (repeatable)")
+	inputGlob := flag.String("input-glob", "", "expand every template in the directory matching `pattern` into --output-dir, instead of the root template")
+	outputDir := flag.String("output-dir", "", "write the templates expanded for --input-glob to `directory`, at their path without .tmpl")
+	keepGoing := flag.Bool("keep-going", false, "with --input-glob, expand the remaining templates after one fails, instead of stopping")
+	trimTrailingWhitespace := flag.Bool("trim-trailing-whitespace", false, "strip spaces and tabs at the end of lines, except inside block scalars")
+	noSeparator := flag.Bool("no-separator", false, "don't follow the content of includes with an empty line")
+	searchPath := flag.String("search-path", os.Getenv("CLOUD_INIT_BUILDER_PATH"), "look up include paths without a slash in the `directories` of this list first, separated like PATH (default $CLOUD_INIT_BUILDER_PATH)")
+	verbose := flag.Bool("verbose", false, "log which --search-path directory each include was found in")
+	shellQuoteStyle := flag.String("shell-quote", "", "print the expanded template quoted for a shell script, as a `heredoc`, single or double quoted string")
+	preprocessOnly := flag.Bool("preprocess-only", false, "substitute variables and resolve #if blocks, but leave include directives as they are")
+	signKeyPath := flag.String("sign-key", "", "write a detached ed25519 signature of the output file next to it as <output>.sig, signed with the PEM private key in `file`")
+	dirRecursion := flag.String("dir-recursion", DirRecursionDeep, "whether directory includes descend into subdirectories: `deep`, shallow or none (the same as shallow)")
+	provenance := flag.Bool("provenance", false, "add a comment recording the version, time, root template and a hash of the input files after the #cloud-config line")
+	noTimestamp := flag.Bool("no-timestamp", false, "leave the time out of the --provenance comment, for reproducible output")
+	lintDuplicates := flag.Bool("lint-duplicates", false, "warn about distinct included files with identical content")
+	parseOnly := flag.Bool("parse-only", false, "report malformed directives in all templates of the directory instead of expanding, without resolving includes")
+	printFiles0 := flag.Bool("print-files0", false, "print the paths of the root template and the files it includes, each followed by a NUL byte for xargs -0, instead of expanding")
+	strict := flag.Bool("strict", false, "fail instead of warning when an included file's content ends up empty after substituting variables and resolving #if blocks")
+	maxFileSize := flag.Int64("max-file-size", 0, "fail if the template or a file it includes is larger than `n` bytes, before reading it (0 means unlimited)")
+	canonicalOrder := flag.Bool("canonical-order", false, "reorder the top-level keys of the output into cloud-init's conventional order, unknown keys last")
+	warningsInOutput := flag.Bool("warnings-in-output", false, "list the warnings in a comment at the end of the expanded template, as well as reporting them")
+	includeOnceGlobal := flag.Bool("include-once-global", false, "include every file at most once, skipping later includes of it, instead of only refusing cycles")
+	includeBase := flag.String("include-base", IncludeBaseFile, "resolve include paths relative to the including `file`, the root directory or the cwd")
+	dumpAST := flag.String("dump-ast", "", "print the nodes the root template is parsed into as `text` or json instead of expanding, to debug directives that aren't recognized")
+	envFile := flag.String("env-file", "", "read variables from the dotenv `file`, NAME=VALUE lines, for ${NAME} references not given with --set")
+	requireYAML := flag.Bool("require-final-yaml-parse", false, "fail without writing anything if the expanded template has YAML syntax errors, e.g. tabs in indentation, unclosed quotes or duplicate top-level keys")
+	requireUTF8 := flag.Bool("require-utf8", false, "fail on invalid UTF-8 in templates, naming the file and byte offset, instead of warning and copying it as is")
+	dataURLEncoding := flag.String("data-url", "", "print the expanded template as a base64 data URL, as `text` of the media type its first line stands for or gzip compressed")
+	singleDocument := flag.Bool("single-document", false, "remove the YAML document markers (--- and ... lines) fragments bring along, with a warning, keeping a leading ---")
+	tempDir := flag.String("temp-dir", "", "create temporary files, like the one --schema-validate passes to cloud-init, in `directory` instead of $TMPDIR")
+	explain := flag.Bool("explain", false, "print which lines of the output came from which file, and the include directive that brought it in, to standard error")
+	noRootDirectives := flag.Bool("no-root-directives", false, "copy the lines of the root template as they are, after substituting variables, treating #include: and other directives in it as comments")
+	tee := flag.Bool("tee", false, "print the expanded template to standard output as well as writing it to the -o file")
+	intoPath := flag.String("into", "", "replace the lines between # BEGIN GENERATED and # END GENERATED in `file` with the expanded template")
+	profile := flag.String("profile", "", "include the `name` subdirectory of #include-env directories, falling back to default")
+	checkIncludes := flag.Bool("check-includes", false, "check that the paths of all includes exist, listing those that don't, instead of expanding the template")
+	listVars := flag.Bool("list-vars", false, "list the variables referenced by the template instead of expanding it")
+	flag.Usage = func() {
+		fmt.Fprintln(flag.CommandLine.Output(), "Usage: expander.exe [flags] <directory>")
+		fmt.Fprintln(flag.CommandLine.Output(), "       expander.exe serve [flags] <directory>")
+		fmt.Fprintln(flag.CommandLine.Output(), "       expander.exe selftest [flags] <fixtures directory>")
+		fmt.Fprintln(flag.CommandLine.Output(), "       expander.exe fmt [flags] <file or directory>...")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	// Options the command line leaves out default to the project config.
+	var projectConfig string
+	if flag.NArg() == 1 {
+		dir, err := filepath.Abs(flag.Arg(0))
+		if err != nil {
+			log.Fatalf("Error: Cannot resolve directory '%s': %v", flag.Arg(0), err)
+		}
+		if projectConfig = findProjectConfig(dir); projectConfig != "" {
+			if err := applyProjectConfig(flag.CommandLine, projectConfig); err != nil {
+				log.Fatalf("Error: Invalid %s: %v", projectConfig, err)
+			}
+		}
+	}
+
+	if *annotations != "" && *annotations != "github" {
+		log.Fatalf("Error: Unknown annotations format '%s', expected github.", *annotations)
+	}
+	color, err := useColor(*colorMode)
+	if err != nil {
+		log.Fatalf("Error: %v", err)
+	}
+	if color {
+		log.SetOutput(colorWriter{w: os.Stderr})
+	}
+
+	if *outputPath != "" && *intoPath != "" {
+		log.Fatalf("Error: -o and --into can't be used together.")
+	}
+	if *tee && *outputPath == "" {
+		log.Fatalf("Error: --tee needs -o, it prints the output file's content as well.")
+	}
+	if *shellQuoteStyle != "" {
+		if _, err := shellQuote("", *shellQuoteStyle); err != nil {
+			log.Fatalf("Error: %v", err)
+		}
+	}
+	if *dataURLEncoding != "" {
+		if _, err := dataURL("", *dataURLEncoding); err != nil {
+			log.Fatalf("Error: %v", err)
+		}
+	}
+	var signKey ed25519.PrivateKey
+	if *signKeyPath != "" {
+		if *outputPath == "" && *outputDir == "" {
+			log.Fatalf("Error: --sign-key needs -o or --output-dir, the signature is written next to the output file.")
+		}
+		var err error
+		if signKey, err = loadSigningKey(*signKeyPath); err != nil {
+			log.Fatalf("Error: Cannot load signing key: %v", err)
+		}
+	}
+	if *envFile != "" {
+		data, err := os.ReadFile(*envFile)
+		if err != nil {
+			log.Fatalf("Error: Cannot read env file: %v", err)
+		}
+		envVars, err := parseEnvFile(string(data), os.LookupEnv)
+		if err != nil {
+			log.Fatalf("Error: Invalid env file '%s': %v", *envFile, err)
+		}
+		// --set takes precedence.
+		for name, value := range envVars {
+			if _, ok := vars[name]; !ok {
+				vars[name] = value
+			}
+		}
+	}
+	if (*inputGlob == "") != (*outputDir == "") {
+		log.Fatalf("Error: --input-glob and --output-dir must be used together.")
+	}
+	if *keepGoing && *inputGlob == "" {
+		log.Fatalf("Error: --keep-going only applies to --input-glob.")
+	}
+	if *inputGlob != "" && (*outputPath != "" || *intoPath != "" || *sourceMapPath != "" || *explain || *showStats || *listVars || *checkIncludes || *printFiles0) {
+		log.Fatalf("Error: -o, --into, --sourcemap, --explain, --stats, --list-vars, --check-includes and --print-files0 can't be used with --input-glob.")
+	}
+
 	// --- 1. Argument Validation ---
-	if len(os.Args) != 2 {
-		fmt.Println("Usage: expander.exe <directory>")
+	if flag.NArg() != 1 {
+		flag.Usage()
 		// Print error to stderr, which is standard for errors.
 		fmt.Fprintln(os.Stderr, "Error: A single directory path must be provided as an argument.")
 
@@ -153,7 +5675,12 @@ func main() {
 		bufio.NewReader(os.Stdin).ReadBytes('\n')
 		os.Exit(1)
 	}
-	rootDir := os.Args[1]
+	// Resolve the directory once, so that `.`, `dir/` and absolute paths
+	// all behave the same from here on.
+	rootDir, err := filepath.Abs(flag.Arg(0))
+	if err != nil {
+		log.Fatalf("Error: Cannot resolve directory '%s': %v", flag.Arg(0), err)
+	}
 	info, err := os.Stat(rootDir)
 	if err != nil {
 		log.Fatalf("Error: Cannot access directory '%s': %v", rootDir, err)
@@ -163,16 +5690,457 @@ func main() {
 	}
 
 	// --- 2. Find and Process the Root File ---
-	initialFilePath := filepath.Join(rootDir, "cloud-init.tmpl.yaml")
-	if _, err := os.Stat(initialFilePath); err != nil {
-		log.Fatalf("Error: 'cloud-init.yaml' not found in directory '%s': %v", rootDir, err)
+	var fsys fs.FS = dirFS(rootDir)
+	if *gitRef != "" {
+		refFS, err := gitFS(rootDir, *gitRef)
+		switch {
+		case errors.Is(err, errNotGitRepo):
+			log.Printf("Warning: '%s' is not inside a git repository, reading the working tree instead of %s.", rootDir, *gitRef)
+		case err != nil:
+			log.Fatalf("Error: %v", err)
+		default:
+			fsys = refFS
+		}
+	}
+	if *parseOnly {
+		// Lint every template in the directory, not only those included.
+		problems := 0
+		err := fs.WalkDir(fsys, ".", func(p string, d fs.DirEntry, err error) error {
+			if err != nil || d.IsDir() || !strings.HasSuffix(p, ".yaml") && !strings.HasSuffix(p, ".yml") {
+				return err
+			}
+			data, err := fs.ReadFile(fsys, p)
+			if err != nil {
+				return err
+			}
+			nodes, err := Parse(bytes.NewReader(data))
+			if err != nil {
+				return fmt.Errorf("%s: %w", p, err)
+			}
+			for _, w := range Lint(nodes) {
+				w.File = p
+				fmt.Fprintln(os.Stderr, w)
+				problems++
+			}
+			return nil
+		})
+		if err != nil {
+			log.Fatalf("Error: %v", err)
+		}
+		if problems > 0 {
+			log.Fatalf("Error: %d malformed directive(s).", problems)
+		}
+		return
+	}
+	if _, err := fs.Stat(fsys, rootTemplateName); err != nil && *inputGlob == "" {
+		log.Fatalf("Error: '%s' not found in directory '%s': %v", rootTemplateName, rootDir, err)
+	}
+	if *dumpAST != "" {
+		data, err := fs.ReadFile(fsys, rootTemplateName)
+		if err != nil {
+			log.Fatalf("Error: %v", err)
+		}
+		nodes, err := Parse(bytes.NewReader(data))
+		if err != nil {
+			log.Fatalf("Error: Cannot parse '%s': %v", rootTemplateName, err)
+		}
+		switch *dumpAST {
+		case "text":
+			err = DumpNodes(os.Stdout, nodes)
+		case "json":
+			encoder := json.NewEncoder(os.Stdout)
+			encoder.SetIndent("", "  ")
+			err = encoder.Encode(nodes)
+		default:
+			log.Fatalf("Error: Unknown AST format '%s', expected text or json.", *dumpAST)
+		}
+		if err != nil {
+			log.Fatalf("Error: %v", err)
+		}
+		return
+	}
+	// warnings collects the warnings of the template being expanded, for
+	// --warnings-in-output.
+	var warnings []Warning
+	expander := &Expander{
+		FS:                    fsys,
+		Vars:                  vars,
+		StreamTimeout:         *streamTimeout,
+		NoFinalNewline:        *noFinalNewline || !*finalNewline,
+		MarkDisabled:          *markDisabled,
+		MaxOutputLines:        *maxOutputLines,
+		WarnDuplicateIncludes: *warnDuplicateIncludes,
+		LintDuplicates:        *lintDuplicates,
+		MarkerPathStyle:       *markerPathStyle,
+		OnWarning: func(w Warning) {
+			if *warningsInOutput {
+				warnings = append(warnings, w)
+			}
+			if *annotations == "github" {
+				fmt.Fprintln(os.Stderr, githubAnnotation("warning", rootDir, w.File, w.Line, w.Message))
+				return
+			}
+			logWarning(w, color)
+		},
+		DedupContent:            *dedupContent,
+		IncludeTags:             *includeTags,
+		MaxDirDepth:             *maxDirDepth,
+		Profile:                 *profile,
+		PreserveDirectives:      *preserveDirectives,
+		WarnIncludeBytes:        *warnIncludeBytes,
+		CaseInsensitiveIncludes: *caseInsensitiveIncludes,
+		DirWrap:                 *dirWrap,
+		CacheDir:                *cacheDir,
+		Base64Width:             *base64Width,
+		SkipEmptyIncludes:       *skipEmptyIncludes,
+		ExpandTabs:              *expandTabs,
+		Defines:                 make(map[string]bool),
+		ErrorOnEmptyDir:         *errorOnEmptyDir,
+		SortLists:               sortLists,
+		TrimTrailingWhitespace:  *trimTrailingWhitespace,
+		NoSeparator:             *noSeparator,
+		Verbose:                 *verbose,
+		PreprocessOnly:          *preprocessOnly,
+		DirRecursion:            *dirRecursion,
+		Strict:                  *strict,
+		MaxFileSize:             *maxFileSize,
+		CanonicalOrder:          *canonicalOrder,
+		IncludeOnceGlobal:       *includeOnceGlobal,
+		IncludeBase:             *includeBase,
+		RequireUTF8:             *requireUTF8,
+		SingleDocument:          *singleDocument,
+		NoRootDirectives:        *noRootDirectives,
+	}
+	var stats Stats
+	if *showStats {
+		expander.Stats = &stats
+	}
+	var sourceMap SourceMap
+	if *sourceMapPath != "" {
+		expander.SourceMap = &sourceMap
+	}
+	var explanations []Explanation
+	if *explain {
+		expander.Explain = &explanations
+	}
+	var inputs []string
+	if *provenance {
+		expander.Inputs = &inputs
+		// The header is added by the expansion, so that the source map
+		// and --explain count its lines.
+		expander.Header = func(root string) (string, error) {
+			var generated time.Time
+			if !*noTimestamp {
+				generated = time.Now()
+			}
+			header, err := provenanceHeader(fsys, root, inputs, generated)
+			if err != nil {
+				return "", fmt.Errorf("cannot hash the input files: %w", err)
+			}
+			return header, nil
+		}
+	}
+	if !validDirRecursion(*dirRecursion) {
+		log.Fatalf("Error: Unknown directory recursion '%s', expected deep, shallow or none.", *dirRecursion)
+	}
+	switch *markerPathStyle {
+	case MarkerPathRoot, MarkerPathRelativeToParent:
+	case MarkerPathAbs:
+		expander.AbsRoot = rootDir
+	default:
+		log.Fatalf("Error: Unknown marker path style '%s', expected root, abs or relative-to-parent.", *markerPathStyle)
+	}
+	if !*relativizeErrors {
+		expander.DisplayRoot = rootDir
+	}
+	expander.LineEnding = lineEnding("line-endings", *lineEndings)
+	if *includeLineEndings != "" {
+		expander.IncludeLineEnding = lineEnding("include-line-endings", *includeLineEndings)
+	}
+	for _, define := range defines {
+		expander.Defines[define] = true
+	}
+	// Library and search path directories are reached through FS,
+	// relative to its root.
+	fsDir := func(dir string, kind string) string {
+		absDir, err := filepath.Abs(dir)
+		if err != nil {
+			log.Fatalf("Error: Cannot resolve %s directory '%s': %v", kind, dir, err)
+		}
+		relDir, err := filepath.Rel(rootDir, absDir)
+		if err != nil {
+			log.Fatalf("Error: Cannot use %s directory '%s' with '%s': %v", kind, dir, rootDir, err)
+		}
+		return filepath.ToSlash(relDir)
+	}
+	for _, libDir := range libDirs {
+		expander.LibDirs = append(expander.LibDirs, fsDir(libDir, "library"))
+	}
+	for _, searchDir := range filepath.SplitList(*searchPath) {
+		expander.SearchPath = append(expander.SearchPath, fsDir(searchDir, "search path"))
+	}
+	switch *includeBase {
+	case IncludeBaseFile, IncludeBaseRoot:
+	case IncludeBaseCwd:
+		expander.WorkDir = fsDir(".", "working")
+	default:
+		log.Fatalf("Error: Unknown include base '%s', expected file, root or cwd.", *includeBase)
+	}
+
+	// Keep directory includes from picking up the project config.
+	if relConfig, err := filepath.Rel(rootDir, projectConfig); projectConfig != "" && err == nil && !strings.HasPrefix(relConfig, "..") {
+		expander.Skip = append(expander.Skip, filepath.ToSlash(relConfig))
+	}
+
+	// Keep directory includes from picking up the output of a previous run.
+	if *outputPath != "" {
+		absOutput, err := filepath.Abs(*outputPath)
+		if err != nil {
+			log.Fatalf("Error: Cannot resolve output path '%s': %v", *outputPath, err)
+		}
+		// If Rel fails (e.g., different drive on Windows), the output can't be walked into.
+		if relOutput, err := filepath.Rel(rootDir, absOutput); err == nil {
+			relOutput = filepath.ToSlash(relOutput)
+			if relOutput == rootTemplateName {
+				log.Fatalf("Error: The output path '%s' would overwrite the root template.", *outputPath)
+			}
+			expander.Skip = append(expander.Skip, relOutput)
+		}
+	}
+
+	if *checkIncludes {
+		missing, err := expander.CheckIncludes(rootTemplateName)
+		if err != nil {
+			log.Fatalf("Failed to check includes: %v", err)
+		}
+		for _, notFound := range missing {
+			if *annotations == "github" {
+				fmt.Fprintln(os.Stderr, githubAnnotation("error", rootDir, notFound.FromFile, notFound.Line, notFound.Error()))
+				continue
+			}
+			fmt.Fprintf(os.Stderr, "%s:%d: %v\n", notFound.FromFile, notFound.Line, notFound)
+		}
+		if len(missing) > 0 {
+			log.Fatalf("Error: %d include(s) not found.", len(missing))
+		}
+		return
+	}
+
+	if *listVars {
+		names, err := expander.ReferencedVars(rootTemplateName)
+		if err != nil {
+			log.Fatalf("Failed to list variables: %v", err)
+		}
+		for _, name := range names {
+			if _, ok := vars[name]; ok {
+				fmt.Println(name)
+			} else {
+				fmt.Printf("%s (undefined)\n", name)
+			}
+		}
+		return
+	}
+
+	if *printFiles0 {
+		expander.Inputs = &inputs
+		if _, err := expander.ExpandFile(rootTemplateName); err != nil {
+			log.Fatalf("Failed to expand cloud-init file: %v", err)
+		}
+		for _, name := range inputs {
+			// Inputs taken from the cache can be directories or names
+			// that don't exist, only files are of use to a pipeline.
+			if info, err := fs.Stat(fsys, name); err != nil || info.IsDir() {
+				continue
+			}
+			fmt.Printf("%s\x00", filepath.Join(rootDir, filepath.FromSlash(name)))
+		}
+		return
+	}
+
+	// check runs the post hook and the checks asked for on the expanded
+	// template root, returning what's to be written, quoted if asked for.
+	check := func(root string, content string) (string, error) {
+		if *validate {
+			for _, w := range mixedIndentation(content) {
+				expander.OnWarning(w)
+			}
+		}
+		var cloudInit string
+		if *schemaValidate {
+			cloudInit = cloudInitPath(expander.OnWarning)
+		}
+		if len(warnings) > 0 {
+			content = appendWarnings(content, warnings)
+		}
+		if *postHook != "" {
+			var err error
+			if content, err = runPostHook(*postHook, content, *postHookReplace); err != nil {
+				return "", err
+			}
+		}
+
+		if *requireYAML {
+			if err := checkYAMLSyntax(content); err != nil {
+				return "", fmt.Errorf("the expanded template isn't valid YAML: %w", err)
+			}
+		}
+
+		if missing := missingKeys(content, requiredKeys); len(missing) > 0 {
+			return "", fmt.Errorf("the expanded template is missing required top-level keys: %s", strings.Join(missing, ", "))
+		}
+
+		if *validate {
+			if markers := quotedMarkers(content); len(markers) > 0 {
+				lines := make([]string, len(markers))
+				for i, lineNo := range markers {
+					lines[i] = strconv.Itoa(lineNo)
+				}
+				return "", fmt.Errorf("START/END markers on lines %s of the expanded template are inside a quoted string, is an include inside a multi-line quoted value?", strings.Join(lines, ", "))
+			}
+			if problems := emptyCommands(content); len(problems) > 0 {
+				return "", fmt.Errorf("the expanded template has commands cloud-init can't run: %s", strings.Join(problems, ", "))
+			}
+		}
+
+		if cloudInit != "" {
+			if err := validateSchema(content, *tempDir, cloudInit); err != nil {
+				return "", err
+			}
+		}
+		if *dataURLEncoding != "" {
+			var err error
+			if content, err = dataURL(content, *dataURLEncoding); err != nil {
+				return "", err
+			}
+		}
+		if *shellQuoteStyle != "" {
+			return shellQuote(content, *shellQuoteStyle)
+		}
+		return content, nil
+	}
+
+	if *inputGlob != "" {
+		roots, err := fs.Glob(fsys, *inputGlob)
+		if err != nil {
+			log.Fatalf("Error: Bad --input-glob pattern '%s': %v", *inputGlob, err)
+		}
+		if len(roots) == 0 {
+			log.Fatalf("Error: No templates in '%s' match '%s'.", rootDir, *inputGlob)
+		}
+		if err := os.MkdirAll(*outputDir, 0o755); err != nil {
+			log.Fatalf("Error: Cannot create output directory '%s': %v", *outputDir, err)
+		}
+		absOutputDir, err := filepath.Abs(*outputDir)
+		if err != nil {
+			log.Fatalf("Error: Cannot resolve output directory '%s': %v", *outputDir, err)
+		}
+
+		outputs, err := batchOutputs(rootDir, absOutputDir, roots)
+		if err != nil {
+			log.Fatalf("Error: %v", err)
+		}
+		// Keep directory includes from picking up the output of this or a
+		// previous run.
+		for _, output := range outputs {
+			if relOutput, err := filepath.Rel(rootDir, output); err == nil {
+				expander.Skip = append(expander.Skip, filepath.ToSlash(relOutput))
+			}
+		}
+
+		failures := expandBatch(os.Stderr, roots, outputs, *keepGoing, func(root string, output string) error {
+			warnings = nil
+			content, err := expander.ExpandFile(root)
+			if err == nil {
+				content, err = check(root, content)
+			}
+			if err == nil {
+				err = os.MkdirAll(filepath.Dir(output), 0o755)
+			}
+			if err == nil {
+				err = os.WriteFile(output, []byte(content), 0o644)
+			}
+			if err == nil && signKey != nil {
+				err = writeSignature(signKey, output, content)
+			}
+			if err != nil && *annotations == "github" {
+				fmt.Fprintln(os.Stderr, errorAnnotation(rootDir, root, err))
+			}
+			return err
+		})
+		if len(failures) > 0 && !*keepGoing {
+			log.Fatalf("Error: %s failed to expand, --keep-going expands the other templates anyway.", failures[0])
+		}
+		if len(failures) > 0 {
+			log.Fatalf("Error: %d of %d templates failed to expand.", len(failures), len(roots))
+		}
+		return
 	}
 
 	// --- 3. Run the Processor and Print Output ---
-	finalContent, err := processFile(initialFilePath, rootDir, true)
+	finalContent, err := expander.ExpandFile(rootTemplateName)
 	if err != nil {
+		if *annotations == "github" {
+			fmt.Fprintln(os.Stderr, errorAnnotation(rootDir, "", err))
+		}
 		log.Fatalf("Failed to expand cloud-init file: %v", err)
 	}
+	// Only report on and map output that passes the checks.
+	finalContent, err = check(rootTemplateName, finalContent)
+	if err != nil {
+		log.Fatalf("Error: %v", err)
+	}
+
+	if *showStats {
+		fmt.Fprintf(os.Stderr, "Files read: %d\nBytes read: %d\nMax include depth: %d\nTime: %s\n", stats.Files, stats.Bytes, stats.MaxDepth, stats.Duration)
+	}
+
+	for _, e := range explanations {
+		site := "the root template"
+		if e.IncludedFrom != "" {
+			site = fmt.Sprintf("included at %s:%d", e.IncludedFrom, e.IncludedLine)
+		}
+		fmt.Fprintf(os.Stderr, "%s: %s %s, %s\n", lineRange(e.OutputStart, e.OutputEnd), e.Source, lineRange(e.SourceStart, e.SourceEnd), site)
+	}
+
+	if *sourceMapPath != "" {
+		data, err := json.MarshalIndent(sourceMap, "", "  ")
+		if err != nil {
+			log.Fatalf("Error: Cannot encode source map: %v", err)
+		}
+		if err := os.WriteFile(*sourceMapPath, append(data, '\n'), 0o644); err != nil {
+			log.Fatalf("Error: Cannot write source map '%s': %v", *sourceMapPath, err)
+		}
+	}
+
+	if *outputPath != "" {
+		if err := os.WriteFile(*outputPath, []byte(finalContent), 0o644); err != nil {
+			log.Fatalf("Error: Cannot write output file '%s': %v", *outputPath, err)
+		}
+		if signKey != nil {
+			if err := writeSignature(signKey, *outputPath, finalContent); err != nil {
+				log.Fatalf("Error: Cannot write signature of '%s': %v", *outputPath, err)
+			}
+		}
+		if *tee {
+			fmt.Print(finalContent)
+		}
+		return
+	}
+
+	if *intoPath != "" {
+		target, err := os.ReadFile(*intoPath)
+		if err != nil {
+			log.Fatalf("Error: Cannot read target file '%s': %v", *intoPath, err)
+		}
+		updated, err := replaceManagedBlock(string(target), finalContent)
+		if err != nil {
+			log.Fatalf("Error: %s: %v", *intoPath, err)
+		}
+		if err := os.WriteFile(*intoPath, []byte(updated), 0o644); err != nil {
+			log.Fatalf("Error: Cannot write target file '%s': %v", *intoPath, err)
+		}
+		return
+	}
 
 	// Print the final, fully expanded content to standard output.
 	fmt.Print(finalContent)
@@ -0,0 +1,2572 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"text/template"
+	"time"
+)
+
+// mainArgsEnv holds the arguments, separated by newlines, TestMain runs
+// main with instead of the tests.
+const mainArgsEnv = "CLOUD_INIT_BUILDER_TEST_ARGS"
+
+func TestMain(m *testing.M) {
+	if args, ok := os.LookupEnv(mainArgsEnv); ok {
+		os.Args = append([]string{"cloud-init-builder"}, strings.Split(args, "\n")...)
+		main()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// runMain runs main with args in a new process, as it exits on errors,
+// returning what it printed to standard output and error.
+func runMain(t *testing.T, args ...string) (stdout string, stderr string, err error) {
+	t.Helper()
+	cmd := exec.Command(os.Args[0])
+	cmd.Env = append(os.Environ(), mainArgsEnv+"="+strings.Join(args, "\n"))
+	var outBuf, errBuf strings.Builder
+	cmd.Stdout, cmd.Stderr = &outBuf, &errBuf
+	err = cmd.Run()
+	return outBuf.String(), errBuf.String(), err
+}
+
+// writeFiles creates files, which map slash-separated paths relative to
+// dir to their contents, along with the directories they're in.
+func writeFiles(t testing.TB, dir string, files map[string]string) {
+	t.Helper()
+	for name, content := range files {
+		p := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestServeHandler(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"served/frag.yaml": "- echo ${HOST}\n",
+		// Next to the served directory, where includes mustn't reach.
+		"secret.yaml": "password: hunter2\n",
+	})
+	handler := newServeHandler(os.DirFS(filepath.Join(dir, "served")), 512)
+
+	tests := []struct {
+		name       string
+		method     string
+		body       string
+		wantStatus int
+		// wantBody is part of the response body, and notBody mustn't be.
+		wantBody string
+		notBody  string
+	}{
+		{
+			name:       "substitutes vars",
+			body:       `{"template": "runcmd:\n  #include: frag.yaml\n", "vars": {"HOST": "host.example.com"}}`,
+			wantStatus: http.StatusOK,
+			wantBody:   "  - echo host.example.com\n",
+		},
+		{
+			name:       "leaves unknown vars",
+			body:       `{"template": "#include: frag.yaml\n"}`,
+			wantStatus: http.StatusOK,
+			wantBody:   "- echo ${HOST}\n",
+		},
+		{
+			name:       "invalid JSON",
+			body:       `{"template": `,
+			wantStatus: http.StatusBadRequest,
+			wantBody:   "invalid request body",
+		},
+		{
+			name:       "body too large",
+			body:       `{"template": "` + strings.Repeat("a", 600) + `"}`,
+			wantStatus: http.StatusRequestEntityTooLarge,
+			wantBody:   "request body exceeds 512 bytes",
+		},
+		{
+			name:       "missing include",
+			body:       `{"template": "#include: missing.yaml\n"}`,
+			wantStatus: http.StatusUnprocessableEntity,
+			wantBody:   "missing.yaml",
+		},
+		{
+			name:       "include outside the served directory",
+			body:       `{"template": "#include: ../secret.yaml\n"}`,
+			wantStatus: http.StatusUnprocessableEntity,
+			notBody:    "hunter2",
+		},
+		{
+			name:       "files instead of the served directory",
+			body:       `{"template": "#include: parts/\n#include: frag.yaml\n", "files": {"parts/a.yaml": "- a\n", "frag.yaml": "- in memory\n"}}`,
+			wantStatus: http.StatusOK,
+			wantBody:   "- in memory\n",
+			notBody:    "${HOST}",
+		},
+		{
+			name:       "files without a file the template includes",
+			body:       `{"template": "#include: frag.yaml\n", "files": {"other.yaml": "- other\n"}}`,
+			wantStatus: http.StatusUnprocessableEntity,
+			wantBody:   "frag.yaml",
+		},
+		{
+			name:       "files with an invalid path",
+			body:       `{"template": "#include: ../secret.yaml\n", "files": {"../secret.yaml": "- x\n"}}`,
+			wantStatus: http.StatusBadRequest,
+			wantBody:   "invalid files",
+		},
+		{
+			name:       "not a POST",
+			method:     http.MethodGet,
+			wantStatus: http.StatusMethodNotAllowed,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			method := tt.method
+			if method == "" {
+				method = http.MethodPost
+			}
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, httptest.NewRequest(method, "/expand", strings.NewReader(tt.body)))
+			body := rec.Body.String()
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d, body:\n%s", rec.Code, tt.wantStatus, body)
+			}
+			if !strings.Contains(body, tt.wantBody) {
+				t.Errorf("body = %q, want it to contain %q", body, tt.wantBody)
+			}
+			if tt.notBody != "" && strings.Contains(body, tt.notBody) {
+				t.Errorf("body = %q, want it not to contain %q", body, tt.notBody)
+			}
+		})
+	}
+}
+
+// expandDir expands the root template of the files, written to a new
+// directory, with the options in e, failing the test on errors.
+func expandDir(t testing.TB, e *Expander, files map[string]string) string {
+	t.Helper()
+	dir := t.TempDir()
+	writeFiles(t, dir, files)
+	e.FS = dirFS(dir)
+	if e.OnWarning == nil {
+		e.OnWarning = func(Warning) {}
+	}
+	got, err := e.ExpandFile(rootTemplateName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return got
+}
+
+func TestCacheDependsOnStack(t *testing.T) {
+	// d1/f.yaml includes g.yaml through d2/ unless g.yaml is being
+	// processed, as it is when f.yaml is first included, from g.yaml.
+	files := map[string]string{
+		rootTemplateName: "#include: d2/g.yaml\n#include: d1/f.yaml\n",
+		"d1/f.yaml":      "- f\n#include: ../d2/\n",
+		"d2/g.yaml":      "- g\n#include: ../d1/\n",
+	}
+	cacheDir := t.TempDir()
+	// The second run with the CacheDir reads the entries of the first.
+	for _, dir := range []string{"", cacheDir, cacheDir} {
+		got := expandDir(t, &Expander{CacheDir: dir}, files)
+		// g, f from the first include, f, g from the second.
+		if n := strings.Count(got, "- g\n"); n != 2 {
+			t.Errorf("CacheDir %q: got %d copies of g.yaml, want 2, output:\n%s", dir, n, got)
+		}
+	}
+}
+
+func TestCacheDependsOnFilters(t *testing.T) {
+	got := expandDir(t, &Expander{}, map[string]string{
+		rootTemplateName: "#include-filter: picked a.yaml\n#include: list.yaml\n#include-filter: picked b.yaml\n#include: list.yaml\n",
+		"list.yaml":      "#include: items/ {filter: picked}\n",
+		"items/a.yaml":   "- a\n",
+		"items/b.yaml":   "- b\n",
+	})
+	if !strings.Contains(got, "- a\n") || !strings.Contains(got, "- b\n") {
+		t.Errorf("want both filters applied, output:\n%s", got)
+	}
+}
+
+func TestCacheIndentsPerSite(t *testing.T) {
+	dir := t.TempDir()
+	// shared.yaml is included twice, at different indentation, and
+	// includes a file itself.
+	writeFiles(t, dir, map[string]string{
+		rootTemplateName: "a:\n  #include: shared.yaml\nb:\n    #include: shared.yaml\n",
+		"shared.yaml":    "- echo ${HOST}\n- nested:\n    #include: inner.yaml\n",
+		"inner.yaml":     "- echo inner\n",
+	})
+	e := &Expander{FS: dirFS(dir), Vars: map[string]string{"HOST": "web1"}}
+	got, err := e.ExpandFile(rootTemplateName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{"\n  - echo web1\n", "\n      - echo inner\n", "\n    - echo web1\n", "\n        - echo inner\n"} {
+		if n := strings.Count(got, line); n != 1 {
+			t.Errorf("got %d lines %q, want 1, output:\n%s", n, strings.Trim(line, "\n"), got)
+		}
+	}
+}
+
+func BenchmarkExpandSharedFragments(b *testing.B) {
+	files := map[string]string{"shared/base.yaml": "#include: packages/\n"}
+	var root strings.Builder
+	for i := 0; i < 50; i++ {
+		files[fmt.Sprintf("shared/packages/p%02d.yaml", i)] = fmt.Sprintf("- package%02d\n", i)
+		fmt.Fprintf(&root, "#include: host%02d.yaml\n", i)
+		files[fmt.Sprintf("host%02d.yaml", i)] = "#include: shared/base.yaml\n"
+	}
+	files[rootTemplateName] = root.String()
+	dir := b.TempDir()
+	writeFiles(b, dir, files)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		e := &Expander{FS: dirFS(dir)}
+		if _, err := e.ExpandFile(rootTemplateName); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// readFixture returns the content of file in the fixture dir.
+func readFixture(t *testing.T, dir, file string) string {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join("..", "testdata", dir, file))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestGolden(t *testing.T) {
+	entries, err := os.ReadDir(filepath.Join("..", "testdata"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		dir := filepath.Join("..", "testdata", entry.Name())
+		if _, err := os.Stat(filepath.Join(dir, rootTemplateName)); err != nil {
+			continue
+		}
+		t.Run(entry.Name(), func(t *testing.T) {
+			if err := RunGolden(dir, false); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestQuotedMarkers(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    []int
+	}{
+		{
+			name:    "fixture",
+			content: readFixture(t, "quoted-marker", goldenName),
+			want:    []int{3, 5},
+		},
+		{
+			name:    "single quotes",
+			content: "- 'it''s\n  # START a.yaml\n  x\n  # END a.yaml\n  '\n",
+			want:    []int{2, 4},
+		},
+		{
+			name:    "escaped double quote",
+			content: "- \"say \\\"hi\n  # START a.yaml\n  # END a.yaml\n  \"\n",
+			want:    []int{2, 3},
+		},
+		{
+			name:    "quote inside a plain scalar",
+			content: "- echo it's\n# START a.yaml\n# END a.yaml\n",
+		},
+		{
+			name:    "quote in a comment",
+			content: "- echo # \"\n# START a.yaml\n# END a.yaml\n",
+		},
+		{
+			name:    "quote in a block scalar",
+			content: "- |\n  echo \"\n# START a.yaml\n# END a.yaml\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := quotedMarkers(tt.content); fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("quotedMarkers() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMixedIndentation(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    []string
+	}{
+		{
+			name:    "fixture",
+			content: readFixture(t, "mixed-indentation", goldenName),
+			want: []string{
+				"line 5 of the output, from users.yaml, mixes tabs and spaces in its indentation",
+				"line 12 of the output, from commands.yaml, mixes tabs and spaces in its indentation",
+				"line 4 of the output, from users.yaml, is indented with tabs while others are indented with spaces",
+			},
+		},
+		{
+			name:    "only tabs",
+			content: "users:\n\t- name: admin\n",
+		},
+		{
+			name:    "tabs in the root template",
+			content: "runcmd:\n  - a\nusers:\n\t- b\n",
+			want:    []string{"line 4 of the output, from the root template, is indented with tabs while others are indented with spaces"},
+		},
+		{
+			name:    "tabs in a block scalar",
+			content: "write_files:\n  - content: |\n      a\n\tb\n",
+			want:    []string{"line 4 of the output, from the root template, is indented with tabs while others are indented with spaces"},
+		},
+		{
+			name:    "tabs inside a block scalar",
+			content: "write_files:\n  - content: |\n      a\n      \tb\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+			for _, w := range mixedIndentation(tt.content) {
+				got = append(got, w.Message)
+			}
+			if strings.Join(got, "\n") != strings.Join(tt.want, "\n") {
+				t.Errorf("mixedIndentation() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFormatTemplate(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{"include", "#include :  a.yaml,b.yaml\n", "#include: a.yaml, b.yaml\n"},
+		{"missing space", "  #include:a.yaml\n", "  #include: a.yaml\n"},
+		{"env", "#include-env:profiles/\n", "#include-env: profiles/\n"},
+		{"unless key", "#include-unless-key :users  a.yaml ,b.yaml\n", "#include-unless-key: users a.yaml, b.yaml\n"},
+		{"repeat", "#repeat:HOSTS   host.yaml\n", "#repeat: HOSTS host.yaml\n"},
+		{"file", "#include-file :  /etc/motd   motd.txt\n", "#include-file: /etc/motd motd.txt\n"},
+		{"filter", "#include-filter:on  *.yaml   !*.off.yaml\n", "#include-filter: on *.yaml !*.off.yaml\n"},
+		{"diff", "#include-diff :base.yaml   overlay.yaml\n", "#include-diff: base.yaml overlay.yaml\n"},
+		{"literal", "    content:  #include-literal :script.sh   keep\n", "    content:  #include-literal: script.sh keep\n"},
+		{"disabled", "##include :  a.yaml\n", "##include: a.yaml\n"},
+		{"include-disabled", "#include-disabled:a.yaml\n", "#include-disabled: a.yaml\n"},
+		{"continued list", "#include:a.yaml,\\\n  #b.yaml ,c.yaml\n", "#include: a.yaml, \\\n  #b.yaml ,c.yaml\n"},
+		{"condition", "#if   DEBUG  \n#endif \n", "#if DEBUG\n#endif\n"},
+		{"crlf", "#include:a.yaml\r\n", "#include: a.yaml\r\n"},
+		{"comment with a space after the #", "# include: nothing here\n#  repeat :this\n", "# include: nothing here\n#  repeat :this\n"},
+		{"comment starting with a directive name", "#includes: a.yaml\n#include this file: a.yaml\n", "#includes: a.yaml\n#include this file: a.yaml\n"},
+		{"disabled other directive", "##include-env :profiles/\n", "##include-env :profiles/\n"},
+		{"literal content", "runcmd:\n  - echo '#include :x'\n", "runcmd:\n  - echo '#include :x'\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := formatTemplate(tt.in)
+			if got != tt.want {
+				t.Errorf("formatTemplate(%q) = %q, want %q", tt.in, got, tt.want)
+			}
+			if again := formatTemplate(got); again != got {
+				t.Errorf("formatTemplate isn't idempotent: %q became %q", got, again)
+			}
+		})
+	}
+}
+
+func TestLineDiff(t *testing.T) {
+	old := "a\n#include:x\nb\nc\nd\ne\nf\ng\nh\ni\nj\n#include:y\n"
+	got := lineDiff("t.yaml", old, formatTemplate(old))
+	want := `--- t.yaml
++++ t.yaml
+@@ -1,5 +1,5 @@
+ a
+-#include:x
++#include: x
+ b
+ c
+ d
+@@ -9,4 +9,4 @@
+ h
+ i
+ j
+-#include:y
++#include: y
+`
+	if got != want {
+		t.Errorf("lineDiff() =\n%s\nwant:\n%s", got, want)
+	}
+	if got := lineDiff("t.yaml", "a\n", "a\n"); got != "" {
+		t.Errorf("lineDiff() of unchanged content = %q, want it empty", got)
+	}
+}
+
+func TestHeaderLineNumbers(t *testing.T) {
+	files := map[string]string{
+		rootTemplateName: "#cloud-config\npackages:\n  - vim\nruncmd:\n  #include: cmds.yaml\n",
+		"cmds.yaml":      "- echo one\n- echo two\n",
+	}
+	var sourceMap SourceMap
+	var explanations []Explanation
+	got := expandDir(t, &Expander{
+		SourceMap: &sourceMap,
+		Explain:   &explanations,
+		Header: func(root string) (string, error) {
+			return "# Generated from " + root + "\n# for the test\n", nil
+		},
+	}, files)
+
+	lines := strings.Split(got, "\n")
+	if lines[1] != "# Generated from "+rootTemplateName {
+		t.Fatalf("want the header after #cloud-config, output:\n%s", got)
+	}
+	// sourceLine returns the line of file, starting at 1, without the
+	// indentation the include adds.
+	sourceLine := func(file string, n int) string {
+		return strings.Split(files[file], "\n")[n-1]
+	}
+	for _, m := range sourceMap.Mappings {
+		for i := m.OutputStart; i <= m.OutputEnd; i++ {
+			if out, src := strings.TrimSpace(lines[i-1]), strings.TrimSpace(sourceLine(m.Source, m.SourceLine+i-m.OutputStart)); out != src {
+				t.Errorf("source map: output line %d is %q, its source line %q", i, out, src)
+			}
+		}
+	}
+	for _, e := range explanations {
+		if out, src := strings.TrimSpace(lines[e.OutputStart-1]), strings.TrimSpace(sourceLine(e.Source, e.SourceStart)); out != src {
+			t.Errorf("explain: output line %d is %q, its source line %q", e.OutputStart, out, src)
+		}
+		if out, src := strings.TrimSpace(lines[e.OutputEnd-1]), strings.TrimSpace(sourceLine(e.Source, e.SourceEnd)); out != src {
+			t.Errorf("explain: output line %d is %q, its source line %q", e.OutputEnd, out, src)
+		}
+	}
+	if len(sourceMap.Mappings) == 0 || len(explanations) == 0 {
+		t.Errorf("got no source map or explanations")
+	}
+}
+
+func TestBatch(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"hosts/web.tmpl.yaml":    "#include: ../common.yaml\n- web\n",
+		"hosts/eu/web.tmpl.yaml": "#include: ../../common.yaml\n- eu web\n",
+		"common.yaml":            "- common\n",
+	})
+	roots := []string{"hosts/eu/web.tmpl.yaml", "hosts/web.tmpl.yaml"}
+	outputDir := filepath.Join(dir, "out")
+	outputs, err := batchOutputs(dir, outputDir, roots)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e := &Expander{FS: dirFS(dir)}
+	var log strings.Builder
+	failed := expandBatch(&log, roots, outputs, false, func(root string, output string) error {
+		content, err := e.ExpandFile(root)
+		if err != nil {
+			return err
+		}
+		if err := os.MkdirAll(filepath.Dir(output), 0o755); err != nil {
+			return err
+		}
+		return os.WriteFile(output, []byte(content), 0o644)
+	})
+	if len(failed) > 0 {
+		t.Fatalf("failed: %v, log:\n%s", failed, log.String())
+	}
+	for output, want := range map[string]string{
+		"hosts/eu/web.yaml": "- eu web\n",
+		"hosts/web.yaml":    "- web\n",
+	} {
+		got, err := os.ReadFile(filepath.Join(outputDir, filepath.FromSlash(output)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(string(got), "- common\n") || !strings.HasSuffix(string(got), want) {
+			t.Errorf("%s =\n%s", output, got)
+		}
+	}
+}
+
+func TestBatchOutputsConflicts(t *testing.T) {
+	dir := t.TempDir()
+	tests := []struct {
+		name      string
+		outputDir string
+		roots     []string
+		wantErr   string
+	}{
+		{
+			name:      "same output",
+			outputDir: filepath.Join(dir, "out"),
+			roots:     []string{"web.tmpl.yaml", "web.yaml"},
+			wantErr:   "web.tmpl.yaml and web.yaml would both be written to",
+		},
+		{
+			name:      "output is the template",
+			outputDir: dir,
+			roots:     []string{"web.yaml"},
+			wantErr:   "web.yaml would be written over the template web.yaml",
+		},
+		{
+			name:      "output is another template",
+			outputDir: filepath.Join(dir, "hosts"),
+			roots:     []string{"web.tmpl.yaml", "hosts/web.yaml"},
+			wantErr:   "web.tmpl.yaml would be written over the template hosts/web.yaml",
+		},
+		{
+			name:      "same name in different directories",
+			outputDir: filepath.Join(dir, "out"),
+			roots:     []string{"eu/web.tmpl.yaml", "us/web.tmpl.yaml"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := batchOutputs(dir, tt.outputDir, tt.roots)
+			switch {
+			case tt.wantErr == "" && err != nil:
+				t.Errorf("batchOutputs() error = %v", err)
+			case tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)):
+				t.Errorf("batchOutputs() error = %v, want it to contain %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestBatchOneRootFails(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"a.tmpl.yaml": "- a\n",
+		"b.tmpl.yaml": "#include: missing.yaml\n",
+		"c.tmpl.yaml": "- c\n",
+	})
+	roots := []string{"a.tmpl.yaml", "b.tmpl.yaml", "c.tmpl.yaml"}
+	for _, keepGoing := range []bool{false, true} {
+		t.Run(fmt.Sprintf("keepGoing=%v", keepGoing), func(t *testing.T) {
+			outputs, err := batchOutputs(dir, t.TempDir(), roots)
+			if err != nil {
+				t.Fatal(err)
+			}
+			e := &Expander{FS: dirFS(dir)}
+			var log strings.Builder
+			failed := expandBatch(&log, roots, outputs, keepGoing, func(root string, output string) error {
+				content, err := e.ExpandFile(root)
+				if err != nil {
+					return err
+				}
+				return os.WriteFile(output, []byte(content), 0o644)
+			})
+			if fmt.Sprint(failed) != "[b.tmpl.yaml]" {
+				t.Errorf("failed = %v, want [b.tmpl.yaml]", failed)
+			}
+			if !strings.Contains(log.String(), "FAIL b.tmpl.yaml: ") || !strings.Contains(log.String(), "missing.yaml") {
+				t.Errorf("log doesn't report the failure:\n%s", log.String())
+			}
+			// a is expanded before the failure, c only when keeping going.
+			for i, want := range []bool{true, false, keepGoing} {
+				if _, err := os.Stat(outputs[i]); (err == nil) != want {
+					t.Errorf("%s written: %v, want %v", outputs[i], err == nil, want)
+				}
+			}
+			if got := strings.Contains(log.String(), "\nFailed:\n  b.tmpl.yaml: "); got != keepGoing {
+				t.Errorf("failures repeated at the end: %v, want %v, log:\n%s", got, keepGoing, log.String())
+			}
+		})
+	}
+}
+
+func TestMapFS(t *testing.T) {
+	fsys := mapFS{
+		"cloud-init.tmpl.yaml": []byte("#include: fragments/\n"),
+		"fragments/a.yaml":     []byte("- a\n"),
+		"fragments/b/c.yaml":   []byte("- c\n"),
+	}
+	if err := fstest.TestFS(fsys, "cloud-init.tmpl.yaml", "fragments/a.yaml", "fragments/b/c.yaml"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGitFS(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git isn't installed")
+	}
+	dir := t.TempDir()
+	git := func(args ...string) {
+		t.Helper()
+		cmd := exec.Command("git", append([]string{"-C", dir, "-c", "user.name=test", "-c", "user.email=test@example.com"}, args...)...)
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("git %s: %v\n%s", args[0], err, out)
+		}
+	}
+	git("init", "-q")
+	writeFiles(t, dir, map[string]string{
+		"templates/cloud-init.tmpl.yaml": "#include: fragments/\n",
+		"templates/fragments/a.yaml":     "- committed\n",
+		"outside.yaml":                   "- outside\n",
+	})
+	git("add", "-A")
+	git("commit", "-q", "-m", "templates")
+	// The working tree differs from the commit.
+	writeFiles(t, dir, map[string]string{
+		"templates/fragments/a.yaml": "- changed\n",
+		"templates/fragments/b.yaml": "- untracked\n",
+	})
+
+	fsys, err := gitFS(filepath.Join(dir, "templates"), "HEAD")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := (&Expander{FS: fsys}).ExpandFile(rootTemplateName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(got, "- committed\n") || strings.Contains(got, "changed") || strings.Contains(got, "untracked") {
+		t.Errorf("want the committed files only, output:\n%s", got)
+	}
+	if _, err := fs.Stat(fsys, "../outside.yaml"); err == nil {
+		t.Errorf("files outside of the directory are readable")
+	}
+
+	if _, err := gitFS(t.TempDir(), "HEAD"); !errors.Is(err, errNotGitRepo) {
+		t.Errorf("gitFS() outside a repository error = %v, want errNotGitRepo", err)
+	}
+}
+
+func TestExpandMapFS(t *testing.T) {
+	fsys, err := MapFS(map[string]string{
+		"cloud-init.tmpl.yaml":   "#cloud-config\nwrite_files:\n  #include: write_files/\n",
+		"write_files/a.yaml":     "- path: /etc/a\n",
+		"write_files/sub/b.yaml": "- path: /etc/b\n",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := (&Expander{FS: fsys}).ExpandFile(rootTemplateName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"  - path: /etc/a\n", "  - path: /etc/b\n", "# START write_files/sub/b.yaml"} {
+		if !strings.Contains(got, want) {
+			t.Errorf("output doesn't contain %q:\n%s", want, got)
+		}
+	}
+
+	for _, files := range []map[string]string{
+		{"/etc/a.yaml": ""},
+		{"../a.yaml": ""},
+		{".": ""},
+		{"a.yaml": "", "./a.yaml": ""},
+		{"a": "", "a/b.yaml": ""},
+	} {
+		if _, err := MapFS(files); err == nil {
+			t.Errorf("MapFS(%q) succeeded, want an error", files)
+		}
+	}
+}
+
+func TestTypedErrors(t *testing.T) {
+	expand := func(t *testing.T, e *Expander, files map[string]string) error {
+		t.Helper()
+		dir := t.TempDir()
+		writeFiles(t, dir, files)
+		e.FS = dirFS(dir)
+		_, err := e.ExpandFile(rootTemplateName)
+		if err == nil {
+			t.Fatal("expansion succeeded, want an error")
+		}
+		return err
+	}
+
+	t.Run("cycle", func(t *testing.T) {
+		err := expand(t, &Expander{}, map[string]string{
+			rootTemplateName: "#include: one.yaml\n",
+			"one.yaml":       "#include: two.yaml\n",
+			"two.yaml":       "#include: one.yaml\n",
+		})
+		var cycle *CycleError
+		if !errors.As(err, &cycle) {
+			t.Fatalf("error %v isn't a *CycleError", err)
+		}
+		if got, want := strings.Join(cycle.Chain, " "), rootTemplateName+" one.yaml two.yaml one.yaml"; got != want {
+			t.Errorf("Chain = %q, want %q", got, want)
+		}
+	})
+
+	t.Run("include not found", func(t *testing.T) {
+		err := expand(t, &Expander{}, map[string]string{
+			rootTemplateName: "#include: frag.yaml\n",
+			"frag.yaml":      "- a\n#include: missing.yaml\n",
+		})
+		var notFound *IncludeNotFoundError
+		if !errors.As(err, &notFound) {
+			t.Fatalf("error %v isn't an *IncludeNotFoundError", err)
+		}
+		if notFound.Path != "missing.yaml" || notFound.FromFile != "frag.yaml" || notFound.Line != 2 {
+			t.Errorf("got %+v, want missing.yaml included at frag.yaml:2", notFound)
+		}
+		if !errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("error %v doesn't wrap fs.ErrNotExist", err)
+		}
+	})
+
+	t.Run("depth exceeded", func(t *testing.T) {
+		err := expand(t, &Expander{MaxDirDepth: 1}, map[string]string{
+			rootTemplateName: "#include: d/\n",
+			"d/a/b/c.yaml":   "- c\n",
+		})
+		var depth *DepthExceededError
+		if !errors.As(err, &depth) {
+			t.Fatalf("error %v isn't a *DepthExceededError", err)
+		}
+		if depth.File != "d" || depth.Depth != 1 {
+			t.Errorf("got %+v, want d nested more than 1 level deep", depth)
+		}
+	})
+
+	t.Run("invalid option", func(t *testing.T) {
+		err := expand(t, &Expander{}, map[string]string{
+			rootTemplateName: "#include: frag.yaml {bogus: 1}\n",
+			"frag.yaml":      "- a\n",
+		})
+		// Consumers tolerating missing includes mustn't tolerate this.
+		var notFound *IncludeNotFoundError
+		var cycle *CycleError
+		var depth *DepthExceededError
+		if errors.As(err, &notFound) || errors.As(err, &cycle) || errors.As(err, &depth) {
+			t.Errorf("error %v unwraps to one of the typed errors", err)
+		}
+		if !strings.Contains(err.Error(), `unknown include option "bogus"`) {
+			t.Errorf("error %v doesn't name the option", err)
+		}
+	})
+}
+
+func TestDiskCache(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		rootTemplateName:         "#cloud-config\nruncmd:\n  #include: commands.yaml\n",
+		"commands.yaml":          "- echo top\n#include: nested/more.yaml\n",
+		"nested/more.yaml":       "- echo nested\n#include: deeper.yaml\n",
+		"nested/deeper.yaml":     "- echo deeper ${HOST}\n",
+		"nested/not-included.md": "not included\n",
+	})
+	cacheDir := t.TempDir()
+	// expand returns the output and source map of an expansion, and the
+	// number of files it read.
+	expand := func(cacheDir string) (string, SourceMap, int) {
+		t.Helper()
+		var sourceMap SourceMap
+		var stats Stats
+		e := &Expander{FS: dirFS(dir), CacheDir: cacheDir, Vars: map[string]string{"HOST": "a"}, SourceMap: &sourceMap, Stats: &stats}
+		got, err := e.ExpandFile(rootTemplateName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return got, sourceMap, stats.Files
+	}
+
+	fresh, freshMap, freshFiles := expand("")
+	first, _, _ := expand(cacheDir)
+	hit, hitMap, hitFiles := expand(cacheDir)
+	if first != fresh || hit != fresh {
+		t.Errorf("cached output differs from a fresh run\nfresh:\n%s\nfirst run:\n%s\nhit:\n%s", fresh, first, hit)
+	}
+	if fmt.Sprint(hitMap) != fmt.Sprint(freshMap) {
+		t.Errorf("cached source map differs from a fresh run\nfresh: %v\nhit:   %v", freshMap, hitMap)
+	}
+	if hitFiles >= freshFiles {
+		t.Errorf("a hit read %d files, a fresh run %d, want the includes taken from the cache", hitFiles, freshFiles)
+	}
+
+	// Only the innermost include changes.
+	writeFiles(t, dir, map[string]string{"nested/deeper.yaml": "- echo changed ${HOST}\n"})
+	fresh, _, _ = expand("")
+	got, _, _ := expand(cacheDir)
+	if got != fresh || !strings.Contains(got, "echo changed a") {
+		t.Errorf("editing a nested include didn't invalidate the cache\nfresh:\n%s\ncached:\n%s", fresh, got)
+	}
+
+	// As does adding a file to an included directory.
+	writeFiles(t, dir, map[string]string{
+		"commands.yaml":    "#include: nested/\n",
+		"nested/new.yaml":  "- echo new\n",
+		"nested/more.yaml": "- echo more\n",
+	})
+	expand(cacheDir)
+	writeFiles(t, dir, map[string]string{"nested/newer.yaml": "- echo newer\n"})
+	fresh, _, _ = expand("")
+	if got, _, _ := expand(cacheDir); got != fresh || !strings.Contains(got, "echo newer") {
+		t.Errorf("adding a file to an included directory didn't invalidate the cache\nfresh:\n%s\ncached:\n%s", fresh, got)
+	}
+}
+
+// writeKey writes key to a PEM encoded PKCS #8 file in dir, returning its
+// path.
+func writeKey(t *testing.T, dir string, key any) string {
+	t.Helper()
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyPath := filepath.Join(dir, "key.pem")
+	if err := os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return keyPath
+}
+
+func TestSignature(t *testing.T) {
+	dir := t.TempDir()
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := loadSigningKey(writeKey(t, dir, private))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	content := "#cloud-config\nruncmd:\n  - echo signed\n"
+	outputPath := filepath.Join(dir, "user-data.yaml")
+	if err := os.WriteFile(outputPath, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeSignature(key, outputPath, content); err != nil {
+		t.Fatal(err)
+	}
+	signature, err := os.ReadFile(outputPath + ".sig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	written, err := os.ReadFile(outputPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ed25519.Verify(public, written, signature) {
+		t.Errorf("the signature doesn't verify the output")
+	}
+	if ed25519.Verify(public, append(written, '\n'), signature) {
+		t.Errorf("the signature verifies changed output")
+	}
+}
+
+func TestLoadSigningKeyRejectsOtherKeys(t *testing.T) {
+	dir := t.TempDir()
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadSigningKey(writeKey(t, dir, ecKey)); err == nil || !strings.Contains(err.Error(), "expected an ed25519 key") {
+		t.Errorf("loadSigningKey() of an ECDSA key error = %v, want it rejected", err)
+	}
+
+	notPEM := filepath.Join(dir, "not-pem.txt")
+	if err := os.WriteFile(notPEM, []byte("not a key\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadSigningKey(notPEM); err == nil || !strings.Contains(err.Error(), "is not a PEM encoded PRIVATE KEY") {
+		t.Errorf("loadSigningKey() of a non-PEM file error = %v, want it rejected", err)
+	}
+}
+
+func TestNamedPipe(t *testing.T) {
+	if _, err := exec.LookPath("mkfifo"); err != nil {
+		t.Skip("mkfifo isn't installed")
+	}
+	// mkfifoDir returns a directory whose root template includes the named
+	// pipe pipe.yaml.
+	mkfifoDir := func(t *testing.T) string {
+		dir := t.TempDir()
+		writeFiles(t, dir, map[string]string{rootTemplateName: "runcmd:\n  #include: pipe.yaml\n"})
+		if out, err := exec.Command("mkfifo", filepath.Join(dir, "pipe.yaml")).CombinedOutput(); err != nil {
+			t.Fatalf("mkfifo: %v\n%s", err, out)
+		}
+		return dir
+	}
+
+	t.Run("written", func(t *testing.T) {
+		dir := mkfifoDir(t)
+		go func() {
+			// Opening blocks until the expansion opens the pipe for reading.
+			if err := os.WriteFile(filepath.Join(dir, "pipe.yaml"), []byte("- echo from the pipe\n"), 0o644); err != nil {
+				t.Error(err)
+			}
+		}()
+		got, err := (&Expander{FS: dirFS(dir), StreamTimeout: 10 * time.Second}).ExpandFile(rootTemplateName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(got, "  - echo from the pipe\n") {
+			t.Errorf("output doesn't contain the pipe's content:\n%s", got)
+		}
+	})
+
+	t.Run("no writer", func(t *testing.T) {
+		dir := mkfifoDir(t)
+		_, err := (&Expander{FS: dirFS(dir), StreamTimeout: 50 * time.Millisecond}).ExpandFile(rootTemplateName)
+		if err == nil || !strings.Contains(err.Error(), "timed out after 50ms waiting for stream pipe.yaml") {
+			t.Errorf("error = %v, want a timeout", err)
+		}
+		// Unblock the abandoned reader.
+		if f, err := os.OpenFile(filepath.Join(dir, "pipe.yaml"), os.O_WRONLY, 0); err == nil {
+			f.Close()
+		}
+	})
+
+	t.Run("without a timeout", func(t *testing.T) {
+		dir := mkfifoDir(t)
+		_, err := (&Expander{FS: dirFS(dir)}).ExpandFile(rootTemplateName)
+		if err == nil || !strings.Contains(err.Error(), "pipe.yaml is not a regular file, set a stream timeout") {
+			t.Errorf("error = %v, want named pipes refused", err)
+		}
+	})
+}
+
+func TestTemplateFunc(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"users.yaml":         "- name: ${USER}\n#include: more/\n",
+		"more/operator.yaml": "- name: operator\n",
+	})
+	e := &Expander{FS: dirFS(dir), Vars: map[string]string{"USER": "admin"}}
+	name, fn := e.TemplateFunc()
+	tmpl, err := template.New("user-data").Funcs(template.FuncMap{name: fn}).Parse("#cloud-config\nhostname: {{ .Host }}\nusers:\n{{ cloudinit \"users.yaml\" }}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var b strings.Builder
+	if err := tmpl.Execute(&b, map[string]string{"Host": "web"}); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"hostname: web\n", "- name: admin\n", "- name: operator\n", "# START more/operator.yaml"} {
+		if !strings.Contains(b.String(), want) {
+			t.Errorf("output doesn't contain %q:\n%s", want, b.String())
+		}
+	}
+
+	// Expansion errors fail the template.
+	tmpl = template.Must(template.New("missing").Funcs(template.FuncMap{name: fn}).Parse(`{{ cloudinit "missing.yaml" }}`))
+	if err := tmpl.Execute(&b, nil); err == nil || !strings.Contains(err.Error(), "missing.yaml") {
+		t.Errorf("Execute() error = %v, want the missing file named", err)
+	}
+}
+
+func TestUseColor(t *testing.T) {
+	// Standard error is a file rather than a terminal.
+	stderr, err := os.Create(filepath.Join(t.TempDir(), "stderr"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stderr.Close()
+	defer func(saved *os.File) { os.Stderr = saved }(os.Stderr)
+	os.Stderr = stderr
+
+	tests := []struct {
+		mode    string
+		noColor string
+		want    bool
+	}{
+		{mode: "auto", want: false},
+		{mode: "auto", noColor: "1", want: false},
+		{mode: "always", want: true},
+		{mode: "always", noColor: "1", want: true},
+		{mode: "never", want: false},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%s NO_COLOR=%s", tt.mode, tt.noColor), func(t *testing.T) {
+			t.Setenv("NO_COLOR", tt.noColor)
+			t.Setenv("TERM", "xterm")
+			got, err := useColor(tt.mode)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("useColor(%q) = %v, want %v", tt.mode, got, tt.want)
+			}
+		})
+	}
+	if _, err := useColor("sometimes"); err == nil {
+		t.Errorf("useColor() of an unknown mode succeeded")
+	}
+}
+
+func TestProgress(t *testing.T) {
+	files := map[string]string{rootTemplateName: "#include: parts/\n"}
+	for i := 0; i < 5; i++ {
+		files[fmt.Sprintf("parts/p%d.yaml", i)] = strings.Repeat(fmt.Sprintf("- echo %d\n", i), 100)
+	}
+	var counts []int64
+	var stats Stats
+	expandDir(t, &Expander{Stats: &stats, Progress: func(bytesRead int64) {
+		counts = append(counts, bytesRead)
+	}}, files)
+
+	// Once per included file, as the root template is read before them.
+	if len(counts) != len(files)-1 {
+		t.Fatalf("Progress called %d times, want %d: %v", len(counts), len(files)-1, counts)
+	}
+	for i := 1; i < len(counts); i++ {
+		if counts[i] <= counts[i-1] {
+			t.Errorf("counts don't increase: %v", counts)
+		}
+	}
+	if last := counts[len(counts)-1]; last != stats.Bytes {
+		t.Errorf("last count = %d, want all %d bytes read", last, stats.Bytes)
+	}
+}
+
+func TestPathRewriter(t *testing.T) {
+	files := map[string]string{
+		rootTemplateName:          "#include: legacy/users.yaml\n#include: fragments/packages.yaml\n",
+		"fragments/users.yaml":    "- users moved\n#include: more.yaml\n",
+		"fragments/more.yaml":     "- more\n",
+		"fragments/packages.yaml": "- packages\n",
+	}
+	var calls []string
+	got := expandDir(t, &Expander{PathRewriter: func(rawPath, fromFile string) (string, error) {
+		calls = append(calls, fromFile+": "+rawPath)
+		if rawPath == "legacy/users.yaml" {
+			return "fragments/users.yaml", nil
+		}
+		return rawPath, nil
+	}}, files)
+	for _, want := range []string{"- users moved\n", "- more\n", "- packages\n", "# START fragments/users.yaml"} {
+		if !strings.Contains(got, want) {
+			t.Errorf("output doesn't contain %q:\n%s", want, got)
+		}
+	}
+	wantCalls := rootTemplateName + ": legacy/users.yaml|fragments/users.yaml: more.yaml|" + rootTemplateName + ": fragments/packages.yaml"
+	if strings.Join(calls, "|") != wantCalls {
+		t.Errorf("calls = %q, want %q", strings.Join(calls, "|"), wantCalls)
+	}
+
+	dir := t.TempDir()
+	writeFiles(t, dir, files)
+	e := &Expander{FS: dirFS(dir), PathRewriter: func(rawPath, fromFile string) (string, error) {
+		return "", errors.New("no legacy paths")
+	}}
+	if _, err := e.ExpandFile(rootTemplateName); err == nil || !strings.Contains(err.Error(), "cannot rewrite include path 'legacy/users.yaml': no legacy paths") {
+		t.Errorf("error = %v, want the rewriter's error", err)
+	}
+}
+
+func TestRequireFinalYAMLParse(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"templates/" + rootTemplateName: "#cloud-config\nruncmd:\n  #include: commands.yaml\n",
+		"templates/commands.yaml":       "- \"echo unclosed\n",
+	})
+	templates := filepath.Join(dir, "templates")
+
+	stdout, stderr, err := runMain(t, "--require-final-yaml-parse", templates)
+	if err == nil {
+		t.Fatalf("succeeded, want it to fail, stderr:\n%s", stderr)
+	}
+	if stdout != "" {
+		t.Errorf("printed the output:\n%s", stdout)
+	}
+	if !strings.Contains(stderr, "isn't valid YAML: line 4, column 5: quoted scalar starting with \" isn't closed") {
+		t.Errorf("stderr doesn't give the line and column:\n%s", stderr)
+	}
+
+	outputPath := filepath.Join(dir, "user-data.yaml")
+	sourceMapPath := filepath.Join(dir, "user-data.map.json")
+	_, stderr, err = runMain(t, "--require-final-yaml-parse", "--tee", "-o", outputPath, "--sourcemap", sourceMapPath, "--stats", "--explain", templates)
+	if err == nil {
+		t.Fatalf("succeeded with -o, want it to fail, stderr:\n%s", stderr)
+	}
+	for _, p := range []string{outputPath, sourceMapPath} {
+		if _, err := os.Stat(p); !errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("wrote %s: %v", p, err)
+		}
+	}
+	if strings.Contains(stderr, "Files read:") || strings.Contains(stderr, rootTemplateName+" line") {
+		t.Errorf("printed --stats or --explain lines:\n%s", stderr)
+	}
+
+	// Without the flag, the output is written.
+	if _, stderr, err := runMain(t, "-o", outputPath, templates); err != nil {
+		t.Fatalf("%v, stderr:\n%s", err, stderr)
+	}
+	if _, err := os.Stat(outputPath); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestValidateSchemaTempDir(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("sh isn't installed")
+	}
+	// The fake cloud-init logs the file it's given, and fails on content
+	// that says so.
+	binDir, tempDir := t.TempDir(), t.TempDir()
+	logPath := filepath.Join(t.TempDir(), "log")
+	writeFiles(t, binDir, map[string]string{"cloud-init": `#!/bin/sh
+echo "$3" >> "` + logPath + `"
+test -f "$3" || exit 2
+if grep -q invalid "$3"; then echo "$3: invalid"; exit 1; fi
+`})
+	if err := os.Chmod(filepath.Join(binDir, "cloud-init"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", binDir+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	cloudInit := cloudInitPath(func(w Warning) { t.Errorf("unexpected warning %s", w) })
+	if err := validateSchema("runcmd: []\n", tempDir, cloudInit); err != nil {
+		t.Fatal(err)
+	}
+	err := validateSchema("invalid: true\n", tempDir, cloudInit)
+	if err == nil || !strings.Contains(err.Error(), "expanded "+rootTemplateName+": invalid") {
+		t.Errorf("error = %v, want the diagnostics about the expanded template", err)
+	}
+
+	data, err := os.ReadFile(logPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := strings.Fields(string(data))
+	if len(files) != 2 {
+		t.Fatalf("cloud-init ran with %q, want 2 files", files)
+	}
+	for _, file := range files {
+		if filepath.Dir(file) != tempDir {
+			t.Errorf("%s isn't in the temp dir %s", file, tempDir)
+		}
+	}
+	if entries, err := os.ReadDir(tempDir); err != nil || len(entries) > 0 {
+		t.Errorf("temp dir not emptied: %v %v", entries, err)
+	}
+}
+
+func TestTee(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"templates/" + rootTemplateName: "#cloud-config\nruncmd:\n  #include: commands.yaml\n",
+		"templates/commands.yaml":       "- echo ${GREETING}\n",
+	})
+	outputPath := filepath.Join(dir, "user-data.yaml")
+	// CRLF line endings and a missing final newline mustn't differ either.
+	stdout, stderr, err := runMain(t, "--tee", "-o", outputPath, "--set", "GREETING=hello", "--line-endings", "crlf", "--no-final-newline", filepath.Join(dir, "templates"))
+	if err != nil {
+		t.Fatalf("%v, stderr:\n%s", err, stderr)
+	}
+	written, err := os.ReadFile(outputPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stdout != string(written) {
+		t.Errorf("stdout differs from %s\nstdout: %q\nfile:   %q", outputPath, stdout, written)
+	}
+	if !strings.Contains(stdout, "- echo hello\r\n") || strings.HasSuffix(stdout, "\n") {
+		t.Errorf("unexpected output %q", stdout)
+	}
+
+	if _, stderr, err := runMain(t, "--tee", filepath.Join(dir, "templates")); err == nil || !strings.Contains(stderr, "--tee needs -o") {
+		t.Errorf("--tee without -o: %v, stderr:\n%s", err, stderr)
+	}
+}
+
+func TestSchemaValidateWithoutCloudInit(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{rootTemplateName: "#cloud-config\nruncmd: []\n"})
+	t.Setenv("PATH", t.TempDir())
+
+	stdout, stderr, err := runMain(t, "--schema-validate", "--warnings-in-output", "--annotations", "github", dir)
+	if err != nil {
+		t.Fatalf("%v, stderr:\n%s", err, stderr)
+	}
+	const message = "cloud-init not found on PATH, skipping schema validation"
+	if !strings.HasSuffix(stdout, "# 1 warning(s) while expanding:\n# "+message+"\n") {
+		t.Errorf("the warning isn't in the output:\n%s", stdout)
+	}
+	if !strings.Contains(stderr, "::warning") || !strings.Contains(stderr, message) {
+		t.Errorf("the warning isn't annotated:\n%s", stderr)
+	}
+}
+
+func TestIncludeTags(t *testing.T) {
+	files := map[string]string{
+		"motd.txt": "hello\nworld\n",
+		"cmd.sh":   "echo hi",
+	}
+
+	t.Run("block", func(t *testing.T) {
+		files[rootTemplateName] = "write_files:\n  - path: /etc/motd\n    content: !include motd.txt\nruncmd:\n  - !include cmd.sh\n  - echo \"!include motd.txt\"\n"
+		got := expandDir(t, &Expander{IncludeTags: true}, files)
+		want := "write_files:\n  - path: /etc/motd\n    content: |\n      hello\n      world\nruncmd:\n  - |-\n    echo hi\n  - echo \"!include motd.txt\"\n"
+		if got != want {
+			t.Errorf("got:\n%s\nwant:\n%s", got, want)
+		}
+	})
+
+	for _, line := range []string{"motd: {content: !include motd.txt}", "commands: [!include cmd.sh]"} {
+		t.Run("flow "+line, func(t *testing.T) {
+			dir := t.TempDir()
+			files[rootTemplateName] = line + "\n"
+			writeFiles(t, dir, files)
+			e := &Expander{FS: dirFS(dir), IncludeTags: true}
+			_, err := e.ExpandFile(rootTemplateName)
+			if err == nil || !strings.Contains(err.Error(), rootTemplateName+":1: !include tags are not supported in flow collections") {
+				t.Errorf("error = %v, want flow collections rejected", err)
+			}
+		})
+	}
+}
+
+func TestCanonicalOrder(t *testing.T) {
+	t.Run("unknown keys last", func(t *testing.T) {
+		files := map[string]string{
+			rootTemplateName: "#cloud-config\nruncmd:\n  - echo hi\ncustom_b: 1\nhostname: web1\ncustom_a: 2\npackages:\n  - git\n",
+		}
+		got := expandDir(t, &Expander{CanonicalOrder: true}, files)
+		want := "#cloud-config\nhostname: web1\npackages:\n  - git\nruncmd:\n  - echo hi\ncustom_b: 1\ncustom_a: 2\n"
+		if got != want {
+			t.Errorf("got:\n%s\nwant:\n%s", got, want)
+		}
+	})
+
+	t.Run("several documents", func(t *testing.T) {
+		template := "runcmd:\n  - echo hi\n---\nhostname: web1\n"
+		var warnings []string
+		e := &Expander{CanonicalOrder: true, OnWarning: func(w Warning) { warnings = append(warnings, w.String()) }}
+		got := expandDir(t, e, map[string]string{rootTemplateName: template})
+		if got != template {
+			t.Errorf("got:\n%s\nwant it unchanged:\n%s", got, template)
+		}
+		want := rootTemplateName + ":3: left the top-level keys in their order, the output has several YAML documents"
+		if len(warnings) != 1 || warnings[0] != want {
+			t.Errorf("warnings = %q, want %q", warnings, want)
+		}
+	})
+}
+
+func TestSortLists(t *testing.T) {
+	files := map[string]string{
+		rootTemplateName: "write_files:\n  #include: b.yaml\n  #include: a.yaml\npackages:\n  - zsh\n  - git\n",
+		"b.yaml":         "- path: /etc/z\n  content: z\n- path: /etc/b\n  content: b\n",
+		"a.yaml":         "- path: /etc/a\n  content: a\n",
+	}
+	got := expandDir(t, &Expander{SortLists: map[string]string{"write_files": "path"}}, files)
+	// a.yaml's entry comes first, and b.yaml's are sorted among themselves,
+	// each file's separator moving with it. packages isn't sorted.
+	want := "write_files:\n" +
+		"  # START a.yaml\n  - path: /etc/a\n    content: a\n  # END a.yaml\n" +
+		"  # START b.yaml\n  - path: /etc/b\n    content: b\n  - path: /etc/z\n    content: z\n  # END b.yaml\n\n\n" +
+		"packages:\n  - zsh\n  - git\n"
+	if got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestIncludeLiteralChomping(t *testing.T) {
+	for _, test := range []struct {
+		name, file, chomp, header, value string
+	}{
+		{name: "clip", file: "one\n  two\n", header: "|", value: "one\n  two\n"},
+		{name: "strip", file: "one\n  two", header: "|-", value: "one\n  two"},
+		{name: "keep", file: "one\n  two\n\n", header: "|+", value: "one\n  two\n\n"},
+		{name: "strip option", file: "one\n\n", chomp: " strip", header: "|-", value: "one"},
+		{name: "clip option", file: "one\n\n", chomp: " clip", header: "|", value: "one\n"},
+		{name: "keep option", file: "one\n\n", chomp: " keep", header: "|+", value: "one\n\n"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			files := map[string]string{
+				rootTemplateName: "files:\n  body: #include-literal: body.txt" + test.chomp + "\nafter: 1\n",
+				"body.txt":       test.file,
+			}
+			got := expandDir(t, &Expander{}, files)
+			if err := checkYAMLSyntax(got); err != nil {
+				t.Fatalf("%v, output:\n%s", err, got)
+			}
+			lines := strings.Split(got, "\n")
+			if lines[1] != "  body: "+test.header {
+				t.Fatalf("got %q, want the header %q, output:\n%s", lines[1], test.header, got)
+			}
+			// Read the block scalar back the way YAML does.
+			end := 2
+			for lines[end] == "" || strings.HasPrefix(lines[end], "    ") {
+				end++
+			}
+			body := lines[2:end]
+			trailing := 0
+			for len(body) > 0 && body[len(body)-1] == "" {
+				body = body[:len(body)-1]
+				trailing++
+			}
+			for i := range body {
+				body[i] = strings.TrimPrefix(body[i], "    ")
+			}
+			value := strings.Join(body, "\n")
+			switch test.header {
+			case "|":
+				value += "\n"
+			case "|+":
+				value += "\n" + strings.Repeat("\n", trailing)
+			}
+			if value != test.value {
+				t.Errorf("got the value %q, want %q, output:\n%s", value, test.value, got)
+			}
+		})
+	}
+}
+
+func TestDefines(t *testing.T) {
+	template := "runcmd:\n#if DEBUG\n  - echo debug\n  #include: debug.yaml\n#endif\n  - echo always\n"
+
+	t.Run("set", func(t *testing.T) {
+		files := map[string]string{rootTemplateName: template, "debug.yaml": "- set -x\n"}
+		got := expandDir(t, &Expander{Defines: map[string]bool{"DEBUG": true}}, files)
+		want := "runcmd:\n  - echo debug\n  # START debug.yaml\n  - set -x\n  # END debug.yaml\n\n  - echo always\n"
+		if got != want {
+			t.Errorf("got:\n%s\nwant:\n%s", got, want)
+		}
+	})
+
+	t.Run("unset", func(t *testing.T) {
+		// There's no debug.yaml: the dropped block's include isn't processed.
+		files := map[string]string{rootTemplateName: template}
+		got := expandDir(t, &Expander{Defines: map[string]bool{"OTHER": true}}, files)
+		if want := "runcmd:\n  - echo always\n"; got != want {
+			t.Errorf("got:\n%s\nwant:\n%s", got, want)
+		}
+	})
+}
+
+func TestIncludeOnceGlobal(t *testing.T) {
+	// common.yaml is included by both a.yaml and b.yaml.
+	files := map[string]string{
+		rootTemplateName: "runcmd:\n  #include: a/a.yaml\n  #include: b/b.yaml\n",
+		"a/a.yaml":       "- echo a\n#include: ../common.yaml\n",
+		"b/b.yaml":       "- echo b\n#include: ../common.yaml\n",
+		"common.yaml":    "- echo common\n",
+	}
+	for _, once := range []bool{false, true} {
+		got := expandDir(t, &Expander{IncludeOnceGlobal: once}, files)
+		want := 2
+		if once {
+			want = 1
+		}
+		if n := strings.Count(got, "- echo common\n"); n != want {
+			t.Errorf("IncludeOnceGlobal %v: got common.yaml %d times, want %d, output:\n%s", once, n, want, got)
+		}
+		if !strings.Contains(got, "- echo b\n") {
+			t.Errorf("IncludeOnceGlobal %v: b.yaml is missing, output:\n%s", once, got)
+		}
+	}
+}
+
+func TestDirRecursion(t *testing.T) {
+	for _, test := range []struct {
+		recursion, config string
+		sub               bool
+	}{
+		{recursion: "", sub: true},
+		{recursion: DirRecursionDeep, sub: true},
+		{recursion: DirRecursionNone, sub: false},
+		{recursion: DirRecursionShallow, sub: false},
+		{recursion: DirRecursionDeep, config: "recursion: shallow\n", sub: false},
+		{recursion: DirRecursionNone, config: "recursion: deep\n", sub: true},
+	} {
+		t.Run(test.recursion+" "+strings.TrimSpace(test.config), func(t *testing.T) {
+			files := map[string]string{
+				rootTemplateName:      "runcmd:\n  #include: conf.d/\n",
+				"conf.d/top.yaml":     "- echo top\n",
+				"conf.d/sub/sub.yaml": "- echo sub\n",
+			}
+			if test.config != "" {
+				files["conf.d/"+dirConfigName] = test.config
+			}
+			got := expandDir(t, &Expander{DirRecursion: test.recursion}, files)
+			if !strings.Contains(got, "- echo top\n") {
+				t.Errorf("top.yaml is missing, output:\n%s", got)
+			}
+			if sub := strings.Contains(got, "- echo sub\n"); sub != test.sub {
+				t.Errorf("got sub/sub.yaml included %v, want %v, output:\n%s", sub, test.sub, got)
+			}
+		})
+	}
+}
+
+func TestRequireUTF8(t *testing.T) {
+	// The invalid byte comes after the first sniffSize bytes, which would
+	// have the file rejected as binary.
+	padding := strings.Repeat("# padding\n", sniffSize/10+1)
+	files := map[string]string{
+		rootTemplateName: "runcmd:\n  #include: bad.yaml\n",
+		"bad.yaml":       padding + "- echo ok\n- echo \xff\n",
+	}
+	message := fmt.Sprintf("bad.yaml:%d: invalid UTF-8 at byte offset %d", strings.Count(padding, "\n")+2, len(padding)+17)
+
+	dir := t.TempDir()
+	writeFiles(t, dir, files)
+	e := &Expander{FS: dirFS(dir), RequireUTF8: true}
+	if _, err := e.ExpandFile(rootTemplateName); err == nil || !strings.Contains(err.Error(), message) {
+		t.Errorf("error = %v, want it to contain %q", err, message)
+	}
+
+	var warnings []string
+	e = &Expander{OnWarning: func(w Warning) { warnings = append(warnings, w.String()) }}
+	got := expandDir(t, e, files)
+	if !strings.Contains(got, "- echo \xff\n") {
+		t.Errorf("the invalid line isn't copied as is, output:\n%q", got)
+	}
+	if want := message + ", copying it as is"; len(warnings) != 1 || warnings[0] != want {
+		t.Errorf("warnings = %q, want %q", warnings, want)
+	}
+}
+
+func TestOutputInTemplates(t *testing.T) {
+	dir := t.TempDir()
+	templates := filepath.Join(dir, "templates")
+	writeFiles(t, templates, map[string]string{
+		rootTemplateName: "runcmd:\n  #include: ./\n",
+		"frag.yaml":      "- echo frag\n",
+	})
+	// The output lands in the directory the root template includes, where
+	// the second run mustn't pick up the first one's output.
+	outputPath := filepath.Join(templates, "out.yaml")
+	var outputs []string
+	for i := 0; i < 2; i++ {
+		if _, stderr, err := runMain(t, "-o", outputPath, templates); err != nil {
+			t.Fatalf("run %d: %v, stderr:\n%s", i+1, err, stderr)
+		}
+		output, err := os.ReadFile(outputPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		outputs = append(outputs, string(output))
+	}
+	if strings.Contains(outputs[1], "out.yaml") || outputs[1] != outputs[0] {
+		t.Errorf("the second output differs from the first:\n%s\nfirst:\n%s", outputs[1], outputs[0])
+	}
+}
+
+func TestIncludeListContinuation(t *testing.T) {
+	files := map[string]string{
+		rootTemplateName: "runcmd:\n  #include: a.yaml, \\\n  #  b.yaml, \\\n  #  c.yaml,\n  - echo after\n",
+		"a.yaml":         "- echo a\n",
+		"b.yaml":         "- echo b\n",
+		"c.yaml":         "- echo c\n",
+	}
+	got := expandDir(t, &Expander{}, files)
+	want := "runcmd:\n" +
+		"  # START a.yaml\n  - echo a\n  # END a.yaml\n\n" +
+		"  # START b.yaml\n  - echo b\n  # END b.yaml\n\n" +
+		"  # START c.yaml\n  - echo c\n  # END c.yaml\n\n" +
+		"  - echo after\n"
+	if got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestDisabledIncludes(t *testing.T) {
+	// missing.yaml doesn't exist, so reading it would fail the expansion.
+	files := map[string]string{
+		rootTemplateName: "runcmd:\n  ##include: missing.yaml\n  #include-disabled: missing.yaml\n  - echo on\n",
+	}
+	for _, test := range []struct {
+		markDisabled bool
+		want         string
+	}{
+		{markDisabled: false, want: "runcmd:\n  - echo on\n"},
+		{markDisabled: true, want: "runcmd:\n  # (disabled) missing.yaml\n  # (disabled) missing.yaml\n  - echo on\n"},
+	} {
+		got := expandDir(t, &Expander{MarkDisabled: test.markDisabled}, files)
+		if got != test.want {
+			t.Errorf("MarkDisabled %v: got:\n%s\nwant:\n%s", test.markDisabled, got, test.want)
+		}
+	}
+}
+
+func TestListVars(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		rootTemplateName: "hostname: ${CIB_HOST}\nruncmd:\n  #include: a.yaml, b.yaml\n",
+		"a.yaml":         "- echo ${CIB_ZONE} ${CIB_HOST}\n",
+		"b.yaml":         "- echo ${CIB_APP}\n",
+	})
+	stdout, stderr, err := runMain(t, "--list-vars", "--set", "CIB_HOST=web1", dir)
+	if err != nil {
+		t.Fatalf("%v, stderr:\n%s", err, stderr)
+	}
+	if want := "CIB_APP (undefined)\nCIB_HOST\nCIB_ZONE (undefined)\n"; stdout != want {
+		t.Errorf("got:\n%s\nwant:\n%s", stdout, want)
+	}
+}
+
+func TestMaxOutputLines(t *testing.T) {
+	files := map[string]string{
+		rootTemplateName: "runcmd:\n  #include: a.yaml\n  - echo after\n",
+		"a.yaml":         "- echo a\n- echo b\n",
+	}
+	full := expandDir(t, &Expander{}, files)
+	lines := strings.Count(full, "\n")
+
+	got := expandDir(t, &Expander{MaxOutputLines: lines}, files)
+	if got != full {
+		t.Errorf("at the limit, got:\n%s\nwant:\n%s", got, full)
+	}
+
+	dir := t.TempDir()
+	writeFiles(t, dir, files)
+	e := &Expander{FS: dirFS(dir), MaxOutputLines: lines - 1}
+	want := fmt.Sprintf("output exceeds the limit of %d lines", lines-1)
+	if _, err := e.ExpandFile(rootTemplateName); err == nil || !strings.Contains(err.Error(), want) {
+		t.Errorf("one line over the limit, error = %v, want %q", err, want)
+	}
+}
+
+func TestRelativizeErrors(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		rootTemplateName: "runcmd:\n  #include: sub/a.yaml\n",
+		"sub/a.yaml":     "#include: missing.yaml\n",
+	})
+	for _, test := range []struct {
+		flag, want string
+	}{
+		{flag: "--relativize-errors", want: "in file sub/a.yaml: include path not found sub/missing.yaml"},
+		{flag: "--relativize-errors=false", want: fmt.Sprintf("in file %s: include path not found %s", filepath.Join(dir, "sub", "a.yaml"), filepath.Join(dir, "sub", "missing.yaml"))},
+	} {
+		_, stderr, err := runMain(t, test.flag, dir)
+		if err == nil || !strings.Contains(stderr, test.want) {
+			t.Errorf("%s: error = %v, want %q in stderr:\n%s", test.flag, err, test.want, stderr)
+		}
+	}
+}
+
+func TestMarkerPathStyle(t *testing.T) {
+	files := map[string]string{
+		rootTemplateName: "runcmd:\n  #include: sub/a.yaml\n",
+		"sub/a.yaml":     "- echo a\n#include: b.yaml\n",
+		"sub/b.yaml":     "- echo b\n",
+	}
+	const root = "/srv/templates"
+	for _, test := range []struct {
+		style   string
+		a, b    string
+		absRoot string
+	}{
+		{style: MarkerPathRoot, a: "sub/a.yaml", b: "sub/b.yaml"},
+		{style: MarkerPathAbs, a: root + "/sub/a.yaml", b: root + "/sub/b.yaml", absRoot: root},
+		{style: MarkerPathRelativeToParent, a: "sub/a.yaml", b: "b.yaml"},
+	} {
+		t.Run(test.style, func(t *testing.T) {
+			got := expandDir(t, &Expander{MarkerPathStyle: test.style, AbsRoot: test.absRoot}, files)
+			want := "runcmd:\n  # START " + test.a + "\n  - echo a\n  # START " + test.b + "\n  - echo b\n  # END " + test.b + "\n  # END " + test.a + "\n"
+			if got != want {
+				t.Errorf("got:\n%s\nwant:\n%s", got, want)
+			}
+		})
+	}
+}
+
+func TestPostHook(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("hooks run through cmd on Windows")
+	}
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("sh isn't installed")
+	}
+	// The fake sh logs its arguments, and runs the hooks the test knows.
+	binDir := t.TempDir()
+	logPath := filepath.Join(t.TempDir(), "log")
+	writeFiles(t, binDir, map[string]string{"sh": `#!/bin/sh
+echo "$@" >> "` + logPath + `"
+case "$2" in
+upper) tr a-z A-Z ;;
+fail) echo broken >&2; exit 3 ;;
+esac
+`})
+	if err := os.Chmod(filepath.Join(binDir, "sh"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", binDir+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	got, err := runPostHook("upper", "runcmd: []\n", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "RUNCMD: []\n"; got != want {
+		t.Errorf("got %q, want the hook's output %q", got, want)
+	}
+	if got, err := runPostHook("upper", "runcmd: []\n", false); err != nil || got != "runcmd: []\n" {
+		t.Errorf("got %q, %v, want the content unchanged", got, err)
+	}
+	if data, err := os.ReadFile(logPath); err != nil || string(data) != "-c upper\n-c upper\n" {
+		t.Errorf("sh ran with %q, %v, want -c upper twice", data, err)
+	}
+
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{rootTemplateName: "runcmd: []\n"})
+	outputPath := filepath.Join(t.TempDir(), "out.yaml")
+	_, stderr, err := runMain(t, "--post-hook", "fail", "-o", outputPath, dir)
+	if err == nil || !strings.Contains(stderr, "post hook 'fail' failed: exit status 3\nbroken") {
+		t.Errorf("error = %v, want the failing hook reported, stderr:\n%s", err, stderr)
+	}
+	if _, err := os.Stat(outputPath); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("the output was written despite the failing hook: %v", err)
+	}
+}
+
+func TestDirConfig(t *testing.T) {
+	// Including conf.d/ applies its config to the files of sub/ as well,
+	// sub/'s own config only applies when sub/ is included itself.
+	files := map[string]string{
+		rootTemplateName:              "parent:\n  #include: conf.d/\nsub:\n  #include: conf.d/sub/\n",
+		"conf.d/" + dirConfigName:     "order: reverse\n",
+		"conf.d/sub/" + dirConfigName: "extensions: [.yml]\n",
+		"conf.d/1.yaml":               "- 1.yaml\n",
+		"conf.d/2.yaml":               "- 2.yaml\n",
+		"conf.d/sub/3.yaml":           "- sub/3.yaml\n",
+		"conf.d/sub/4.yml":            "- sub/4.yml\n",
+	}
+	got := expandDir(t, &Expander{}, files)
+	var items []string
+	for _, line := range strings.Split(got, "\n") {
+		if item, ok := strings.CutPrefix(line, "  - "); ok {
+			items = append(items, item)
+		} else if key, ok := topLevelKey(line); ok {
+			items = append(items, key+":")
+		}
+	}
+	want := []string{"parent:", "sub/4.yml", "sub/3.yaml", "2.yaml", "1.yaml", "sub:", "sub/4.yml"}
+	if strings.Join(items, " ") != strings.Join(want, " ") {
+		t.Errorf("got %q, want %q, output:\n%s", items, want, got)
+	}
+}
+
+func TestDedupContent(t *testing.T) {
+	files := map[string]string{
+		rootTemplateName: "runcmd:\n  #include: conf.d/\n",
+		"conf.d/a.yaml":  "- echo same\n",
+		"conf.d/b.yaml":  "- echo other\n",
+		"conf.d/c.yaml":  "- echo same\n",
+	}
+	var warnings []string
+	e := &Expander{DedupContent: true, OnWarning: func(w Warning) { warnings = append(warnings, w.String()) }}
+	got := expandDir(t, e, files)
+	want := "runcmd:\n" +
+		"  # START conf.d/a.yaml\n  - echo same\n  # END conf.d/a.yaml\n" +
+		"  # START conf.d/b.yaml\n  - echo other\n  # END conf.d/b.yaml\n"
+	if got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+	if want := "conf.d/c.yaml: skipped, same content as conf.d/a.yaml"; len(warnings) != 1 || warnings[0] != want {
+		t.Errorf("warnings = %q, want %q", warnings, want)
+	}
+}
+
+func TestMissingKeys(t *testing.T) {
+	content := "#cloud-config\nusers:\n  - name: deploy\n    ssh_authorized_keys: []\nruncmd: []\n"
+	for _, test := range []struct {
+		required, want []string
+	}{
+		{required: []string{"users", "runcmd"}, want: nil},
+		{required: []string{"packages", "users", "hostname"}, want: []string{"packages", "hostname"}},
+		// Only indented in content.
+		{required: []string{"ssh_authorized_keys"}, want: []string{"ssh_authorized_keys"}},
+	} {
+		if got := missingKeys(content, test.required); strings.Join(got, ",") != strings.Join(test.want, ",") {
+			t.Errorf("missingKeys(%q) = %q, want %q", test.required, got, test.want)
+		}
+	}
+}
+
+func TestPreserveDirectives(t *testing.T) {
+	files := map[string]string{
+		rootTemplateName: "hostname: web1\nruncmd:\n  #include: a.yaml\n  - echo after\n",
+		"a.yaml":         "- echo a\n- echo b\n",
+	}
+	var sourceMap SourceMap
+	got := expandDir(t, &Expander{PreserveDirectives: true, SourceMap: &sourceMap}, files)
+	want := "hostname: web1\nruncmd:\n  #include: a.yaml\n  # START a.yaml\n  - echo a\n  - echo b\n  # END a.yaml\n\n  - echo after\n"
+	if got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+
+	// Every mapped line is the line it's mapped to, indented.
+	output := strings.Split(got, "\n")
+	mapped := 0
+	for _, m := range sourceMap.Mappings {
+		source := strings.Split(files[m.Source], "\n")
+		for i := m.OutputStart; i <= m.OutputEnd; i++ {
+			sourceLine := m.SourceLine + i - m.OutputStart
+			if strings.TrimSpace(output[i-1]) != strings.TrimSpace(source[sourceLine-1]) {
+				t.Errorf("output line %d %q is mapped to %s:%d %q", i, output[i-1], m.Source, sourceLine, source[sourceLine-1])
+			}
+			mapped++
+		}
+	}
+	if mapped != 6 {
+		t.Errorf("mapped %d lines, want 6: %+v", mapped, sourceMap.Mappings)
+	}
+}
+
+func TestWarnIncludeBytes(t *testing.T) {
+	files := map[string]string{
+		rootTemplateName: "runcmd:\n  #include: a.yaml\n",
+		"a.yaml":         "- echo a\n",
+	}
+	// What the include adds, markers and indentation included.
+	size := len("  # START a.yaml\n  - echo a\n  # END a.yaml\n")
+	for _, limit := range []int{size, size - 1} {
+		var warnings []string
+		e := &Expander{WarnIncludeBytes: limit, OnWarning: func(w Warning) { warnings = append(warnings, w.String()) }}
+		expandDir(t, e, files)
+		var want []string
+		if limit < size {
+			want = []string{fmt.Sprintf("%s:2: include 'a.yaml' adds %d bytes, more than %d", rootTemplateName, size, limit)}
+		}
+		if strings.Join(warnings, "\n") != strings.Join(want, "\n") {
+			t.Errorf("limit %d: warnings = %q, want %q", limit, warnings, want)
+		}
+	}
+}
+
+func TestMaxFileSize(t *testing.T) {
+	files := map[string]string{
+		rootTemplateName: "runcmd:\n  #include: a.yaml\n",
+		// Larger than the root template, which is checked too.
+		"a.yaml": "- echo a long enough command\n",
+	}
+	size := int64(len(files["a.yaml"]))
+	if got := expandDir(t, &Expander{MaxFileSize: size}, files); !strings.Contains(got, "- echo a long enough command\n") {
+		t.Errorf("a file at the limit isn't included, output:\n%s", got)
+	}
+
+	dir := t.TempDir()
+	writeFiles(t, dir, files)
+	e := &Expander{FS: dirFS(dir), MaxFileSize: size - 1}
+	want := fmt.Sprintf("file a.yaml has %d bytes, more than the limit of %d", size, size-1)
+	if _, err := e.ExpandFile(rootTemplateName); err == nil || !strings.Contains(err.Error(), want) {
+		t.Errorf("error = %v, want %q", err, want)
+	}
+}
+
+func TestCaseInsensitiveIncludes(t *testing.T) {
+	t.Run("single match", func(t *testing.T) {
+		files := map[string]string{
+			rootTemplateName: "runcmd:\n  #include: Conf/Base.yaml\n",
+			"conf/base.yaml": "- echo base\n",
+		}
+		var warnings []string
+		e := &Expander{CaseInsensitiveIncludes: true, OnWarning: func(w Warning) { warnings = append(warnings, w.String()) }}
+		got := expandDir(t, e, files)
+		if want := "runcmd:\n  # START conf/base.yaml\n  - echo base\n  # END conf/base.yaml\n"; got != want {
+			t.Errorf("got:\n%s\nwant:\n%s", got, want)
+		}
+		want := rootTemplateName + ":2: include path Conf/Base.yaml only matches conf/base.yaml ignoring case"
+		if len(warnings) != 1 || warnings[0] != want {
+			t.Errorf("warnings = %q, want %q", warnings, want)
+		}
+	})
+
+	t.Run("ambiguous", func(t *testing.T) {
+		dir := t.TempDir()
+		writeFiles(t, dir, map[string]string{
+			rootTemplateName: "runcmd:\n  #include: Base.yaml\n",
+			"BASE.yaml":      "- echo upper\n",
+			"base.yaml":      "- echo lower\n",
+		})
+		if _, err := os.Stat(filepath.Join(dir, "Base.yaml")); err == nil {
+			t.Skip("the file system ignores case")
+		}
+		e := &Expander{FS: dirFS(dir), CaseInsensitiveIncludes: true, OnWarning: func(Warning) {}}
+		_, err := e.ExpandFile(rootTemplateName)
+		want := rootTemplateName + ":2: include path Base.yaml is ambiguous ignoring case, it matches BASE.yaml and base.yaml"
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("error = %v, want %q", err, want)
+		}
+	})
+}
+
+func TestLibDirs(t *testing.T) {
+	files := map[string]string{
+		rootTemplateName:  "runcmd:\n  #include: sub/a.yaml\n",
+		"sub/a.yaml":      "#include: local.yaml, std/x.yaml, std/y.yaml\n",
+		"sub/local.yaml":  "- echo local\n",
+		"lib1/local.yaml": "- echo lib1 local\n",
+		"lib1/std/x.yaml": "- echo lib1 x\n",
+		"lib2/std/x.yaml": "- echo lib2 x\n",
+		"lib2/std/y.yaml": "- echo lib2 y\n",
+	}
+	got := expandDir(t, &Expander{LibDirs: []string{"lib1", "lib2"}}, files)
+	// The including file's directory comes first, then the libraries in
+	// order.
+	for _, want := range []string{"# START sub/local.yaml\n", "# START lib1/std/x.yaml\n", "# START lib2/std/y.yaml\n"} {
+		if !strings.Contains(got, want) {
+			t.Errorf("%q is missing, output:\n%s", want, got)
+		}
+	}
+	if strings.Contains(got, "lib1 local") || strings.Contains(got, "lib2 x") {
+		t.Errorf("a shadowed file is included, output:\n%s", got)
+	}
+
+	// Paths in none of them are reported relative to the including file.
+	files["sub/a.yaml"] = "#include: std/missing.yaml\n"
+	dir := t.TempDir()
+	writeFiles(t, dir, files)
+	e := &Expander{FS: dirFS(dir), LibDirs: []string{"lib1", "lib2"}}
+	if _, err := e.ExpandFile(rootTemplateName); err == nil || !strings.Contains(err.Error(), "include path not found sub/std/missing.yaml") {
+		t.Errorf("error = %v, want sub/std/missing.yaml not found", err)
+	}
+}
+
+func TestSearchPath(t *testing.T) {
+	files := map[string]string{
+		rootTemplateName:      "runcmd:\n  #include: users.yaml, base-only.yaml, local.yaml, base/users.yaml\n",
+		"site/users.yaml":     "- echo site users\n",
+		"base/users.yaml":     "- echo base users\n",
+		"base/base-only.yaml": "- echo base only\n",
+		"local.yaml":          "- echo local\n",
+		"users.yaml":          "- echo root users\n",
+	}
+	got := expandDir(t, &Expander{SearchPath: []string{"site", "base"}}, files)
+	// The first directory that has a path without a slash wins over later
+	// ones and the including file's directory, which is the fallback.
+	// Paths with a slash aren't looked up.
+	want := []string{"site/users.yaml", "base/base-only.yaml", "local.yaml", "base/users.yaml"}
+	var starts []string
+	for _, line := range strings.Split(got, "\n") {
+		if name, ok := strings.CutPrefix(line, "  # START "); ok {
+			starts = append(starts, name)
+		}
+	}
+	if strings.Join(starts, " ") != strings.Join(want, " ") {
+		t.Errorf("included %q, want %q, output:\n%s", starts, want, got)
+	}
+}
+
+func TestIncludeBase(t *testing.T) {
+	// The root template's include is relative to the working directory
+	// too with IncludeBaseCwd, hence work/sub/a.yaml. y.yaml is only in
+	// the library, which every base falls back to.
+	files := map[string]string{
+		rootTemplateName:  "runcmd:\n  #include: sub/a.yaml\n",
+		"sub/a.yaml":      "#include: x.yaml, y.yaml\n",
+		"work/sub/a.yaml": "#include: x.yaml, y.yaml\n",
+		"sub/x.yaml":      "- echo sub\n",
+		"x.yaml":          "- echo root\n",
+		"work/x.yaml":     "- echo work\n",
+		"lib/y.yaml":      "- echo lib\n",
+	}
+	for _, test := range []struct {
+		base, x string
+	}{
+		{base: "", x: "sub/x.yaml"},
+		{base: IncludeBaseFile, x: "sub/x.yaml"},
+		{base: IncludeBaseRoot, x: "x.yaml"},
+		{base: IncludeBaseCwd, x: "work/x.yaml"},
+	} {
+		t.Run(test.base, func(t *testing.T) {
+			e := &Expander{IncludeBase: test.base, WorkDir: "work", LibDirs: []string{"lib"}}
+			got := expandDir(t, e, files)
+			for _, want := range []string{"# START " + test.x + "\n", "# START lib/y.yaml\n"} {
+				if !strings.Contains(got, want) {
+					t.Errorf("%q is missing, output:\n%s", want, got)
+				}
+			}
+		})
+	}
+}
+
+func TestGithubAnnotation(t *testing.T) {
+	cwd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		file    string
+		line    int
+		message string
+		want    string
+	}{
+		{file: "a.yaml", line: 3, message: "bad", want: "::error file=templates/a.yaml,line=3::bad"},
+		{file: "a.yaml", message: "bad", want: "::error file=templates/a.yaml::bad"},
+		{message: "bad", want: "::error::bad"},
+		{file: "50%,x:y.yaml", line: 1, message: "100%\r\ndone", want: "::error file=templates/50%25%2Cx%3Ay.yaml,line=1::100%25%0D%0Adone"},
+	} {
+		got := githubAnnotation("error", filepath.Join(cwd, "templates"), test.file, test.line, test.message)
+		if got != test.want {
+			t.Errorf("githubAnnotation(%q, %d, %q) = %q, want %q", test.file, test.line, test.message, got, test.want)
+		}
+	}
+}
+
+func TestReplaceManagedBlock(t *testing.T) {
+	target := "#!/bin/sh\nwrite() {\n  # BEGIN GENERATED\n  old\n  # END GENERATED\n}\n"
+	want := "#!/bin/sh\nwrite() {\n  # BEGIN GENERATED\n  runcmd:\n    - echo hi\n\n  # END GENERATED\n}\n"
+	got, err := replaceManagedBlock(target, "runcmd:\n  - echo hi\n\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+	// Replacing again gives the same result.
+	again, err := replaceManagedBlock(got, "runcmd:\n  - echo hi\n\n")
+	if err != nil || again != got {
+		t.Errorf("replacing again gives %q, %v, want it unchanged:\n%s", again, err, got)
+	}
+
+	for _, test := range []struct {
+		target, want string
+	}{
+		{target: "a: 1\n", want: `no "# BEGIN GENERATED" line`},
+		{target: "# BEGIN GENERATED\n# BEGIN GENERATED\n# END GENERATED\n", want: `line 2: second "# BEGIN GENERATED", the first is on line 1`},
+		{target: "# BEGIN GENERATED\n# END GENERATED\n# END GENERATED\n", want: `line 3: "# END GENERATED" without a "# BEGIN GENERATED" before it`},
+		{target: "# END GENERATED\n# BEGIN GENERATED\n", want: `line 1: "# END GENERATED" without a "# BEGIN GENERATED" before it`},
+		{target: "x\n# BEGIN GENERATED\n", want: `line 2: "# BEGIN GENERATED" without a "# END GENERATED" after it`},
+	} {
+		if _, err := replaceManagedBlock(test.target, "a: 1\n"); err == nil || err.Error() != test.want {
+			t.Errorf("replaceManagedBlock(%q) error = %v, want %q", test.target, err, test.want)
+		}
+	}
+}
+
+func TestShellQuote(t *testing.T) {
+	for _, test := range []struct {
+		content, style, want string
+	}{
+		{content: "", style: "heredoc", want: "cat <<'EOF'\nEOF\n"},
+		{content: "a\nb", style: "heredoc", want: "cat <<'EOF'\na\nb\nEOF\n"},
+		{content: "EOF\n$HOME\n", style: "heredoc", want: "cat <<'EOF_1'\nEOF\n$HOME\nEOF_1\n"},
+		{content: "", style: "single", want: "''\n"},
+		{content: "it's $HOME\n", style: "single", want: "'it'\\''s $HOME\n'\n"},
+		{content: "", style: "double", want: "\"\"\n"},
+		{content: "it's $HOME `id` \"q\" \\\n", style: "double", want: "\"it's \\$HOME \\`id\\` \\\"q\\\" \\\\\n\"\n"},
+	} {
+		got, err := shellQuote(test.content, test.style)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != test.want {
+			t.Errorf("shellQuote(%q, %s) = %q, want %q", test.content, test.style, got, test.want)
+		}
+		if _, err := exec.LookPath("sh"); err != nil || runtime.GOOS == "windows" {
+			continue
+		}
+		// The shell gets the content back, a here-document ending in a
+		// newline.
+		script, want := "printf %s "+got, test.content
+		if test.style == "heredoc" {
+			script = got
+			if want != "" && !strings.HasSuffix(want, "\n") {
+				want += "\n"
+			}
+		}
+		if out, err := exec.Command("sh", "-c", script).Output(); err != nil || string(out) != want {
+			t.Errorf("%s quoted %q gives %q in the shell, %v", test.style, test.content, out, err)
+		}
+	}
+	if _, err := shellQuote("a", "backticks"); err == nil {
+		t.Error("an unknown style isn't an error")
+	}
+}
+
+func TestDataURL(t *testing.T) {
+	for _, test := range []struct {
+		content, encoding, prefix string
+	}{
+		{content: "#cloud-config\nruncmd:\n  - echo 'it''s $HOME'\n", encoding: "text", prefix: "data:text/cloud-config;charset=utf-8;base64,"},
+		{content: "#!/bin/sh\necho hi\n", encoding: "text", prefix: "data:text/x-shellscript;charset=utf-8;base64,"},
+		{content: "", encoding: "text", prefix: "data:text/plain;charset=utf-8;base64,"},
+		{content: "#cloud-config\nruncmd: []\n", encoding: "gzip", prefix: "data:application/gzip;base64,"},
+		{content: "", encoding: "gzip", prefix: "data:application/gzip;base64,"},
+	} {
+		got, err := dataURL(test.content, test.encoding)
+		if err != nil {
+			t.Fatal(err)
+		}
+		encoded, ok := strings.CutPrefix(got, test.prefix)
+		if !ok || !strings.HasSuffix(encoded, "\n") {
+			t.Errorf("dataURL(%q, %s) = %q, want it to start with %q and end in a newline", test.content, test.encoding, got, test.prefix)
+			continue
+		}
+		data, err := base64.StdEncoding.DecodeString(strings.TrimSuffix(encoded, "\n"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if test.encoding == "gzip" {
+			r, err := gzip.NewReader(bytes.NewReader(data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if data, err = io.ReadAll(r); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if string(data) != test.content {
+			t.Errorf("dataURL(%q, %s) decodes to %q", test.content, test.encoding, data)
+		}
+	}
+	if _, err := dataURL("a", "zip"); err == nil {
+		t.Error("an unknown encoding isn't an error")
+	}
+}
+
+func TestPreprocessOnly(t *testing.T) {
+	dir := t.TempDir()
+	// missing.yaml doesn't exist, as includes aren't resolved.
+	writeFiles(t, dir, map[string]string{
+		rootTemplateName: "hostname: ${HOST}\n#if DEBUG\ndebug: true\n#else\ndebug: false\n#endif\nruncmd:\n  #include: missing.yaml\n  #include-literal: missing.sh\n",
+	})
+	stdout, stderr, err := runMain(t, "--preprocess-only", "--set", "HOST=web1", dir)
+	if err != nil {
+		t.Fatalf("%v, stderr:\n%s", err, stderr)
+	}
+	if want := "hostname: web1\ndebug: false\nruncmd:\n  #include: missing.yaml\n  #include-literal: missing.sh\n"; stdout != want {
+		t.Errorf("got:\n%s\nwant:\n%s", stdout, want)
+	}
+}
+
+func TestParseOnly(t *testing.T) {
+	dir := t.TempDir()
+	// Includes aren't resolved, so the missing files don't matter.
+	writeFiles(t, dir, map[string]string{
+		rootTemplateName: "runcmd:\n  #include: missing.yaml\n  #include:\n",
+		"sub/a.yaml":     "#if X\n- x\n#include-file: a.sh mode=rw\n",
+		"sub/ok.yml":     "#include: other.yaml nosep\n",
+	})
+	_, stderr, err := runMain(t, "--parse-only", dir)
+	if err == nil || !strings.Contains(stderr, "Error: 3 malformed directive(s).") {
+		t.Errorf("error = %v, want 3 malformed directives, stderr:\n%s", err, stderr)
+	}
+	for _, want := range []string{
+		rootTemplateName + ":3: #include: without a path\n",
+		"sub/a.yaml:3: invalid mode 'rw', expected an octal number like 0644\n",
+		"sub/a.yaml:1: #if without #endif\n",
+	} {
+		if !strings.Contains(stderr, want) {
+			t.Errorf("%q isn't reported, stderr:\n%s", want, stderr)
+		}
+	}
+	if strings.Contains(stderr, "ok.yml") {
+		t.Errorf("a valid file is reported, stderr:\n%s", stderr)
+	}
+}
+
+func TestDumpAST(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		rootTemplateName: "hostname: ${H}\n#if X\nx: 1\n#endif\nruncmd:\n  #include: a.yaml\n",
+	})
+
+	stdout, stderr, err := runMain(t, "--dump-ast", "text", dir)
+	if err != nil {
+		t.Fatalf("%v, stderr:\n%s", err, stderr)
+	}
+	want := "1 literal \"hostname: ${H}\"\n2 if args=[\"X\"]\n  3 literal \"x: 1\"\n4 endif\n5 literal \"runcmd:\"\n6 include indent=\"  \" args=[\"a.yaml\"]\n"
+	if stdout != want {
+		t.Errorf("got:\n%s\nwant:\n%s", stdout, want)
+	}
+
+	stdout, stderr, err = runMain(t, "--dump-ast", "json", dir)
+	if err != nil {
+		t.Fatalf("%v, stderr:\n%s", err, stderr)
+	}
+	var nodes []Node
+	if err := json.Unmarshal([]byte(stdout), &nodes); err != nil {
+		t.Fatalf("%v, output:\n%s", err, stdout)
+	}
+	var kinds []string
+	for _, node := range nodes {
+		kinds = append(kinds, fmt.Sprintf("%d %s %q", node.Line, node.Kind, node.Args))
+	}
+	wantKinds := []string{`1 literal []`, `2 if ["X"]`, `3 literal []`, `4 endif []`, `5 literal []`, `6 include ["a.yaml"]`}
+	if strings.Join(kinds, "\n") != strings.Join(wantKinds, "\n") {
+		t.Fatalf("got nodes %q, want %q", kinds, wantKinds)
+	}
+	if last := nodes[len(nodes)-1]; last.Indentation != "  " || len(last.Lines) != 1 || last.Lines[0] != "  #include: a.yaml" {
+		t.Errorf("got the include node %+v", last)
+	}
+}
+
+func TestParse(t *testing.T) {
+	for _, test := range []struct {
+		line string
+		kind NodeKind
+		args []string
+	}{
+		{line: "runcmd:", kind: NodeLiteral},
+		{line: "# include: x.yaml", kind: NodeLiteral},
+		{line: "  #include: a.yaml, b.yaml dedent", kind: NodeInclude, args: []string{"a.yaml", "b.yaml dedent"}},
+		{line: "#include-env: overlays", kind: NodeIncludeEnv, args: []string{"overlays"}},
+		{line: "#include-unless-key: users users.yaml", kind: NodeIncludeUnlessKey, args: []string{"users", "users.yaml"}},
+		{line: "#repeat: 3 worker.yaml", kind: NodeRepeat, args: []string{"3", "worker.yaml"}},
+		{line: "#include-file: a.conf dest=/etc/a.conf mode=0644", kind: NodeIncludeFile, args: []string{"a.conf", "dest=/etc/a.conf", "mode=0644"}},
+		{line: "#include-diff: base.yaml overlay.yaml", kind: NodeIncludeDiff, args: []string{"base.yaml", "overlay.yaml"}},
+		{line: "#include-filter: enabled *.yaml !*.off.yaml", kind: NodeIncludeFilter, args: []string{"enabled", "*.yaml", "!*.off.yaml"}},
+		{line: "    content: #include-literal: setup.sh strip", kind: NodeIncludeLiteral, args: []string{"    content: ", "    ", "setup.sh", "strip"}},
+		{line: "##include: old.yaml", kind: NodeDisabledInclude, args: []string{"old.yaml"}},
+		{line: "#include-disabled: old.yaml", kind: NodeDisabledInclude, args: []string{"old.yaml"}},
+		{line: "#if DEBUG", kind: NodeIf, args: []string{"DEBUG"}},
+		{line: "#else", kind: NodeElse},
+		{line: "#endif", kind: NodeEndif},
+	} {
+		nodes, err := Parse(strings.NewReader(test.line + "\n"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(nodes) != 1 || nodes[0].Kind != test.kind || fmt.Sprintf("%q", nodes[0].Args) != fmt.Sprintf("%q", test.args) {
+			t.Errorf("Parse(%q) = %+v, want a %s node with the args %q", test.line, nodes, test.kind, test.args)
+		}
+	}
+}
+
+func TestParseEnvFile(t *testing.T) {
+	data := `# database
+export DB_HOST=db.internal
+DB_PORT = 5432   # the default
+DB_URL=postgres://${DB_HOST}:${DB_PORT}/app
+SINGLE='${DB_HOST} # kept'
+DOUBLE="a\t\"b\" \$HOME ${DB_HOST}
+next line"
+FROM_ENV=${HOME_DIR}/app
+UNDEFINED=[${NOPE}]
+`
+	env := map[string]string{"HOME_DIR": "/home/deploy"}
+	vars, err := parseEnvFile(data, func(name string) (string, bool) {
+		value, ok := env[name]
+		return value, ok
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"DB_HOST":   "db.internal",
+		"DB_PORT":   "5432",
+		"DB_URL":    "postgres://db.internal:5432/app",
+		"SINGLE":    "${DB_HOST} # kept",
+		"DOUBLE":    "a\t\"b\" $HOME db.internal\nnext line",
+		"FROM_ENV":  "/home/deploy/app",
+		"UNDEFINED": "[]",
+	}
+	if fmt.Sprint(vars) != fmt.Sprint(want) {
+		t.Errorf("got %q\nwant %q", vars, want)
+	}
+
+	for _, test := range []struct {
+		data, want string
+	}{
+		{data: "A=1\nnot a variable\n", want: "line 2: expected NAME=VALUE"},
+		{data: "A='open\n", want: "line 1: unterminated single-quoted value"},
+	} {
+		if _, err := parseEnvFile(test.data, func(string) (string, bool) { return "", false }); err == nil || err.Error() != test.want {
+			t.Errorf("parseEnvFile(%q) error = %v, want %q", test.data, err, test.want)
+		}
+	}
+}
+
+func TestEmptyCommands(t *testing.T) {
+	content := `runcmd:
+  - echo ok
+  -
+  - null
+  - ~ # nothing
+  - ""
+  - ''
+  - []
+  - [ls, -l]
+  -
+    - ls
+    - -l
+  - - nested
+  - # a comment only
+bootcmd:
+  - ""
+packages:
+  -
+  - ""
+write_files: []
+`
+	want := []string{
+		"runcmd item 1 on line 3 is null",
+		"runcmd item 2 on line 4 is null",
+		"runcmd item 3 on line 5 is null",
+		"runcmd item 4 on line 6 is an empty string",
+		"runcmd item 5 on line 7 is an empty string",
+		"runcmd item 6 on line 8 is an empty list",
+		"runcmd item 10 on line 14 is null",
+		"bootcmd item 0 on line 16 is an empty string",
+	}
+	if got := emptyCommands(content); strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestWarnDuplicateIncludes(t *testing.T) {
+	// extra.yaml is included by the directory include and on its own.
+	files := map[string]string{
+		rootTemplateName:    "runcmd:\n  #include: conf.d/\n  #include: conf.d/extra.yaml\n",
+		"conf.d/base.yaml":  "- echo base\n",
+		"conf.d/extra.yaml": "- echo extra\n",
+	}
+	var warnings []string
+	e := &Expander{WarnDuplicateIncludes: true, OnWarning: func(w Warning) { warnings = append(warnings, w.String()) }}
+	expandDir(t, e, files)
+	want := "conf.d/extra.yaml: included 2 times, by " + rootTemplateName + ":2, " + rootTemplateName + ":3"
+	if len(warnings) != 1 || warnings[0] != want {
+		t.Errorf("warnings = %q, want %q", warnings, want)
+	}
+}
+
+func TestDirWrap(t *testing.T) {
+	files := map[string]string{
+		rootTemplateName: "runcmd:\n  #include: conf.d/\n  - echo after\n",
+		"conf.d/a.yaml":  "- echo a\n",
+		"conf.d/b.yaml":  "- echo b\n",
+	}
+	got := expandDir(t, &Expander{DirWrap: true}, files)
+	want := "runcmd:\n  # START conf.d/\n" +
+		"    # START conf.d/a.yaml\n  - echo a\n    # END conf.d/a.yaml\n" +
+		"    # START conf.d/b.yaml\n  - echo b\n    # END conf.d/b.yaml\n" +
+		"  # END conf.d/\n\n  - echo after\n"
+	if got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestBase64Width(t *testing.T) {
+	data := strings.Repeat("\x00\x01\x02\xff", 10)
+	files := map[string]string{
+		rootTemplateName: "write_files:\n  #include-file: blob.bin dest=/opt/blob.bin\n",
+		"blob.bin":       data,
+	}
+	encoded := base64.StdEncoding.EncodeToString([]byte(data))
+
+	got := expandDir(t, &Expander{}, files)
+	if want := "    content: " + encoded + "\n"; !strings.Contains(got, want) {
+		t.Errorf("got:\n%s\nwant a single line %q", got, want)
+	}
+
+	got = expandDir(t, &Expander{Base64Width: 20}, files)
+	want := "  - path: \"/opt/blob.bin\"\n    encoding: b64\n    content: |\n" +
+		"      " + encoded[:20] + "\n      " + encoded[20:40] + "\n      " + encoded[40:] + "\n"
+	if !strings.HasSuffix(got, want) {
+		t.Errorf("got:\n%s\nwant it to end in:\n%s", got, want)
+	}
+}
+
+func TestSkipEmptyIncludes(t *testing.T) {
+	files := map[string]string{
+		rootTemplateName: "runcmd:\n  #include: empty.yaml, a.yaml\n  - echo after\n",
+		"empty.yaml":     "# only a comment\n\n",
+		"a.yaml":         "- echo a\n",
+	}
+	got := expandDir(t, &Expander{SkipEmptyIncludes: true}, files)
+	if want := "runcmd:\n  # START a.yaml\n  - echo a\n  # END a.yaml\n\n  - echo after\n"; got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestExpandTabs(t *testing.T) {
+	// Tabs go to the next tab stop, and only in indentation.
+	files := map[string]string{
+		rootTemplateName: "a:\n  #include: tabs.yaml\n",
+		"tabs.yaml":      "b:\n\tc: 1\n\t\td: \"x\ty\"\n  \te: 2\n",
+	}
+	got := expandDir(t, &Expander{ExpandTabs: 4}, files)
+	want := "a:\n  # START tabs.yaml\n  b:\n      c: 1\n          d: \"x\ty\"\n      e: 2\n  # END tabs.yaml\n"
+	if got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestLineEndings(t *testing.T) {
+	// The templates' own line endings don't matter.
+	files := map[string]string{
+		rootTemplateName: "runcmd:\r\n  #include: a.yaml\r\n  - echo root\n",
+		"a.yaml":         "- echo a\r\n",
+	}
+	included := "  # START a.yaml\n  - echo a\n  # END a.yaml\n"
+	for _, test := range []struct {
+		lineEnding, includeLineEnding, want string
+	}{
+		{want: "runcmd:\n" + included + "\n  - echo root\n"},
+		{lineEnding: "\r\n", want: strings.ReplaceAll("runcmd:\n"+included+"\n  - echo root\n", "\n", "\r\n")},
+		{lineEnding: "\r\n", includeLineEnding: "\n", want: "runcmd:\r\n" + included + "\r\n  - echo root\r\n"},
+	} {
+		got := expandDir(t, &Expander{LineEnding: test.lineEnding, IncludeLineEnding: test.includeLineEnding}, files)
+		if got != test.want {
+			t.Errorf("LineEnding %q, IncludeLineEnding %q: got %q, want %q", test.lineEnding, test.includeLineEnding, got, test.want)
+		}
+	}
+}
+
+func TestErrorOnEmptyDir(t *testing.T) {
+	for _, test := range []struct {
+		name  string
+		files map[string]string
+		want  string
+	}{
+		{name: "empty", want: "directory conf.d has no files"},
+		{
+			name:  "excluded",
+			files: map[string]string{"conf.d/" + dirConfigName: "extensions: [.yml]\n", "conf.d/a.yaml": "- echo a\n"},
+			want:  "directory conf.d has no files to include, the 1 it has are excluded by its " + dirConfigName + " or skipped",
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			if err := os.MkdirAll(filepath.Join(dir, "conf.d"), 0o755); err != nil {
+				t.Fatal(err)
+			}
+			writeFiles(t, dir, test.files)
+			writeFiles(t, dir, map[string]string{rootTemplateName: "runcmd:\n  #include: conf.d/\n"})
+
+			e := &Expander{FS: dirFS(dir), OnWarning: func(Warning) {}}
+			if got, err := e.ExpandFile(rootTemplateName); err != nil || got != "runcmd:\n" {
+				t.Errorf("without ErrorOnEmptyDir, got %q, %v, want the directory to add nothing", got, err)
+			}
+			e.ErrorOnEmptyDir = true
+			if _, err := e.ExpandFile(rootTemplateName); err == nil || !strings.Contains(err.Error(), test.want) {
+				t.Errorf("error = %v, want %q", err, test.want)
+			}
+		})
+	}
+}
+
+func TestTrimTrailingWhitespace(t *testing.T) {
+	// Trailing whitespace in block scalars is part of their value.
+	files := map[string]string{
+		rootTemplateName: "hostname: web1  \nwrite_files:\n  - path: /etc/motd \t\n    content: |  \n      keep  \n\n      this\t\nruncmd: \n  - echo hi \n",
+	}
+	got := expandDir(t, &Expander{TrimTrailingWhitespace: true}, files)
+	want := "hostname: web1\nwrite_files:\n  - path: /etc/motd\n    content: |\n      keep  \n\n      this\t\nruncmd:\n  - echo hi\n"
+	if got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestCheckIncludes(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		rootTemplateName: "runcmd:\n  #include: sub/a.yaml, missing.yaml\n  - x: #include-literal: gone.sh\n",
+		"sub/a.yaml":     "#include: b.yaml\n#include: nothere.yaml\n",
+		"sub/b.yaml":     "- b\n",
+	})
+	_, stderr, err := runMain(t, "--check-includes", dir)
+	if err == nil || !strings.Contains(stderr, "Error: 3 include(s) not found.") {
+		t.Errorf("error = %v, want 3 includes not found, stderr:\n%s", err, stderr)
+	}
+	// Files that exist are checked too, those that don't only reported.
+	for _, want := range []string{
+		"sub/a.yaml:2: include path not found sub/nothere.yaml",
+		rootTemplateName + ":2: include path not found missing.yaml",
+		rootTemplateName + ":3: include path not found gone.sh",
+	} {
+		if !strings.Contains(stderr, want) {
+			t.Errorf("%q isn't reported, stderr:\n%s", want, stderr)
+		}
+	}
+
+	writeFiles(t, dir, map[string]string{rootTemplateName: "runcmd:\n  #include: sub/b.yaml\n"})
+	if stdout, stderr, err := runMain(t, "--check-includes", dir); err != nil || stdout != "" {
+		t.Errorf("got %q, %v, want nothing for includes that exist, stderr:\n%s", stdout, err, stderr)
+	}
+}
+
+func TestNoSeparator(t *testing.T) {
+	files := map[string]string{
+		rootTemplateName: "runcmd:\n  #include: a.yaml\n  #include: b.yaml\n  - echo after\n",
+		"a.yaml":         "- echo a\n",
+		"b.yaml":         "- echo b\n",
+	}
+	included := "  # START a.yaml\n  - echo a\n  # END a.yaml\n%s  # START b.yaml\n  - echo b\n  # END b.yaml\n%s"
+	for _, test := range []struct {
+		noSeparator bool
+		want        string
+	}{
+		{noSeparator: false, want: "runcmd:\n" + fmt.Sprintf(included, "\n", "\n") + "  - echo after\n"},
+		{noSeparator: true, want: "runcmd:\n" + fmt.Sprintf(included, "", "") + "  - echo after\n"},
+	} {
+		if got := expandDir(t, &Expander{NoSeparator: test.noSeparator}, files); got != test.want {
+			t.Errorf("NoSeparator %v: got:\n%s\nwant:\n%s", test.noSeparator, got, test.want)
+		}
+	}
+}
+
+func TestLintDuplicates(t *testing.T) {
+	files := map[string]string{
+		rootTemplateName:    "runcmd:\n  #include: conf.d/\n  #include: conf.d/base.yaml\n",
+		"conf.d/base.yaml":  "- echo base\n",
+		"conf.d/copy.yaml":  "- echo base\n",
+		"conf.d/other.yaml": "- echo other\n",
+	}
+	var warnings []string
+	e := &Expander{LintDuplicates: true, OnWarning: func(w Warning) { warnings = append(warnings, w.String()) }}
+	expandDir(t, e, files)
+	// base.yaml included twice isn't a duplicate of itself.
+	want := "conf.d/base.yaml: has the same content as conf.d/copy.yaml, consider including one file instead"
+	if len(warnings) != 1 || warnings[0] != want {
+		t.Errorf("warnings = %q, want %q", warnings, want)
+	}
+}
+
+func TestPrintFiles0(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		rootTemplateName: "runcmd:\n  #include: sub dir/a.yaml\n  - x: #include-literal: s.sh\n",
+		"sub dir/a.yaml": "- a\n",
+		"s.sh":           "echo hi\n",
+		"unused.yaml":    "- unused\n",
+	})
+	stdout, stderr, err := runMain(t, "--print-files0", dir)
+	if err != nil {
+		t.Fatalf("%v, stderr:\n%s", err, stderr)
+	}
+	want := strings.Join([]string{filepath.Join(dir, rootTemplateName), filepath.Join(dir, "s.sh"), filepath.Join(dir, "sub dir", "a.yaml")}, "\x00") + "\x00"
+	if stdout != want {
+		t.Errorf("got %q, want %q", stdout, want)
+	}
+}
+
+func TestStrictEmptiedIncludes(t *testing.T) {
+	// prod.yaml only has content with PROD, empty.yaml never had any.
+	files := map[string]string{
+		rootTemplateName: "runcmd:\n  #include: prod.yaml, empty.yaml\n",
+		"prod.yaml":      "#if PROD\n- echo prod\n#endif\n",
+		"empty.yaml":     "",
+	}
+	const message = "prod.yaml: 12 bytes of content are empty after substituting variables and resolving #if blocks, is a variable or --define missing?"
+
+	var warnings []string
+	e := &Expander{Defines: map[string]bool{"PROD": true}, OnWarning: func(w Warning) { warnings = append(warnings, w.String()) }}
+	expandDir(t, e, files)
+	e.Defines = nil
+	expandDir(t, e, files)
+	if len(warnings) != 1 || warnings[0] != message {
+		t.Errorf("warnings = %q, want only %q", warnings, message)
+	}
+
+	dir := t.TempDir()
+	writeFiles(t, dir, files)
+	e = &Expander{FS: dirFS(dir), Strict: true}
+	if _, err := e.ExpandFile(rootTemplateName); err == nil || !strings.Contains(err.Error(), message) {
+		t.Errorf("error = %v, want %q", err, message)
+	}
+}
+
+func TestProjectConfigDiscovery(t *testing.T) {
+	dir := t.TempDir()
+	templates := filepath.Join(dir, "a", "templates")
+	writeFiles(t, dir, map[string]string{
+		projectConfigName:                 "set: [HOST=parent]\ndefine: [DEBUG]\n",
+		"a/templates/" + rootTemplateName: "hostname: ${HOST}\n#if DEBUG\ndebug: true\n#endif\n",
+	})
+	for _, test := range []struct {
+		name   string
+		config string
+		args   []string
+		want   string
+	}{
+		{name: "above", want: "hostname: parent\ndebug: true\n"},
+		// Only the closest config is read.
+		{name: "closer", config: "set: [HOST=closer]\n", want: "hostname: closer\n"},
+		{name: "command line", config: "set: [HOST=closer]\n", args: []string{"--set", "HOST=cli"}, want: "hostname: cli\n"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			closer := filepath.Join(dir, "a", projectConfigName)
+			os.Remove(closer)
+			if test.config != "" {
+				if err := os.WriteFile(closer, []byte(test.config), 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			stdout, stderr, err := runMain(t, append(test.args, templates)...)
+			if err != nil {
+				t.Fatalf("%v, stderr:\n%s", err, stderr)
+			}
+			if stdout != test.want {
+				t.Errorf("got:\n%s\nwant:\n%s", stdout, test.want)
+			}
+		})
+	}
+}
+
+func TestSingleDocument(t *testing.T) {
+	// The root's leading marker is kept, `--- !tag` starts a document
+	// with content and is left alone.
+	files := map[string]string{
+		rootTemplateName: "#cloud-config\n---\n#include: a.yaml, b.yaml\n",
+		"a.yaml":         "---\nruncmd: []\n...\n",
+		"b.yaml":         "--- # b\nhostname: x\n--- !tag\ny: 2\n",
+	}
+	var warnings []string
+	e := &Expander{SingleDocument: true, OnWarning: func(w Warning) { warnings = append(warnings, w.String()) }}
+	got := expandDir(t, e, files)
+	want := "#cloud-config\n---\n# START a.yaml\nruncmd: []\n# END a.yaml\n\n# START b.yaml\nhostname: x\n--- !tag\ny: 2\n# END b.yaml\n"
+	if got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+	wantWarnings := []string{
+		`a.yaml:1: removed the document marker "---", the output is a single document`,
+		`a.yaml:3: removed the document marker "...", the output is a single document`,
+		`b.yaml:1: removed the document marker "---", the output is a single document`,
+	}
+	if strings.Join(warnings, "\n") != strings.Join(wantWarnings, "\n") {
+		t.Errorf("warnings = %q, want %q", warnings, wantWarnings)
+	}
+}
+
+func TestNoRootDirectives(t *testing.T) {
+	files := map[string]string{
+		rootTemplateName: "#cloud-config\n# Built from fragments\n#include: a.yaml\n#if DEBUG\ndebug: ${LEVEL}\n#endif\n",
+		"a.yaml":         "runcmd: []\n",
+	}
+	for _, test := range []struct {
+		noRootDirectives bool
+		want             string
+	}{
+		// Leading comments are content, and directives work at the root.
+		{noRootDirectives: false, want: "#cloud-config\n# Built from fragments\n# START a.yaml\nruncmd: []\n# END a.yaml\n"},
+		{noRootDirectives: true, want: "#cloud-config\n# Built from fragments\n#include: a.yaml\n#if DEBUG\ndebug: 2\n#endif\n"},
+	} {
+		e := &Expander{NoRootDirectives: test.noRootDirectives, Vars: map[string]string{"LEVEL": "2"}}
+		if got := expandDir(t, e, files); got != test.want {
+			t.Errorf("NoRootDirectives %v: got:\n%s\nwant:\n%s", test.noRootDirectives, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,6 @@
+#!/bin/sh
+set -e
+
+echo "hi: there" # not a comment
+
+